@@ -25,14 +25,14 @@ func DescribeEC2Instances(ciMap ContainerInstanceMap, sess *session.Session) (ma
     InstanceIds: ciMap.GetEc2InstanceIds(),
   }
   instances := make(map[string]*ec2.Instance)
-  resp, err := ec2_svc.DescribeInstances(params)
-  if err == nil {
-    for _, reservation := range resp.Reservations {
+  err := ec2_svc.DescribeInstancesPages(params, func(page *ec2.DescribeInstancesOutput, lastPage bool) (bool) {
+    for _, reservation := range page.Reservations {
       for _, instance := range reservation.Instances {
        instances[*instance.InstanceId] = instance
       }
     }
-  }
+    return true
+  })
   return instances, err
 }
 
@@ -0,0 +1,248 @@
+package awslib
+
+import(
+  "fmt"
+  "sort"
+  "time"
+  "github.com/aws/aws-sdk-go/aws"
+  "github.com/aws/aws-sdk-go/aws/awserr"
+  "github.com/aws/aws-sdk-go/aws/session"
+  "github.com/aws/aws-sdk-go/service/ecs"
+  "github.com/Sirupsen/logrus"
+)
+
+// Container agent health, and rolling agent updates across a cluster.
+
+type AgentStatus struct {
+  ContainerInstanceArn string
+  Ec2InstanceId string
+  // The container instance status, ACTIVE, DRAINING ...
+  Status string
+  Connected bool
+  AgentVersion string
+  AgentHash string
+  DockerVersion string
+  // PENDING, STAGING, STAGED, UPDATING, UPDATED or FAILED, empty if there's never been an update.
+  UpdateStatus string
+  Outdated bool
+  // Why the agent was flagged, empty if it's healthy.
+  Problems []string
+}
+
+func (as AgentStatus) Healthy() (bool) { return len(as.Problems) == 0 }
+
+type AgentReport struct {
+  // Sorted by EC2 instance id.
+  Instances []AgentStatus
+  // The version agents are held to: the minimum asked for, or the newest on the cluster.
+  Version string
+}
+
+// Flags agents that are disconnected, failed their last update, or are older than minVersion.
+// With an empty minVersion agents are compared with the newest agent on the cluster.
+func (ciMap ContainerInstanceMap) AgentReport(minVersion string) (r AgentReport) {
+  r.Version = minVersion
+  for _, ci := range ciMap {
+    if ci.Instance == nil { continue }
+    as := AgentStatus{
+      ContainerInstanceArn: stringPString(ci.Instance.ContainerInstanceArn),
+      Ec2InstanceId: stringPString(ci.Instance.Ec2InstanceId),
+      Status: stringPString(ci.Instance.Status),
+      Connected: ci.Instance.AgentConnected != nil && *ci.Instance.AgentConnected,
+      UpdateStatus: stringPString(ci.Instance.AgentUpdateStatus),
+    }
+    if vi := ci.Instance.VersionInfo; vi != nil {
+      as.AgentVersion = stringPString(vi.AgentVersion)
+      as.AgentHash = stringPString(vi.AgentHash)
+      as.DockerVersion = stringPString(vi.DockerVersion)
+    }
+    if minVersion == "" && compareVersions(as.AgentVersion, r.Version) > 0 { r.Version = as.AgentVersion }
+    r.Instances = append(r.Instances, as)
+  }
+  sort.Slice(r.Instances, func(i, j int) bool { return r.Instances[i].Ec2InstanceId < r.Instances[j].Ec2InstanceId })
+
+  for i := range r.Instances {
+    as := &r.Instances[i]
+    if !as.Connected { as.Problems = append(as.Problems, "agent disconnected") }
+    if as.UpdateStatus == ecs.AgentUpdateStatusFailed { as.Problems = append(as.Problems, "last agent update failed") }
+    if as.AgentVersion == "" {
+      as.Problems = append(as.Problems, "agent version unknown")
+    } else if compareVersions(as.AgentVersion, r.Version) < 0 {
+      as.Outdated = true
+      as.Problems = append(as.Problems, fmt.Sprintf("agent %s is older than %s", as.AgentVersion, r.Version))
+    }
+  }
+  return r
+}
+
+func (r AgentReport) Flagged() (flagged []AgentStatus) {
+  for _, as := range r.Instances {
+    if !as.Healthy() { flagged = append(flagged, as) }
+  }
+  return flagged
+}
+
+// The connected ACTIVE instances with outdated agents, the ones UpdateContainerAgent can do something about.
+func (r AgentReport) Updatable() (arns []string) {
+  for _, as := range r.Instances {
+    if as.Outdated && as.Connected && as.Status == ContainerInstanceActive { arns = append(arns, as.ContainerInstanceArn) }
+  }
+  return arns
+}
+
+// e.g.
+// instance             agent    docker     connected  update   problems
+// i-0a1b2c3d4e5f60718  1.14.2   17.03.2-ce true       UPDATED  agent 1.14.2 is older than 1.20.0
+func (r AgentReport) String() (string) {
+  s := fmt.Sprintf("%-20s %-8s %-12s %-10s %-9s %s\n", "instance", "agent", "docker", "connected", "update", "problems")
+  for _, as := range r.Instances {
+    problems := ""
+    for i, p := range as.Problems {
+      if i > 0 { problems += ", " }
+      problems += p
+    }
+    s += fmt.Sprintf("%-20s %-8s %-12s %-10t %-9s %s\n", as.Ec2InstanceId, as.AgentVersion, as.DockerVersion, as.Connected, as.UpdateStatus, problems)
+  }
+  return s
+}
+
+func GetAgentReport(clusterName, minVersion string, sess *session.Session) (r AgentReport, err error) {
+  ciMap, err := GetAllContainerInstanceDescriptions(clusterName, sess)
+  if err != nil { return r, fmt.Errorf("GetAgentReport: can't get container instances for %s: %s", clusterName, err) }
+  return ciMap.AgentReport(minVersion), err
+}
+
+type AgentUpdateProgress struct {
+  // Counting from 1.
+  Batch int
+  Batches int
+  // UpdateStatus of each instance in the batch that's still updating.
+  Pending map[string]string
+}
+
+type AgentUpdateResult struct {
+  Updated []string
+  // The agent was already the latest.
+  NoUpdate []string
+  Failed map[string]error
+  // Instances we didn't get to because an earlier batch failed.
+  Skipped []string
+}
+
+const AgentUpdatePollInterval = 10 * time.Second
+
+// Updates the agents on instanceArns, batchSize instances at a time, waiting up to timeout for
+// each batch to finish before starting the next. We stop at the first batch with a failure so
+// that a bad update doesn't go across the whole cluster.
+// Progress is sent on progress (which may be nil) and the channel is closed when we're done.
+// Sends don't block, reports the caller isn't ready for are dropped, so give the channel a buffer.
+func UpdateContainerAgents(clusterName string, instanceArns []string, batchSize int, timeout time.Duration,
+  progress chan<- AgentUpdateProgress, sess *session.Session) (r AgentUpdateResult, err error) {
+
+  if progress != nil { defer close(progress) }
+  r.Failed = make(map[string]error)
+  if batchSize < 1 { batchSize = 1 }
+  batches := (len(instanceArns) + batchSize - 1) / batchSize
+  ecsSvc := ecs.New(sess)
+
+  for b := 0; b < batches; b++ {
+    start, end := b * batchSize, (b + 1) * batchSize
+    if end > len(instanceArns) { end = len(instanceArns) }
+
+    pending := make(map[string]string)
+    for _, arn := range instanceArns[start:end] {
+      _, err := ecsSvc.UpdateContainerAgent(&ecs.UpdateContainerAgentInput{
+        Cluster: aws.String(clusterName),
+        ContainerInstance: aws.String(arn),
+      })
+      if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ecs.ErrCodeNoUpdateAvailableException {
+        r.NoUpdate = append(r.NoUpdate, arn)
+      } else if ok && aerr.Code() == ecs.ErrCodeUpdateInProgressException {
+        pending[arn] = ecs.AgentUpdateStatusPending
+      } else if err != nil {
+        r.Failed[arn] = err
+      } else {
+        pending[arn] = ecs.AgentUpdateStatusPending
+      }
+    }
+
+    deadline := time.Now().Add(timeout)
+    // The last poll's error, if it failed, so a batch that times out says why.
+    var describeErr error
+    for len(pending) > 0 {
+      report := AgentUpdateProgress{Batch: b + 1, Batches: batches, Pending: make(map[string]string)}
+      for arn, status := range pending { report.Pending[arn] = status }
+      log.Debug(logrus.Fields{"cluster": clusterName, "batch": report.Batch, "batches": batches, "pending": len(pending)},
+        "UpdateContainerAgents: waiting for agent updates.")
+      if progress != nil {
+        select {
+        case progress <- report:
+        default:
+        }
+      }
+
+      if time.Now().After(deadline) {
+        for arn, status := range pending {
+          r.Failed[arn] = fmt.Errorf("timed out with agent update %s", status)
+          if describeErr != nil { r.Failed[arn] = fmt.Errorf("timed out with agent update %s, describe failed: %s", status, describeErr) }
+        }
+        break
+      }
+      time.Sleep(AgentUpdatePollInterval)
+
+      arns := make([]*string, 0, len(pending))
+      for arn := range pending { arns = append(arns, aws.String(arn)) }
+      ciMap, err := DescribeContainerInstances(clusterName, arns, sess)
+      describeErr = err
+      if err != nil {
+        log.Debug(logrus.Fields{"cluster": clusterName, "batch": b + 1, "error": err},
+          "UpdateContainerAgents: failed to describe container instances.")
+        continue
+      }
+      for arn := range pending {
+        ci, ok := ciMap[arn]
+        if !ok || ci.Instance == nil { continue }
+        status, done, err := agentUpdateState(ci.Instance)
+        pending[arn] = status
+        if !done { continue }
+        delete(pending, arn)
+        if err != nil {
+          r.Failed[arn] = err
+        } else {
+          r.Updated = append(r.Updated, arn)
+        }
+      }
+    }
+
+    if len(r.Failed) > 0 {
+      r.Skipped = append(r.Skipped, instanceArns[end:]...)
+      return r, fmt.Errorf("UpdateContainerAgents: %d agent updates failed in batch %d of %d, %d instances not updated.",
+        len(r.Failed), b + 1, batches, len(r.Skipped))
+    }
+  }
+  return r, err
+}
+
+// An update is done when it's UPDATED and the agent has reconnected, or when it has FAILED.
+func agentUpdateState(i *ecs.ContainerInstance) (status string, done bool, err error) {
+  status = stringPString(i.AgentUpdateStatus)
+  switch status {
+  case ecs.AgentUpdateStatusUpdated:
+    done = i.AgentConnected != nil && *i.AgentConnected
+  case ecs.AgentUpdateStatusFailed:
+    done = true
+    err = fmt.Errorf("agent update failed")
+  }
+  return status, done, err
+}
+
+// Updates the connected agents older than minVersion (or than the newest on the cluster), see UpdateContainerAgents.
+func UpdateOutdatedAgents(clusterName, minVersion string, batchSize int, timeout time.Duration,
+  progress chan<- AgentUpdateProgress, sess *session.Session) (r AgentUpdateResult, err error) {
+  report, err := GetAgentReport(clusterName, minVersion, sess)
+  if err != nil {
+    if progress != nil { close(progress) }
+    return r, err
+  }
+  return UpdateContainerAgents(clusterName, report.Updatable(), batchSize, timeout, progress, sess)
+}
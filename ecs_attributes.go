@@ -0,0 +1,247 @@
+package awslib
+
+import(
+  "fmt"
+  "regexp"
+  "sort"
+  "strings"
+  "github.com/aws/aws-sdk-go/aws"
+  "github.com/aws/aws-sdk-go/aws/session"
+  "github.com/aws/aws-sdk-go/service/ec2"
+  "github.com/aws/aws-sdk-go/service/ecs"
+  "github.com/Sirupsen/logrus"
+)
+
+// Custom container instance attributes, for placement constraints like attribute:ec2.tag.role == web.
+
+// Attribute values by name, by container instance arn (the ContainerInstanceMap key).
+type InstanceAttributes map[string]map[string]string
+
+func (ia InstanceAttributes) set(ciArn, name, value string) {
+  if ia[ciArn] == nil { ia[ciArn] = make(map[string]string) }
+  ia[ciArn][name] = value
+}
+
+func (ia InstanceAttributes) arns() (arns []string) {
+  for arn := range ia { arns = append(arns, arn) }
+  sort.Strings(arns)
+  return arns
+}
+
+func attributeNames(attrs map[string]string) (names []string) {
+  for name := range attrs { names = append(names, name) }
+  sort.Strings(names)
+  return names
+}
+
+func sortedArns(m map[string][]string) (arns []string) {
+  for arn := range m { arns = append(arns, arn) }
+  sort.Strings(arns)
+  return arns
+}
+
+// All the instance's attributes, the ecs.* ones included.
+func (ci *ContainerInstance) Attributes() (attrs map[string]string) {
+  attrs = make(map[string]string)
+  if ci.Instance == nil { return attrs }
+  for _, a := range ci.Instance.Attributes {
+    if a.Name != nil { attrs[*a.Name] = stringPString(a.Value) }
+  }
+  return attrs
+}
+
+// PutAttributes and DeleteAttributes take at most this many attributes at a time.
+const putAttributesMax = 10
+
+// Sets attributes on a container instance, replacing the values of any it already has.
+func PutAttributes(clusterName, containerArn string, attrs map[string]string, sess *session.Session) (err error) {
+  names := attributeNames(attrs)
+  for _, name := range names {
+    if err := validAttribute(name, attrs[name]); err != nil { return fmt.Errorf("PutAttributes: %s", err) }
+  }
+  ecsSvc := ecs.New(sess)
+  for start := 0; start < len(names); start += putAttributesMax {
+    end := start + putAttributesMax
+    if end > len(names) { end = len(names) }
+    params := &ecs.PutAttributesInput{Cluster: aws.String(clusterName)}
+    for _, name := range names[start:end] {
+      params.Attributes = append(params.Attributes, &ecs.Attribute{
+        Name: aws.String(name),
+        Value: aws.String(attrs[name]),
+        TargetId: aws.String(containerArn),
+        TargetType: aws.String(ecs.TargetTypeContainerInstance),
+      })
+    }
+    _, err = ecsSvc.PutAttributes(params)
+    if err != nil { return fmt.Errorf("PutAttributes: failed to put attributes on %s: %s", containerArn, err) }
+  }
+  return err
+}
+
+// Removes the named attributes from a container instance.
+func DeleteAttributes(clusterName, containerArn string, names []string, sess *session.Session) (err error) {
+  ecsSvc := ecs.New(sess)
+  for start := 0; start < len(names); start += putAttributesMax {
+    end := start + putAttributesMax
+    if end > len(names) { end = len(names) }
+    params := &ecs.DeleteAttributesInput{Cluster: aws.String(clusterName)}
+    for _, name := range names[start:end] {
+      params.Attributes = append(params.Attributes, &ecs.Attribute{
+        Name: aws.String(name),
+        TargetId: aws.String(containerArn),
+        TargetType: aws.String(ecs.TargetTypeContainerInstance),
+      })
+    }
+    _, err = ecsSvc.DeleteAttributes(params)
+    if err != nil { return fmt.Errorf("DeleteAttributes: failed to delete attributes from %s: %s", containerArn, err) }
+  }
+  return err
+}
+
+// The attributes on the cluster's container instances. An empty name lists them all.
+func ListAttributes(clusterName, name string, sess *session.Session) (ia InstanceAttributes, err error) {
+  ia = make(InstanceAttributes)
+  params := &ecs.ListAttributesInput{
+    Cluster: aws.String(clusterName),
+    TargetType: aws.String(ecs.TargetTypeContainerInstance),
+  }
+  if name != "" { params.AttributeName = aws.String(name) }
+  err = ecs.New(sess).ListAttributesPages(params, func(page *ecs.ListAttributesOutput, lastPage bool) (bool) {
+    for _, a := range page.Attributes {
+      if a.TargetId == nil || a.Name == nil { continue }
+      ia.set(*a.TargetId, *a.Name, stringPString(a.Value))
+    }
+    return true
+  })
+  if err != nil { return ia, fmt.Errorf("ListAttributes: failed to list attributes on %s: %s", clusterName, err) }
+  return ia, err
+}
+
+var attributeNameRE = regexp.MustCompile(`^[a-zA-Z0-9_./\\-]{1,128}$`)
+var attributeValueRE = regexp.MustCompile(`^[a-zA-Z0-9_.@/:\\ -]{1,128}$`)
+
+// ECS's rules for attribute names and values.
+func validAttribute(name, value string) (error) {
+  if !attributeNameRE.MatchString(name) { return fmt.Errorf("invalid attribute name %q", name) }
+  if !attributeValueRE.MatchString(value) || strings.TrimSpace(value) != value {
+    return fmt.Errorf("invalid value %q for attribute %s", value, name)
+  }
+  return nil
+}
+
+const DefaultEC2AttributePrefix = "ec2."
+
+// Which EC2 properties become attributes, named Prefix + instance-type, availability-zone and tag.<key>.
+type EC2AttributeMapping struct {
+  InstanceType bool
+  AvailabilityZone bool
+  Tags []string
+  // Defaults to DefaultEC2AttributePrefix. Attributes with the prefix are ours, and go when the property does.
+  Prefix string
+}
+
+func (m EC2AttributeMapping) prefix() (string) {
+  if m.Prefix == "" { return DefaultEC2AttributePrefix }
+  return m.Prefix
+}
+
+// The attributes m wants for an EC2 instance.
+func (m EC2AttributeMapping) attributes(i *ec2.Instance) (attrs map[string]string) {
+  attrs = make(map[string]string)
+  p := m.prefix()
+  if m.InstanceType && i.InstanceType != nil { attrs[p + "instance-type"] = *i.InstanceType }
+  if m.AvailabilityZone && i.Placement != nil && i.Placement.AvailabilityZone != nil {
+    attrs[p + "availability-zone"] = *i.Placement.AvailabilityZone
+  }
+  for _, key := range m.Tags {
+    for _, tag := range i.Tags {
+      if stringPString(tag.Key) == key { attrs[p + "tag." + key] = stringPString(tag.Value) }
+    }
+  }
+  return attrs
+}
+
+type EC2AttributeSync struct {
+  Mapping EC2AttributeMapping
+  // New or changed attributes, by container instance arn.
+  Put InstanceAttributes
+  // Attributes with our prefix the instance shouldn't have any more, including
+  // those whose new value ECS won't take, so placement doesn't go on the old one.
+  Delete map[string][]string
+  // Instances or attributes we can't do anything with.
+  Problems []string
+  DryRun bool
+  Failed map[string]error
+}
+
+func (s EC2AttributeSync) String() (string) {
+  str := ""
+  for _, arn := range s.Put.arns() {
+    for _, name := range attributeNames(s.Put[arn]) { str += fmt.Sprintf("put %s: %s=%s\n", arn, name, s.Put[arn][name]) }
+  }
+  for _, arn := range sortedArns(s.Delete) {
+    for _, name := range s.Delete[arn] { str += fmt.Sprintf("delete %s: %s\n", arn, name) }
+  }
+  for _, p := range s.Problems { str += fmt.Sprintf("problem: %s\n", p) }
+  failed := make([]string, 0, len(s.Failed))
+  for arn := range s.Failed { failed = append(failed, arn) }
+  sort.Strings(failed)
+  for _, arn := range failed { str += fmt.Sprintf("failed %s: %s\n", arn, s.Failed[arn]) }
+  return str
+}
+
+// Works out what it takes to make the instances' attributes match their EC2 properties.
+func planEC2AttributeSync(m EC2AttributeMapping, ciMap ContainerInstanceMap, ec2Map map[string]*ec2.Instance) (s EC2AttributeSync) {
+  s.Mapping = m
+  s.Put = make(InstanceAttributes)
+  s.Delete = make(map[string][]string)
+  s.Failed = make(map[string]error)
+  for arn, ci := range ciMap {
+    if ci.Instance == nil { continue }
+    ei, ok := ec2Map[stringPString(ci.Instance.Ec2InstanceId)]
+    if !ok {
+      s.Problems = append(s.Problems, fmt.Sprintf("%s: no EC2 instance %s", arn, stringPString(ci.Instance.Ec2InstanceId)))
+      continue
+    }
+    want := m.attributes(ei)
+    have := ci.Attributes()
+    for _, name := range attributeNames(want) {
+      if v, ok := have[name]; ok && v == want[name] { continue }
+      if err := validAttribute(name, want[name]); err != nil {
+        s.Problems = append(s.Problems, fmt.Sprintf("%s: %s", arn, err))
+        if _, ok := have[name]; ok { s.Delete[arn] = append(s.Delete[arn], name) }
+        continue
+      }
+      s.Put.set(arn, name, want[name])
+    }
+    for _, name := range attributeNames(have) {
+      if _, ok := want[name]; !ok && strings.HasPrefix(name, m.prefix()) { s.Delete[arn] = append(s.Delete[arn], name) }
+    }
+    sort.Strings(s.Delete[arn])
+  }
+  sort.Strings(s.Problems)
+  return s
+}
+
+// Tags the cluster's container instances with attributes from their EC2 instances, and removes the
+// ones that no longer apply, so that placement constraints follow changes to the fleet.
+// With dryRun we only work out what would change.
+func SyncEC2Attributes(clusterName string, m EC2AttributeMapping, dryRun bool, sess *session.Session) (s EC2AttributeSync, err error) {
+  ciMap, ec2Map, err := GetContainerMaps(clusterName, sess)
+  if err != nil { return s, fmt.Errorf("SyncEC2Attributes: %s", err) }
+  s = planEC2AttributeSync(m, ciMap, ec2Map)
+  s.DryRun = dryRun
+  if dryRun { return s, err }
+
+  for _, arn := range sortedArns(s.Delete) {
+    if err := DeleteAttributes(clusterName, arn, s.Delete[arn], sess); err != nil { s.Failed[arn] = err }
+  }
+  for _, arn := range s.Put.arns() {
+    if _, failed := s.Failed[arn]; failed { continue }
+    if err := PutAttributes(clusterName, arn, s.Put[arn], sess); err != nil { s.Failed[arn] = err }
+  }
+  log.Debug(logrus.Fields{"cluster": clusterName, "put": len(s.Put), "delete": len(s.Delete), "failed": len(s.Failed)},
+    "SyncEC2Attributes: done.")
+  if len(s.Failed) > 0 { err = fmt.Errorf("SyncEC2Attributes: failed to update attributes on %d instances.", len(s.Failed)) }
+  return s, err
+}
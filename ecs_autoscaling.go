@@ -0,0 +1,296 @@
+package awslib
+
+import(
+  "fmt"
+  "strings"
+  "time"
+  "github.com/aws/aws-sdk-go/aws"
+  "github.com/aws/aws-sdk-go/aws/session"
+  "github.com/aws/aws-sdk-go/service/applicationautoscaling"
+  "github.com/aws/aws-sdk-go/service/cloudwatch"
+  "github.com/Sirupsen/logrus"
+)
+
+// Service autoscaling goes through Application Auto Scaling, which
+// identifies a service as "service/<clusterName>/<serviceName>" and
+// scales its DesiredCount.
+
+const(
+  ecsScalingNamespace = "ecs"
+  ecsScalableDimension = "ecs:service:DesiredCount"
+)
+
+// Like the functions in ecs_service.go these take names or arns, but scaling wants the names.
+// Newer service arns are service/<clusterName>/<serviceName>, so the service's is the last part.
+func scalingNames(serviceName, clusterName string) (string, string) {
+  if i := strings.LastIndex(serviceName, "/"); i >= 0 { serviceName = serviceName[i+1:] }
+  return serviceName, ShortArnString(&clusterName)
+}
+
+func serviceResourceId(serviceName, clusterName string) (string) {
+  serviceName, clusterName = scalingNames(serviceName, clusterName)
+  return fmt.Sprintf("service/%s/%s", clusterName, serviceName)
+}
+
+// The service metrics we scale on.
+type ServiceScalingMetric int
+const(
+  CPUScalingMetric ServiceScalingMetric = iota
+  MemoryScalingMetric
+)
+
+func (m ServiceScalingMetric) String() (string) {
+  switch m {
+  case CPUScalingMetric: return CPU
+  case MemoryScalingMetric: return MEMORY
+  }
+  return "UNKNOWN"
+}
+
+func (m ServiceScalingMetric) predefinedMetricType() (string) {
+  if m == MemoryScalingMetric { return "ECSServiceAverageMemoryUtilization" }
+  return "ECSServiceAverageCPUUtilization"
+}
+
+// Name of the metric in the AWS/ECS CloudWatch namespace.
+func (m ServiceScalingMetric) cloudWatchMetricName() (string) {
+  if m == MemoryScalingMetric { return "MemoryUtilization" }
+  return "CPUUtilization"
+}
+
+// Makes the service scalable between minCount and maxCount tasks.
+// Also used to change min and max on an already registered service.
+func RegisterServiceScalableTarget(serviceName, clusterName string, minCount, maxCount int64, sess *session.Session) (err error) {
+  aasSvc := applicationautoscaling.New(sess)
+  params := &applicationautoscaling.RegisterScalableTargetInput{
+    ServiceNamespace: aws.String(ecsScalingNamespace),
+    ScalableDimension: aws.String(ecsScalableDimension),
+    ResourceId: aws.String(serviceResourceId(serviceName, clusterName)),
+    MinCapacity: aws.Int64(minCount),
+    MaxCapacity: aws.Int64(maxCount),
+  }
+  _, err = aasSvc.RegisterScalableTarget(params)
+  if err != nil { return err }
+  log.Debug(logrus.Fields{"service": serviceName, "cluster": clusterName, "min": minCount, "max": maxCount},
+    "Registered service scalable target.")
+  return err
+}
+
+// This also deletes the scaling policies on the service, and the alarms
+// PutServiceStepScalingPolicy made for them.
+func DeregisterServiceScalableTarget(serviceName, clusterName string, sess *session.Session) (err error) {
+  policies, err := ListServiceScalingPolicies(serviceName, clusterName, sess)
+  if err != nil { return err }
+
+  aasSvc := applicationautoscaling.New(sess)
+  params := &applicationautoscaling.DeregisterScalableTargetInput{
+    ServiceNamespace: aws.String(ecsScalingNamespace),
+    ScalableDimension: aws.String(ecsScalableDimension),
+    ResourceId: aws.String(serviceResourceId(serviceName, clusterName)),
+  }
+  _, err = aasSvc.DeregisterScalableTarget(params)
+  if err != nil { return err }
+
+  alarms := make([]string, 0, len(policies))
+  for _, p := range policies {
+    if p.PolicyName != nil { alarms = append(alarms, stepScalingAlarmName(serviceName, clusterName, *p.PolicyName)) }
+  }
+  return deleteScalingAlarms(alarms, sess)
+}
+
+// Returns nil if the service is not registered as a scalable target.
+func GetServiceScalableTarget(serviceName, clusterName string, sess *session.Session) (t *applicationautoscaling.ScalableTarget, err error) {
+  aasSvc := applicationautoscaling.New(sess)
+  params := &applicationautoscaling.DescribeScalableTargetsInput{
+    ServiceNamespace: aws.String(ecsScalingNamespace),
+    ScalableDimension: aws.String(ecsScalableDimension),
+    ResourceIds: []*string{aws.String(serviceResourceId(serviceName, clusterName))},
+  }
+  resp, err := aasSvc.DescribeScalableTargets(params)
+  if err == nil && len(resp.ScalableTargets) > 0 { t = resp.ScalableTargets[0] }
+  return t, err
+}
+
+// Keeps the service's average metric at target percent.
+// Cooldowns of 0 leave the Application Auto Scaling defaults.
+func PutServiceTargetTrackingPolicy(serviceName, clusterName, policyName string, metric ServiceScalingMetric,
+  target float64, scaleInCooldown, scaleOutCooldown time.Duration, sess *session.Session) (policyArn string, err error) {
+  params := targetTrackingPolicyInput(serviceName, clusterName, policyName, metric, target, scaleInCooldown, scaleOutCooldown)
+  resp, err := applicationautoscaling.New(sess).PutScalingPolicy(params)
+  if err == nil { policyArn = *resp.PolicyARN }
+  return policyArn, err
+}
+
+func targetTrackingPolicyInput(serviceName, clusterName, policyName string, metric ServiceScalingMetric,
+  target float64, scaleInCooldown, scaleOutCooldown time.Duration) (*applicationautoscaling.PutScalingPolicyInput) {
+  config := &applicationautoscaling.TargetTrackingScalingPolicyConfiguration{
+    TargetValue: aws.Float64(target),
+    PredefinedMetricSpecification: &applicationautoscaling.PredefinedMetricSpecification{
+      PredefinedMetricType: aws.String(metric.predefinedMetricType()),
+    },
+  }
+  if scaleInCooldown > 0 { config.ScaleInCooldown = aws.Int64(int64(scaleInCooldown / time.Second)) }
+  if scaleOutCooldown > 0 { config.ScaleOutCooldown = aws.Int64(int64(scaleOutCooldown / time.Second)) }
+
+  return &applicationautoscaling.PutScalingPolicyInput{
+    PolicyName: aws.String(policyName),
+    PolicyType: aws.String("TargetTrackingScaling"),
+    ServiceNamespace: aws.String(ecsScalingNamespace),
+    ScalableDimension: aws.String(ecsScalableDimension),
+    ResourceId: aws.String(serviceResourceId(serviceName, clusterName)),
+    TargetTrackingScalingPolicyConfiguration: config,
+  }
+}
+
+// A step policy is fired by a CloudWatch alarm on the service's metric.
+// Step bounds are relative to Threshold.
+type StepScalingPolicy struct {
+  PolicyName string
+  Metric ServiceScalingMetric
+  Threshold float64
+  // true to alarm when the metric is >= Threshold, false for <= Threshold.
+  ScaleOut bool
+  // Defaults to ChangeInCapacity.
+  AdjustmentType string
+  Steps []*applicationautoscaling.StepAdjustment
+  Cooldown time.Duration
+  // The alarm fires after EvaluationPeriods of Period. Defaults to 1 and 1 minute.
+  EvaluationPeriods int64
+  Period time.Duration
+}
+
+// Creates (or updates) the step policy and the CloudWatch alarm that fires it.
+// The alarm is named after the policy and service.
+func PutServiceStepScalingPolicy(serviceName, clusterName string, p StepScalingPolicy,
+  sess *session.Session) (policyArn string, err error) {
+
+  resp, err := applicationautoscaling.New(sess).PutScalingPolicy(p.policyInput(serviceName, clusterName))
+  if err != nil { return policyArn, err }
+  policyArn = *resp.PolicyARN
+
+  _, err = cloudwatch.New(sess).PutMetricAlarm(p.alarmInput(serviceName, clusterName, policyArn))
+  if err != nil {
+    err = fmt.Errorf("Created scaling policy %s but failed to create its alarm: %s", p.PolicyName, err)
+  }
+  return policyArn, err
+}
+
+func (p StepScalingPolicy) policyInput(serviceName, clusterName string) (*applicationautoscaling.PutScalingPolicyInput) {
+  adjustment := p.AdjustmentType
+  if adjustment == "" { adjustment = "ChangeInCapacity" }
+  config := &applicationautoscaling.StepScalingPolicyConfiguration{
+    AdjustmentType: aws.String(adjustment),
+    MetricAggregationType: aws.String("Average"),
+    StepAdjustments: p.Steps,
+  }
+  if p.Cooldown > 0 { config.Cooldown = aws.Int64(int64(p.Cooldown / time.Second)) }
+
+  return &applicationautoscaling.PutScalingPolicyInput{
+    PolicyName: aws.String(p.PolicyName),
+    PolicyType: aws.String("StepScaling"),
+    ServiceNamespace: aws.String(ecsScalingNamespace),
+    ScalableDimension: aws.String(ecsScalableDimension),
+    ResourceId: aws.String(serviceResourceId(serviceName, clusterName)),
+    StepScalingPolicyConfiguration: config,
+  }
+}
+
+func (p StepScalingPolicy) alarmInput(serviceName, clusterName, policyArn string) (*cloudwatch.PutMetricAlarmInput) {
+  periods := p.EvaluationPeriods
+  if periods <= 0 { periods = 1 }
+  period := p.Period
+  if period <= 0 { period = time.Minute }
+  comparison := "LessThanOrEqualToThreshold"
+  if p.ScaleOut { comparison = "GreaterThanOrEqualToThreshold" }
+
+  alarmName := stepScalingAlarmName(serviceName, clusterName, p.PolicyName)
+  serviceName, clusterName = scalingNames(serviceName, clusterName)
+  return &cloudwatch.PutMetricAlarmInput{
+    AlarmName: aws.String(alarmName),
+    AlarmActions: []*string{aws.String(policyArn)},
+    Namespace: aws.String("AWS/ECS"),
+    MetricName: aws.String(p.Metric.cloudWatchMetricName()),
+    Dimensions: []*cloudwatch.Dimension{
+      {Name: aws.String("ClusterName"), Value: aws.String(clusterName)},
+      {Name: aws.String("ServiceName"), Value: aws.String(serviceName)},
+    },
+    Statistic: aws.String("Average"),
+    ComparisonOperator: aws.String(comparison),
+    Threshold: aws.Float64(p.Threshold),
+    EvaluationPeriods: aws.Int64(periods),
+    Period: aws.Int64(int64(period / time.Second)),
+  }
+}
+
+func stepScalingAlarmName(serviceName, clusterName, policyName string) (string) {
+  serviceName, clusterName = scalingNames(serviceName, clusterName)
+  return fmt.Sprintf("%s-%s-%s", clusterName, serviceName, policyName)
+}
+
+// Deletes the policy, and its alarm if PutServiceStepScalingPolicy made one.
+func DeleteServiceScalingPolicy(serviceName, clusterName, policyName string, sess *session.Session) (err error) {
+  aasSvc := applicationautoscaling.New(sess)
+  params := &applicationautoscaling.DeleteScalingPolicyInput{
+    PolicyName: aws.String(policyName),
+    ServiceNamespace: aws.String(ecsScalingNamespace),
+    ScalableDimension: aws.String(ecsScalableDimension),
+    ResourceId: aws.String(serviceResourceId(serviceName, clusterName)),
+  }
+  _, err = aasSvc.DeleteScalingPolicy(params)
+  if err != nil { return err }
+  return deleteScalingAlarms([]string{stepScalingAlarmName(serviceName, clusterName, policyName)}, sess)
+}
+
+// Deletes those of the alarms that exist. Target tracking policies have no alarms of ours.
+func deleteScalingAlarms(alarmNames []string, sess *session.Session) (err error) {
+  cwSvc := cloudwatch.New(sess)
+  // DescribeAlarms and DeleteAlarms take at most 100 names.
+  for start := 0; start < len(alarmNames); start += 100 {
+    end := start + 100
+    if end > len(alarmNames) { end = len(alarmNames) }
+    resp, err := cwSvc.DescribeAlarms(&cloudwatch.DescribeAlarmsInput{
+      AlarmNames: aws.StringSlice(alarmNames[start:end]),
+      MaxRecords: aws.Int64(100),
+    })
+    if err != nil { return fmt.Errorf("Failed to describe scaling alarms: %s", err) }
+    if len(resp.MetricAlarms) == 0 { continue }
+    existing := make([]*string, 0, len(resp.MetricAlarms))
+    for _, a := range resp.MetricAlarms { existing = append(existing, a.AlarmName) }
+    _, err = cwSvc.DeleteAlarms(&cloudwatch.DeleteAlarmsInput{AlarmNames: existing})
+    if err != nil { return fmt.Errorf("Failed to delete scaling alarms: %s", err) }
+  }
+  return err
+}
+
+func ListServiceScalingPolicies(serviceName, clusterName string, sess *session.Session) (policies []*applicationautoscaling.ScalingPolicy, err error) {
+  aasSvc := applicationautoscaling.New(sess)
+  params := &applicationautoscaling.DescribeScalingPoliciesInput{
+    ServiceNamespace: aws.String(ecsScalingNamespace),
+    ScalableDimension: aws.String(ecsScalableDimension),
+    ResourceId: aws.String(serviceResourceId(serviceName, clusterName)),
+  }
+  policies = make([]*applicationautoscaling.ScalingPolicy, 0)
+  err = aasSvc.DescribeScalingPoliciesPages(params,
+    func(page *applicationautoscaling.DescribeScalingPoliciesOutput, lastPage bool) (bool) {
+      policies = append(policies, page.ScalingPolicies...)
+      return true
+  })
+  return policies, err
+}
+
+// Most recent first.
+func ListServiceScalingActivities(serviceName, clusterName string, sess *session.Session) (activities []*applicationautoscaling.ScalingActivity, err error) {
+  aasSvc := applicationautoscaling.New(sess)
+  params := &applicationautoscaling.DescribeScalingActivitiesInput{
+    ServiceNamespace: aws.String(ecsScalingNamespace),
+    ScalableDimension: aws.String(ecsScalableDimension),
+    ResourceId: aws.String(serviceResourceId(serviceName, clusterName)),
+  }
+  activities = make([]*applicationautoscaling.ScalingActivity, 0)
+  err = aasSvc.DescribeScalingActivitiesPages(params,
+    func(page *applicationautoscaling.DescribeScalingActivitiesOutput, lastPage bool) (bool) {
+      activities = append(activities, page.ScalingActivities...)
+      return true
+  })
+  return activities, err
+}
@@ -0,0 +1,147 @@
+package awslib
+
+import(
+  "fmt"
+  "time"
+  "github.com/aws/aws-sdk-go/aws/session"
+  "github.com/aws/aws-sdk-go/service/route53"
+  "github.com/Sirupsen/logrus"
+)
+
+// Two services (blue and green) on a cluster behind one DNS name.
+// Each side has a weighted record for FQDN, with the service name as the
+// SetIdentifier and the side's Endpoint (e.g. its load balancer's DNS name) as the value.
+// The side with all the weight is active, the other is idle. A deploy goes to the idle
+// side, and once it is stable the weight is shifted over to it in Steps.
+type BlueGreen struct {
+  ClusterName string
+  FQDN string
+  RecordType string          // Defaults to CNAME.
+  TTL int64
+  Blue BlueGreenSide
+  Green BlueGreenSide
+  // Percent of the weight on the newly deployed side at each step, e.g. {10, 50, 100}.
+  // Empty means switch all at once.
+  Steps []int64
+  // How long to wait after each step (once the DNS change is synched) before the next.
+  StepInterval time.Duration
+  // Called after each step, an error rolls back to the previously active side.
+  Verify func(weight int64) error
+  // Called with progress messages, may be nil.
+  Progress func(string)
+
+  previous *BlueGreenSide
+}
+
+type BlueGreenSide struct {
+  ServiceName string
+  Endpoint string
+}
+
+func (bg *BlueGreen) progress(f string, args ...interface{}) {
+  m := fmt.Sprintf(f, args...)
+  log.Debug(logrus.Fields{"cluster": bg.ClusterName, "fqdn": bg.FQDN}, "BlueGreen: " + m)
+  if bg.Progress != nil { bg.Progress(m) }
+}
+
+func (bg *BlueGreen) recordType() (string) {
+  if bg.RecordType == "" { return "CNAME" }
+  return bg.RecordType
+}
+
+// Returns the active and idle sides based on the current weights.
+func (bg *BlueGreen) Sides(sess *session.Session) (active, idle BlueGreenSide, err error) {
+  records, err := GetWeightedRecords(bg.FQDN, sess)
+  if err != nil { return active, idle, err }
+  return bg.sidesFromRecords(records)
+}
+
+// The side with the higher weight is active. With no records for either side
+// blue is taken as active so the first deploy goes to green.
+func (bg *BlueGreen) sidesFromRecords(records []*route53.ResourceRecordSet) (active, idle BlueGreenSide, err error) {
+  weights := make(map[string]int64, 2)
+  for _, r := range records {
+    weights[*r.SetIdentifier] = *r.Weight
+  }
+  blueW, blueOk := weights[bg.Blue.ServiceName]
+  greenW, greenOk := weights[bg.Green.ServiceName]
+  if blueOk && greenOk && blueW == greenW && blueW > 0 {
+    return active, idle, fmt.Errorf("BlueGreen: traffic is split evenly between %s and %s, can't tell which is idle.",
+      bg.Blue.ServiceName, bg.Green.ServiceName)
+  }
+  if greenW > blueW { return bg.Green, bg.Blue, nil }
+  return bg.Blue, bg.Green, nil
+}
+
+func (bg *BlueGreen) setWeights(active, idle BlueGreenSide, idleWeight int64, sess *session.Session) (err error) {
+  records := []WeightedRecord{
+    {SetIdentifier: active.ServiceName, Value: active.Endpoint, Weight: 100 - idleWeight},
+    {SetIdentifier: idle.ServiceName, Value: idle.Endpoint, Weight: idleWeight},
+  }
+  comment := fmt.Sprintf("BlueGreen: %d%% %s, %d%% %s", 100 - idleWeight, active.ServiceName, idleWeight, idle.ServiceName)
+  ci, err := SetWeightedRecords(bg.FQDN, bg.recordType(), bg.TTL, records, comment, sess)
+  if err != nil { return err }
+
+  done := make(chan error)
+  OnDNSChangeSynched(ci.Id, sess, func(ci *route53.ChangeInfo, err error) { done <- err })
+  return <-done
+}
+
+// Deploys taskDefinitionArn to the idle service, scaled to match the active one, waits for it
+// to become stable and then shifts the weight over. Any failure while shifting puts all the
+// weight back on the previously active side.
+func (bg *BlueGreen) Deploy(taskDefinitionArn string, sess *session.Session) (err error) {
+  active, idle, err := bg.Sides(sess)
+  if err != nil { return err }
+
+  activeService, failures, err := DescribeService(active.ServiceName, bg.ClusterName, sess)
+  if err != nil { return err }
+  if len(failures) > 0 { return fmt.Errorf("BlueGreen: failed describing %s: %#v.", active.ServiceName, failures) }
+
+  bg.progress("deploying %s to %s", ShortArnString(&taskDefinitionArn), idle.ServiceName)
+  spec := ServiceSpec{
+    Name: idle.ServiceName,
+    Cluster: bg.ClusterName,
+    TaskDefinition: taskDefinitionArn,
+    DesiredCount: activeService.DesiredCount,
+  }
+  _, err = UpdateService(spec, sess)
+  if err != nil { return fmt.Errorf("BlueGreen: failed to update %s: %s", idle.ServiceName, err) }
+
+  done := make(chan error)
+  OnServiceStable(idle.ServiceName, bg.ClusterName, sess, func(err error) { done <- err })
+  err = <-done
+  if err != nil { return fmt.Errorf("BlueGreen: %s did not become stable: %s", idle.ServiceName, err) }
+  bg.progress("%s is stable", idle.ServiceName)
+
+  bg.previous = &active
+  steps := bg.Steps
+  if len(steps) == 0 { steps = []int64{100} }
+  for i, w := range steps {
+    bg.progress("shifting %d%% to %s", w, idle.ServiceName)
+    err = bg.setWeights(active, idle, w, sess)
+    if err == nil && bg.Verify != nil { err = bg.Verify(w) }
+    if err != nil {
+      bg.progress("step %d%% failed, rolling back to %s: %s", w, active.ServiceName, err)
+      if rbErr := bg.Rollback(sess); rbErr != nil {
+        return fmt.Errorf("BlueGreen: shifting to %s failed: %s, and the rollback failed: %s", idle.ServiceName, err, rbErr)
+      }
+      return fmt.Errorf("BlueGreen: shifting to %s failed, rolled back: %s", idle.ServiceName, err)
+    }
+    if i < len(steps) - 1 { time.Sleep(bg.StepInterval) }
+  }
+  bg.progress("%s is active", idle.ServiceName)
+  return err
+}
+
+// Puts all the weight back on the side that was active before the last Deploy.
+// The service on that side is still running the previous task definition.
+func (bg *BlueGreen) Rollback(sess *session.Session) (err error) {
+  if bg.previous == nil { return fmt.Errorf("BlueGreen: nothing to roll back to.") }
+  active := *bg.previous
+  idle := bg.Green
+  if active.ServiceName == bg.Green.ServiceName { idle = bg.Blue }
+
+  bg.progress("rolling back to %s", active.ServiceName)
+  return bg.setWeights(active, idle, 0, sess)
+}
@@ -0,0 +1,152 @@
+package awslib
+
+import(
+  "fmt"
+  "sort"
+  "strconv"
+  "github.com/aws/aws-sdk-go/aws/session"
+  "github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// How many more copies of a task fit on a cluster, and what runs out first.
+
+// What one copy of a task reserves on an instance.
+type TaskRequirements struct {
+  Cpu int64
+  // MB
+  Memory int64
+  // Static host ports, which only one task per instance can have.
+  Ports []string
+  UDPPorts []string
+}
+
+// Binding constraint for instances that can't take tasks at all (DRAINING, agent disconnected).
+const InstanceUnavailable = "STATUS"
+
+type InstanceCapacity struct {
+  ContainerInstanceArn string
+  Ec2InstanceId string
+  Placements int64
+  // The resource that limits Placements: CPU, MEMORY, PORTS, PORTS_UDP or InstanceUnavailable.
+  Binding string
+}
+
+type ClusterCapacity struct {
+  Requirements TaskRequirements
+  Instances []InstanceCapacity
+  Total int64
+  // How many instances each resource binds on.
+  BindingCounts map[string]int
+  // The resource binding on the most instances, the one to add more of.
+  Binding string
+}
+
+// ECS reserves a container's memoryReservation if it has one, otherwise its memory,
+// unless the task sets memory (and cpu) for the whole task.
+func TaskDefinitionRequirements(td *ecs.TaskDefinition) (r TaskRequirements, err error) {
+  host := td.NetworkMode != nil && *td.NetworkMode == ecs.NetworkModeHost
+  // awsvpc tasks get their own ENI and take no host ports. (ENIs per instance is what limits them.)
+  awsvpc := td.NetworkMode != nil && *td.NetworkMode == ecs.NetworkModeAwsvpc
+  for _, cd := range td.ContainerDefinitions {
+    if cd.Cpu != nil { r.Cpu += *cd.Cpu }
+    if cd.MemoryReservation != nil {
+      r.Memory += *cd.MemoryReservation
+    } else if cd.Memory != nil {
+      r.Memory += *cd.Memory
+    }
+    if awsvpc { continue }
+    for _, pm := range cd.PortMappings {
+      port := pm.HostPort
+      // host networking uses the container port on the host.
+      if host && (port == nil || *port == 0) { port = pm.ContainerPort }
+      if port == nil || *port == 0 { continue }
+      p := strconv.FormatInt(*port, 10)
+      if pm.Protocol != nil && *pm.Protocol == ecs.TransportProtocolUdp {
+        r.UDPPorts = append(r.UDPPorts, p)
+      } else {
+        r.Ports = append(r.Ports, p)
+      }
+    }
+  }
+  if td.Cpu != nil {
+    r.Cpu, err = parseTaskCpu(*td.Cpu)
+    if err != nil { return r, fmt.Errorf("TaskDefinitionRequirements: %s", err) }
+  }
+  if td.Memory != nil {
+    r.Memory, err = parseTaskMemory(*td.Memory)
+    if err != nil { return r, fmt.Errorf("TaskDefinitionRequirements: %s", err) }
+  }
+  return r, err
+}
+
+// Works out placements from each instance's RemainingResources.
+func CalculateCapacity(r TaskRequirements, ciMap ContainerInstanceMap) (cc ClusterCapacity) {
+  cc.Requirements = r
+  cc.BindingCounts = make(map[string]int)
+  for _, ci := range ciMap {
+    if ci.Instance == nil { continue }
+    ic := instanceCapacity(r, ci.Instance)
+    cc.Instances = append(cc.Instances, ic)
+    cc.Total += ic.Placements
+    if ic.Binding != "" { cc.BindingCounts[ic.Binding]++ }
+  }
+  sort.Slice(cc.Instances, func(i, j int) bool { return cc.Instances[i].ContainerInstanceArn < cc.Instances[j].ContainerInstanceArn })
+
+  for b, n := range cc.BindingCounts {
+    if n > cc.BindingCounts[cc.Binding] || (n == cc.BindingCounts[cc.Binding] && b < cc.Binding) { cc.Binding = b }
+  }
+  return cc
+}
+
+func instanceCapacity(r TaskRequirements, i *ecs.ContainerInstance) (ic InstanceCapacity) {
+  ic.ContainerInstanceArn = stringPString(i.ContainerInstanceArn)
+  ic.Ec2InstanceId = stringPString(i.Ec2InstanceId)
+  if stringPString(i.Status) != ContainerInstanceActive || (i.AgentConnected != nil && !*i.AgentConnected) {
+    ic.Binding = InstanceUnavailable
+    return ic
+  }
+
+  remaining := collectResources(i.RemainingResources)
+  ic.Placements = -1
+  limit := func(resource string, n int64) {
+    if ic.Placements < 0 || n < ic.Placements {
+      ic.Placements = n
+      ic.Binding = resource
+    }
+  }
+  if r.Cpu > 0 {
+    cpu, _ := remaining.Int64For(CPU)
+    limit(CPU, cpu / r.Cpu)
+  }
+  if r.Memory > 0 {
+    mem, _ := remaining.Int64For(MEMORY)
+    limit(MEMORY, mem / r.Memory)
+  }
+  // RemainingResources lists the ports in use.
+  for _, ports := range []struct{ name string; want []string }{{PORTS, r.Ports}, {PORTS_UDP, r.UDPPorts}} {
+    if len(ports.want) == 0 { continue }
+    used := make(map[string]bool)
+    if res, ok := remaining[ports.name]; ok {
+      for _, p := range res.StringSetValue { used[*p] = true }
+    }
+    n := int64(1)
+    for _, p := range ports.want {
+      if used[p] { n = 0 }
+    }
+    limit(ports.name, n)
+  }
+  // Nothing reserved, nothing to go on.
+  if ic.Placements < 0 { ic.Placements = 0 }
+  return ic
+}
+
+// How many more of taskDefinitionArn fit on the cluster's ACTIVE instances.
+func GetClusterCapacity(clusterName, taskDefinitionArn string, sess *session.Session) (cc ClusterCapacity, err error) {
+  td, err := SharedTaskDefinitionCache.Get(taskDefinitionArn, sess)
+  if err != nil { return cc, fmt.Errorf("GetClusterCapacity: can't get task definition %s: %s", taskDefinitionArn, err) }
+  ciMap, err := GetAllContainerInstanceDescriptions(clusterName, sess)
+  if err != nil { return cc, fmt.Errorf("GetClusterCapacity: can't get container instances for %s: %s", clusterName, err) }
+  r, err := TaskDefinitionRequirements(td)
+  if err != nil { return cc, fmt.Errorf("GetClusterCapacity: %s", err) }
+  return CalculateCapacity(r, ciMap), err
+}
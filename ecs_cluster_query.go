@@ -0,0 +1,421 @@
+package awslib
+
+import(
+  "fmt"
+  "regexp"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+  "unicode"
+  "github.com/aws/aws-sdk-go/aws/session"
+)
+
+// ECS's cluster query language, as used by memberOf placement constraints and
+// ListContainerInstances filters, e.g.
+//
+//   attribute:ecs.instance-type =~ t2.* and attribute:ecs.availability-zone in [us-east-1a, us-east-1b]
+//   not(task:group == service:web) || runningTasksCount < 5
+//
+// Subjects: attribute:name, agentConnected, agentVersion, ec2InstanceId, registeredAt,
+// runningTasksCount and task:group.
+// Operators: == (equals), != (not_equals), exists, !exists (not_exists), in, !in (not_in),
+// =~ (matches), !~ (not_matches), >, >=, < and <=. Expressions combine with and (&&),
+// or (||), not (!) and parentheses.
+//
+// Evaluating a query against a PlacementInstance says whether it matches and why,
+// so mistakes show up before ECS says "unable to place task".
+
+type ClusterQuery struct {
+  Expression string
+  root queryNode
+}
+
+type ClusterQueryResult struct {
+  ContainerInstanceArn string
+  Ec2InstanceId string
+  Match bool
+  Reason string
+}
+
+func ParseClusterQuery(expression string) (q *ClusterQuery, err error) {
+  tokens, err := lexClusterQuery(expression)
+  if err != nil { return nil, fmt.Errorf("ParseClusterQuery: %s", err) }
+  p := &queryParser{tokens: tokens}
+  root, err := p.or()
+  if err == nil && p.pos < len(p.tokens) { err = fmt.Errorf("unexpected %q", p.tokens[p.pos].text) }
+  if err != nil { return nil, fmt.Errorf("ParseClusterQuery: %s in %q", err, expression) }
+  return &ClusterQuery{Expression: expression, root: root}, nil
+}
+
+// Whether the instance matches, and why (or why not).
+func (q *ClusterQuery) Match(pi *PlacementInstance) (match bool, reason string) {
+  return q.root.eval(pi)
+}
+
+// Evaluates the query against every instance.
+func (q *ClusterQuery) Explain(instances []*PlacementInstance) (results []ClusterQueryResult) {
+  for _, pi := range instances {
+    match, reason := q.Match(pi)
+    results = append(results, ClusterQueryResult{
+      ContainerInstanceArn: pi.ContainerInstanceArn,
+      Ec2InstanceId: pi.Ec2InstanceId,
+      Match: match,
+      Reason: reason,
+    })
+  }
+  return results
+}
+
+// Evaluates a memberOf expression against the cluster's instances.
+func ExplainClusterQuery(clusterName, expression string, sess *session.Session) (results []ClusterQueryResult, err error) {
+  q, err := ParseClusterQuery(expression)
+  if err != nil { return results, err }
+  instances, err := GetPlacementSnapshot(clusterName, sess)
+  if err != nil { return results, err }
+  return q.Explain(instances), err
+}
+
+//
+// Lexing
+//
+
+type queryToken struct {
+  text string
+  // The token was quoted, so it's a value whatever it says.
+  quoted bool
+}
+
+const queryPunctuation = "()[],"
+
+func lexClusterQuery(s string) (tokens []queryToken, err error) {
+  rs := []rune(s)
+  for i := 0; i < len(rs); {
+    r := rs[i]
+    switch {
+    case unicode.IsSpace(r):
+      i++
+    case strings.ContainsRune(queryPunctuation, r):
+      tokens = append(tokens, queryToken{text: string(r)})
+      i++
+    case r == '"' || r == '\'':
+      end := i + 1
+      for end < len(rs) && rs[end] != r { end++ }
+      if end == len(rs) { return nil, fmt.Errorf("unterminated quote at %d", i) }
+      tokens = append(tokens, queryToken{text: string(rs[i+1:end]), quoted: true})
+      i = end + 1
+    case strings.ContainsRune("=!<>&|~", r):
+      op := string(r)
+      if i + 1 < len(rs) && strings.ContainsRune("=~&|", rs[i+1]) {
+        op += string(rs[i+1])
+      }
+      switch op {
+      case "==", "!=", "=~", "!~", ">", ">=", "<", "<=", "!", "&&", "||":
+      default: return nil, fmt.Errorf("unknown operator %s at %d", op, i)
+      }
+      tokens = append(tokens, queryToken{text: op})
+      i += len(op)
+    default:
+      end := i
+      for end < len(rs) && !unicode.IsSpace(rs[end]) && !strings.ContainsRune(queryPunctuation + "=!<>&|~\"'", rs[end]) { end++ }
+      tokens = append(tokens, queryToken{text: string(rs[i:end])})
+      i = end
+    }
+  }
+  return tokens, nil
+}
+
+//
+// Parsing
+//
+
+type queryParser struct {
+  tokens []queryToken
+  pos int
+}
+
+func (p *queryParser) peek() (queryToken, bool) {
+  if p.pos >= len(p.tokens) { return queryToken{}, false }
+  return p.tokens[p.pos], true
+}
+
+// Consumes the next token if it's one of words (unquoted).
+func (p *queryParser) accept(words ...string) (bool) {
+  t, ok := p.peek()
+  if !ok || t.quoted { return false }
+  for _, w := range words {
+    if t.text == w {
+      p.pos++
+      return true
+    }
+  }
+  return false
+}
+
+func (p *queryParser) or() (queryNode, error) {
+  left, err := p.and()
+  if err != nil { return nil, err }
+  for p.accept("or", "||") {
+    right, err := p.and()
+    if err != nil { return nil, err }
+    left = orNode{left, right}
+  }
+  return left, nil
+}
+
+func (p *queryParser) and() (queryNode, error) {
+  left, err := p.unary()
+  if err != nil { return nil, err }
+  for p.accept("and", "&&") {
+    right, err := p.unary()
+    if err != nil { return nil, err }
+    left = andNode{left, right}
+  }
+  return left, nil
+}
+
+func (p *queryParser) unary() (queryNode, error) {
+  if p.accept("not", "!") {
+    n, err := p.unary()
+    if err != nil { return nil, err }
+    return notNode{n}, nil
+  }
+  if p.accept("(") {
+    n, err := p.or()
+    if err != nil { return nil, err }
+    if !p.accept(")") { return nil, fmt.Errorf("missing )") }
+    return n, nil
+  }
+  return p.comparison()
+}
+
+var querySubjects = map[string]bool{
+  "agentConnected": true, "agentVersion": true, "ec2InstanceId": true,
+  "registeredAt": true, "runningTasksCount": true, "task:group": true,
+}
+
+// Canonical operator names.
+var queryOperators = map[string]string{
+  "==": "==", "equals": "==", "!=": "!=", "not_equals": "!=",
+  "exists": "exists", "not_exists": "!exists", "in": "in", "not_in": "!in",
+  "=~": "=~", "matches": "=~", "!~": "!~", "not_matches": "!~",
+  ">": ">", ">=": ">=", "<": "<", "<=": "<=",
+}
+
+func (p *queryParser) comparison() (queryNode, error) {
+  t, ok := p.peek()
+  if !ok { return nil, fmt.Errorf("expression ends early") }
+  if t.quoted || (!querySubjects[t.text] && !strings.HasPrefix(t.text, "attribute:")) {
+    return nil, fmt.Errorf("unknown subject %q", t.text)
+  }
+  p.pos++
+  c := &comparisonNode{subject: t.text}
+
+  t, ok = p.peek()
+  if !ok { return nil, fmt.Errorf("no operator after %s", c.subject) }
+  p.pos++
+  op := queryOperators[t.text]
+  // !exists and !in
+  if t.text == "!" {
+    if n, ok := p.peek(); ok && (n.text == "exists" || n.text == "in") {
+      op = "!" + n.text
+      p.pos++
+    }
+  }
+  if op == "" || t.quoted { return nil, fmt.Errorf("unknown operator %q after %s", t.text, c.subject) }
+  c.op = op
+
+  switch op {
+  case "exists", "!exists":
+    return c, nil
+  case "in", "!in":
+    if !p.accept("[", "(") { return nil, fmt.Errorf("%s needs a list, e.g. [a, b]", t.text) }
+    // An empty list: in matches nothing, !in everything.
+    if p.accept("]", ")") { return c, nil }
+    for {
+      v, ok := p.peek()
+      if !ok { return nil, fmt.Errorf("unterminated list") }
+      if !v.quoted && strings.Contains(queryPunctuation, v.text) { return nil, fmt.Errorf("expected a value in list, got %s", v.text) }
+      p.pos++
+      c.values = append(c.values, v.text)
+      if p.accept("]", ")") { break }
+      if !p.accept(",") { return nil, fmt.Errorf("expected , in list") }
+    }
+    return c, nil
+  }
+
+  v, ok := p.peek()
+  if !ok || (!v.quoted && strings.Contains(queryPunctuation, v.text)) { return nil, fmt.Errorf("no value after %s %s", c.subject, t.text) }
+  p.pos++
+  c.values = []string{v.text}
+  if op == "=~" || op == "!~" {
+    re, err := regexp.Compile("^(?:" + v.text + ")$")
+    if err != nil { return nil, fmt.Errorf("bad pattern %s: %s", v.text, err) }
+    c.re = re
+  }
+  return c, nil
+}
+
+//
+// Evaluating
+//
+
+type queryNode interface {
+  eval(pi *PlacementInstance) (bool, string)
+}
+
+type andNode struct { left, right queryNode }
+type orNode struct { left, right queryNode }
+type notNode struct { n queryNode }
+
+func (n andNode) eval(pi *PlacementInstance) (bool, string) {
+  l, lr := n.left.eval(pi)
+  if !l { return false, lr }
+  r, rr := n.right.eval(pi)
+  if !r { return false, rr }
+  return true, lr + " and " + rr
+}
+
+func (n orNode) eval(pi *PlacementInstance) (bool, string) {
+  l, lr := n.left.eval(pi)
+  if l { return true, lr }
+  r, rr := n.right.eval(pi)
+  if r { return true, rr }
+  return false, lr + "; " + rr
+}
+
+func (n notNode) eval(pi *PlacementInstance) (bool, string) {
+  m, reason := n.n.eval(pi)
+  return !m, reason
+}
+
+type comparisonNode struct {
+  subject string
+  op string
+  values []string
+  re *regexp.Regexp
+}
+
+// The subject's value on the instance, false if it doesn't have one.
+func (c *comparisonNode) value(pi *PlacementInstance) (string, bool) {
+  switch c.subject {
+  case "agentConnected": return strconv.FormatBool(pi.AgentConnected), true
+  case "agentVersion": return pi.AgentVersion, pi.AgentVersion != ""
+  case "ec2InstanceId": return pi.Ec2InstanceId, true
+  case "registeredAt": return pi.RegisteredAt.Format(time.RFC3339), !pi.RegisteredAt.IsZero()
+  case "runningTasksCount": return strconv.FormatInt(pi.RunningTasksCount, 10), true
+  }
+  v, ok := pi.Attributes[strings.TrimPrefix(c.subject, "attribute:")]
+  return v, ok
+}
+
+func (c *comparisonNode) eval(pi *PlacementInstance) (bool, string) {
+  if c.subject == "task:group" { return c.evalGroup(pi) }
+
+  v, ok := c.value(pi)
+  is := fmt.Sprintf("%s is %s", c.subject, v)
+  if !ok { is = fmt.Sprintf("%s is not set", c.subject) }
+  switch c.op {
+  case "exists": return ok, is
+  case "!exists": return !ok, is
+  }
+  if !ok { return c.op == "!=" || c.op == "!in" || c.op == "!~", is }
+
+  switch c.op {
+  case "==": return v == c.values[0], is
+  case "!=": return v != c.values[0], is
+  case "in", "!in":
+    in := false
+    for _, want := range c.values { in = in || v == want }
+    return in == (c.op == "in"), is
+  case "=~": return c.re.MatchString(v), is
+  case "!~": return !c.re.MatchString(v), is
+  }
+
+  cmp, err := c.compare(v, c.values[0])
+  if err != nil { return false, fmt.Sprintf("%s, %s", is, err) }
+  switch c.op {
+  case ">": return cmp > 0, is
+  case ">=": return cmp >= 0, is
+  case "<": return cmp < 0, is
+  case "<=": return cmp <= 0, is
+  }
+  return false, is
+}
+
+// task:group is true if any task on the instance is in the group.
+func (c *comparisonNode) evalGroup(pi *PlacementInstance) (bool, string) {
+  groups := make([]string, 0, len(pi.Groups))
+  for g, n := range pi.Groups {
+    if n > 0 { groups = append(groups, g) }
+  }
+  is := "no tasks"
+  if len(groups) > 0 {
+    sort.Strings(groups)
+    is = "tasks in " + strings.Join(groups, ", ")
+  }
+  has := func(g string) (bool) { return pi.Groups[g] > 0 }
+  switch c.op {
+  case "exists": return len(groups) > 0, is
+  case "!exists": return len(groups) == 0, is
+  case "==": return has(c.values[0]), is
+  case "!=": return !has(c.values[0]), is
+  case "in", "!in":
+    in := false
+    for _, g := range c.values { in = in || has(g) }
+    return in == (c.op == "in"), is
+  case "=~", "!~":
+    m := false
+    for _, g := range groups { m = m || c.re.MatchString(g) }
+    return m == (c.op == "=~"), is
+  }
+  return false, fmt.Sprintf("%s can't be compared with %s", c.subject, c.op)
+}
+
+// Numbers, dotted versions and dates compare as such.
+func (c *comparisonNode) compare(v, want string) (int, error) {
+  switch c.subject {
+  case "registeredAt":
+    a, err := time.Parse(time.RFC3339, v)
+    if err != nil { return 0, err }
+    b, err := parseQueryTime(want)
+    if err != nil { return 0, fmt.Errorf("bad date %s", want) }
+    switch {
+    case a.Before(b): return -1, nil
+    case a.After(b): return 1, nil
+    }
+    return 0, nil
+  case "agentVersion":
+    return compareVersions(v, want), nil
+  }
+  a, aErr := strconv.ParseFloat(v, 64)
+  b, bErr := strconv.ParseFloat(want, 64)
+  if aErr != nil || bErr != nil { return strings.Compare(v, want), nil }
+  switch {
+  case a < b: return -1, nil
+  case a > b: return 1, nil
+  }
+  return 0, nil
+}
+
+func parseQueryTime(s string) (time.Time, error) {
+  for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02"} {
+    if t, err := time.Parse(layout, s); err == nil { return t, nil }
+  }
+  return time.Time{}, fmt.Errorf("bad date %s", s)
+}
+
+// e.g. 1.14.2 < 1.15.0, missing parts count as 0.
+func compareVersions(a, b string) (int) {
+  as, bs := strings.Split(a, "."), strings.Split(b, ".")
+  for i := 0; i < len(as) || i < len(bs); i++ {
+    var ai, bi int64
+    if i < len(as) { ai, _ = strconv.ParseInt(as[i], 10, 64) }
+    if i < len(bs) { bi, _ = strconv.ParseInt(bs[i], 10, 64) }
+    if ai != bi {
+      if ai < bi { return -1 }
+      return 1
+    }
+  }
+  return 0
+}
@@ -68,8 +68,7 @@ func GetDeepTasks(clusterName string, sess *session.Session) (dtm DeepTaskMap, e
       if dt.CInstance != nil {
         dt.EC2Instance = ec2Map[*dt.CInstance.Ec2InstanceId]
       }
-      // Cache and/or lazy evaluate?
-      td,  err  := GetTaskDefinition(*dt.Task.TaskDefinitionArn, sess)
+      td,  err  := SharedTaskDefinitionCache.Get(*dt.Task.TaskDefinitionArn, sess)
       if err != nil {return dtm, fmt.Errorf("Failed to get the task definition for task %s: %s", dt.Task.TaskArn, err)}
       dt.TaskDefinition = td
     }
@@ -310,7 +309,7 @@ func makeDeepTaskWith(clusterName, taskArn string, dto *ecs.DescribeTasksOutput,
     if dt.CInstance != nil {
       dt.EC2Instance = ec2Map[*dt.CInstance.Ec2InstanceId]
     }
-    td, err := GetTaskDefinition(*task.TaskDefinitionArn, sess)
+    td, err := SharedTaskDefinitionCache.Get(*task.TaskDefinitionArn, sess)
     if err != nil {
       return dt, fmt.Errorf("Failed to get task-definition for task %s: %s", taskArn, err)
     }
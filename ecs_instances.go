@@ -3,7 +3,9 @@ package awslib
 import (
   "fmt"
   "errors"
+  "sort"
   "strconv"
+  "strings"
   "time"
   "github.com/aws/aws-sdk-go/aws"
   "github.com/aws/aws-sdk-go/aws/session"
@@ -12,20 +14,44 @@ import (
   // "github.com/Sirupsen/logrus"
 )
 
+// Container instance status values for ContainerInstanceFilter.
+const(
+  ContainerInstanceActive = "ACTIVE"
+  ContainerInstanceDraining = "DRAINING"
+  ContainerInstanceInactive = "INACTIVE"
+)
+
+// Zero values don't filter. Without a Status ECS leaves out INACTIVE (deregistered) instances.
+// Filter is a cluster query language expression, e.g. "attribute:ecs.instance-type =~ t2.*"
+type ContainerInstanceFilter struct {
+  Status string
+  Filter string
+}
+
 // returns a list of Containerinstance ARNS.
 func GetContainerInstances(clusterName string, sess *session.Session)([]*string, error) {
+  return GetContainerInstancesWithFilter(clusterName, ContainerInstanceFilter{}, sess)
+}
+
+// returns a list of the Containerinstance ARNS that match the filter, across all pages.
+func GetContainerInstancesWithFilter(clusterName string, f ContainerInstanceFilter, sess *session.Session) ([]*string, error) {
   ecsSvc := ecs.New(sess)
   params := &ecs.ListContainerInstancesInput {
     Cluster: aws.String(clusterName),
     MaxResults: aws.Int64(100),
   }
-  resp, err := ecsSvc.ListContainerInstances(params)
+  if f.Status != "" { params.Status = aws.String(f.Status) }
+  if f.Filter != "" { params.Filter = aws.String(f.Filter) }
+
+  arns := make([]*string, 0)
+  err := ecsSvc.ListContainerInstancesPages(params, func(page *ecs.ListContainerInstancesOutput, lastPage bool) (bool) {
+    arns = append(arns, page.ContainerInstanceArns...)
+    return true
+  })
   if err != nil { return []*string{}, err }
-
-  return resp.ContainerInstanceArns, nil
+  return arns, nil
 }
 
-
 // Capturing the fact that whenever you actually get the
 // description you also get potential failures.
 type ContainerInstance struct {
@@ -41,6 +67,15 @@ func (ci *ContainerInstance) RemainingResources() (ResourceMap) {
   return collectResources(ci.Instance.RemainingResources)
 }
 
+func (ci *ContainerInstance) Resources() (InstanceResource) {
+  return InstanceResource{
+    Registered: ci.RegisteredResources(),
+    Remaining: ci.RemainingResources(),
+    PendingTasks: aws.Int64Value(ci.Instance.PendingTasksCount),
+    RunningTasks: aws.Int64Value(ci.Instance.RunningTasksCount),
+  }
+}
+
 // TODO: THIS BADLY NEEDS REFACTORING ... the next two API points are too close.
 // func GetContainerInstanceDescriptions(clusterName string, sess *session.Session) (cis []*ecs.ContainerInstance, cifs []*ecs.Failure, err error) {
 //   instanceArns, err := GetContainerInstances(clusterName, sess)
@@ -59,21 +94,35 @@ func (ci *ContainerInstance) RemainingResources() (ResourceMap) {
 type ContainerInstanceMap map[string]*ContainerInstance
 
 func GetAllContainerInstanceDescriptions(clusterName string, sess *session.Session) (ContainerInstanceMap, error) {
+  return GetContainerInstanceDescriptionsWithFilter(clusterName, ContainerInstanceFilter{}, sess)
+}
 
-  instanceArns, err := GetContainerInstances(clusterName, sess)
+func GetContainerInstanceDescriptionsWithFilter(clusterName string, f ContainerInstanceFilter, sess *session.Session) (ContainerInstanceMap, error) {
+  instanceArns, err := GetContainerInstancesWithFilter(clusterName, f, sess)
   if err != nil { return make(ContainerInstanceMap), err }
+  return DescribeContainerInstances(clusterName, instanceArns, sess)
+}
 
-  if len(instanceArns) <= 0 {
-    return make(ContainerInstanceMap), nil
-  }
+// DescribeContainerInstances takes at most this many instances at a time.
+const describeContainerInstancesMax = 100
 
+// Describes the instances, as many calls as it takes.
+func DescribeContainerInstances(clusterName string, instanceArns []*string, sess *session.Session) (ContainerInstanceMap, error) {
   ecsSvc := ecs.New(sess)
-  params := &ecs.DescribeContainerInstancesInput {
-    ContainerInstances: instanceArns,
-    Cluster: aws.String(clusterName),
+  dcio := &ecs.DescribeContainerInstancesOutput{}
+  for start := 0; start < len(instanceArns); start += describeContainerInstancesMax {
+    end := start + describeContainerInstancesMax
+    if end > len(instanceArns) { end = len(instanceArns) }
+    params := &ecs.DescribeContainerInstancesInput {
+      ContainerInstances: instanceArns[start:end],
+      Cluster: aws.String(clusterName),
+    }
+    resp, err := ecsSvc.DescribeContainerInstances(params)
+    if err != nil { return makeCIMapFromDescribeContainerInstancesOutput(dcio), err }
+    dcio.ContainerInstances = append(dcio.ContainerInstances, resp.ContainerInstances...)
+    dcio.Failures = append(dcio.Failures, resp.Failures...)
   }
-  resp, err := ecsSvc.DescribeContainerInstances(params)
-  return makeCIMapFromDescribeContainerInstancesOutput(resp), err
+  return makeCIMapFromDescribeContainerInstancesOutput(dcio), nil
 }
 
 func GetContainerInstanceDescription(clusterName string, containerArn string, sess *session.Session) (ContainerInstanceMap, error) {
@@ -181,6 +230,8 @@ type InstanceResource struct {
 const(
   MEMORY = "MEMORY"
   CPU = "CPU"
+  PORTS = "PORTS"
+  PORTS_UDP = "PORTS_UDP"
 )
 
 // This will add a new resoruce to the map,
@@ -223,6 +274,46 @@ func (rMap ResourceMap) Add(r *ecs.Resource) {
 
 }
 
+// The reverse of Add. Numbers are subtracted (going negative if need be),
+// and each string in a STRINGSET removes one occurrence of it.
+func (rMap ResourceMap) Subtract(r *ecs.Resource) {
+  neg := &ecs.Resource{Name: r.Name, Type: r.Type}
+  switch *r.Type {
+    case "INTEGER":
+      neg.IntegerValue = aws.Int64(-*r.IntegerValue)
+    case "LONG":
+      neg.LongValue = aws.Int64(-*r.LongValue)
+    case "DOUBLE":
+      neg.DoubleValue = aws.Float64(-*r.DoubleValue)
+    case "STRINGSET":
+      neg.StringSetValue = []*string{}
+  }
+  rMap.Add(neg)
+
+  if *r.Type == "STRINGSET" {
+    remaining := rMap[*r.Name]
+    for _, remove := range r.StringSetValue {
+      for i, s := range remaining.StringSetValue {
+        if *s == *remove {
+          remaining.StringSetValue = append(remaining.StringSetValue[:i:i], remaining.StringSetValue[i+1:]...)
+          break
+        }
+      }
+    }
+  }
+}
+
+// Subtracts every resource in other, e.g. registered.SubtractAll(remaining) is what's in use.
+func (rMap ResourceMap) SubtractAll(other ResourceMap) {
+  for _, r := range other { rMap.Subtract(r) }
+}
+
+func (rMap ResourceMap) Copy() (ResourceMap) {
+  c := make(ResourceMap, len(rMap))
+  for _, r := range rMap { c.Add(r) }
+  return c
+}
+
 func collectResources(rs []*ecs.Resource) (ResourceMap) {
   // cs := make([]*ecs.Resource, 0)
 
@@ -243,13 +334,24 @@ func (rm ResourceMap) StringFor(resourceName string) (v string) {
   return v
 }
 
-// TODO: Should add a gather flag for totaling values in StringSet.
-// e,g. ["1", "2", "3", "2", "1", "4"] => "1:2, 2:2, 3:1, 4:1" or something.
+// Returns the value of an INTEGER or LONG resource.
+func (rm ResourceMap) Int64For(resourceName string) (v int64, ok bool) {
+  r, ok := rm[resourceName]
+  if !ok { return 0, false }
+  switch {
+  case r.IntegerValue != nil: return *r.IntegerValue, true
+  case r.LongValue != nil: return *r.LongValue, true
+  }
+  return 0, false
+}
+
 func getValueString(r *ecs.Resource) (v string) {
 
     switch *r.Type {
-    case "INTEGER", "LONG": 
+    case "INTEGER":
       v = strconv.FormatInt(*r.IntegerValue,10)
+    case "LONG":
+      v = strconv.FormatInt(*r.LongValue,10)
     case "DOUBLE": 
       v = strconv.FormatFloat(*r.DoubleValue, 'g', 2, 64)
     case "STRINGSET":
@@ -258,6 +360,62 @@ func getValueString(r *ecs.Resource) (v string) {
   return v
 }
 
+// The number of times each string appears in a STRINGSET, e.g. the number of
+// instances using each port in a cluster's Totals.
+func (rm ResourceMap) StringSetCounts(resourceName string) (counts map[string]int) {
+  counts = make(map[string]int)
+  if r, ok := rm[resourceName]; ok {
+    for _, s := range r.StringSetValue { counts[*s]++ }
+  }
+  return counts
+}
+
+func (rm ResourceMap) StringSetContains(resourceName, value string) (bool) {
+  return rm.StringSetCounts(resourceName)[value] > 0
+}
+
+// Gathers up a STRINGSET, e.g. ["22", "80", "22", "8080"] => "22:2, 80:1, 8080:1"
+// Ports are sorted numerically.
+func (rm ResourceMap) GatheredStringFor(resourceName string) (v string) {
+  r, ok := rm[resourceName]
+  if !ok { return "--" }
+  if *r.Type != "STRINGSET" { return getValueString(r) }
+  counts := rm.StringSetCounts(resourceName)
+  keys := make([]string, 0, len(counts))
+  for k, _ := range counts { keys = append(keys, k) }
+  sort.Slice(keys, func(i, j int) bool {
+    ki, iErr := strconv.ParseInt(keys[i], 10, 64)
+    kj, jErr := strconv.ParseInt(keys[j], 10, 64)
+    if iErr == nil && jErr == nil { return ki < kj }
+    return keys[i] < keys[j]
+  })
+  parts := make([]string, len(keys))
+  for i, k := range keys { parts[i] = fmt.Sprintf("%s:%d", k, counts[k]) }
+  return strings.Join(parts, ", ")
+}
+
+// How much of a resource is in use, as a percentage of what's registered.
+// Only for INTEGER, LONG and DOUBLE resources.
+func (ir InstanceResource) Utilisation(resourceName string) (pct float64, ok bool) {
+  reg, ok := ir.Registered.float64For(resourceName)
+  if !ok || reg == 0 { return 0, false }
+  rem, ok := ir.Remaining.float64For(resourceName)
+  if !ok { return 0, false }
+  return (reg - rem) / reg * 100, true
+}
+
+func (ir InstanceResource) UtilisationString(resourceName string) (string) {
+  pct, ok := ir.Utilisation(resourceName)
+  if !ok { return "--" }
+  return fmt.Sprintf("%.0f%%", pct)
+}
+
+func (rm ResourceMap) float64For(resourceName string) (float64, bool) {
+  if r, ok := rm[resourceName]; ok && r.DoubleValue != nil { return *r.DoubleValue, true }
+  v, ok := rm.Int64For(resourceName)
+  return float64(v), ok
+}
+
 // Returns both the CotnainerInstanceMap (cis index by ciArn) and the ec2version ec2Is on ec2ID (not arn)
 func GetContainerMaps(clusterName string, sess *session.Session) (ciMap ContainerInstanceMap, ec2Map map[string]*ec2.Instance, err error) {
   // This is ContainerInstance indexed by ContainerInstanceARN
@@ -275,6 +433,7 @@ func GetContainerMaps(clusterName string, sess *session.Session) (ciMap Containe
   return ciMap, ec2Map, err
 }
 
+// Terminates the EC2 instance straight away, tasks and all. See DrainAndTerminate to move the tasks off first.
 func TerminateContainerInstance(clusterName string, containerArn string, sess *session.Session) (resp *ec2.TerminateInstancesOutput, err error) {
 
   ecsSvc := ecs.New(sess)
@@ -0,0 +1,180 @@
+package awslib
+
+import(
+  "context"
+  "fmt"
+  "strings"
+  "time"
+  "github.com/aws/aws-sdk-go/aws"
+  "github.com/aws/aws-sdk-go/aws/session"
+  "github.com/aws/aws-sdk-go/service/ec2"
+  "github.com/aws/aws-sdk-go/service/ecs"
+  "github.com/Sirupsen/logrus"
+)
+
+type DrainStage int
+const(
+  SetDrainingStage DrainStage = iota
+  WaitingForTasksStage
+  DeregisteringStage
+  TerminatingStage
+  TerminatedStage
+)
+
+func (s DrainStage) String() (string) {
+  switch s {
+  case SetDrainingStage: return "SetDraining"
+  case WaitingForTasksStage: return "WaitingForTasks"
+  case DeregisteringStage: return "Deregistering"
+  case TerminatingStage: return "Terminating"
+  case TerminatedStage: return "Terminated"
+  }
+  return "Unknown"
+}
+
+type DrainProgress struct {
+  Stage DrainStage
+  // The latest description we have of the instance, may be nil.
+  Instance *ecs.ContainerInstance
+  // Tasks still on the instance that belong to services, and those that don't (RunTask etc.).
+  ServiceTasks int
+  OtherTasks int
+}
+
+func (p DrainProgress) String() (string) {
+  if p.Stage != WaitingForTasksStage { return p.Stage.String() }
+  return fmt.Sprintf("%s: %d service tasks, %d other tasks", p.Stage, p.ServiceTasks, p.OtherTasks)
+}
+
+const DrainPollInterval = 10 * time.Second
+
+// Sets the container instance DRAINING, waits for its tasks to go, deregisters it and terminates its EC2 instance.
+// instance is a container instance arn or an EC2 instance id.
+// ECS moves service tasks to other instances but leaves other tasks (e.g. from RunTask) running, so
+// we wait until the instance has no tasks at all. With force we go ahead as soon as the service tasks
+// have moved, or when we time out, killing whatever is left.
+// Without force a time out is an error, and the instance is left DRAINING.
+// Progress is sent on progress (which may be nil) and the channel is closed when we're done.
+// Sends don't block, reports the caller isn't ready for are dropped, so give the channel a buffer.
+func DrainAndTerminate(clusterName, instance string, timeout time.Duration, force bool,
+  progress chan<- DrainProgress, sess *session.Session) (ci *ecs.ContainerInstance, err error) {
+
+  if progress != nil { defer close(progress) }
+  report := func(p DrainProgress) {
+    log.Debug(logrus.Fields{"cluster": clusterName, "instance": instance, "stage": p.Stage.String(),
+      "serviceTasks": p.ServiceTasks, "otherTasks": p.OtherTasks}, "DrainAndTerminate: progress.")
+    if progress != nil {
+      select {
+      case progress <- p:
+      default:
+      }
+    }
+  }
+  deadline := time.Now().Add(timeout)
+
+  ci, err = findContainerInstance(clusterName, instance, sess)
+  if err != nil { return ci, err }
+  ciArn := *ci.ContainerInstanceArn
+
+  if *ci.Status != ContainerInstanceDraining {
+    report(DrainProgress{Stage: SetDrainingStage, Instance: ci})
+    ecsSvc := ecs.New(sess)
+    resp, err := ecsSvc.UpdateContainerInstancesState(&ecs.UpdateContainerInstancesStateInput{
+      Cluster: aws.String(clusterName),
+      ContainerInstances: []*string{aws.String(ciArn)},
+      Status: aws.String(ContainerInstanceDraining),
+    })
+    if err != nil { return ci, fmt.Errorf("DrainAndTerminate: failed to set %s DRAINING: %s", instance, err) }
+    if len(resp.Failures) > 0 { return ci, fmt.Errorf("DrainAndTerminate: failed to set %s DRAINING: %#v.", instance, resp.Failures) }
+  }
+
+  tasksLeft := false
+  for {
+    ctMap, err := GetContainerInstanceTaskDescriptions(clusterName, ciArn, sess)
+    if err != nil { return ci, fmt.Errorf("DrainAndTerminate: failed to get tasks on %s: %s", instance, err) }
+    ciMap, err := GetContainerInstanceDescription(clusterName, ciArn, sess)
+    if err != nil { return ci, fmt.Errorf("DrainAndTerminate: failed to describe %s: %s", instance, err) }
+    if c, ok := ciMap[ciArn]; ok && c.Instance != nil { ci = c.Instance }
+
+    p := DrainProgress{Stage: WaitingForTasksStage, Instance: ci}
+    p.ServiceTasks, p.OtherTasks = countInstanceTasks(ctMap)
+    report(p)
+    // The agent's counts catch tasks the listing has missed.
+    tasksLeft = p.ServiceTasks + p.OtherTasks > 0 || instanceTaskCount(ci) > 0
+
+    if !tasksLeft || (force && p.ServiceTasks == 0) { break }
+    if time.Now().After(deadline) {
+      if force { break }
+      return ci, fmt.Errorf("DrainAndTerminate: timed out draining %s, %d service and %d other tasks still running. The instance has been left DRAINING.",
+        instance, p.ServiceTasks, p.OtherTasks)
+    }
+    time.Sleep(DrainPollInterval)
+  }
+
+  // Deregistering an instance with tasks on it needs force.
+  report(DrainProgress{Stage: DeregisteringStage, Instance: ci})
+  ecsSvc := ecs.New(sess)
+  dResp, err := ecsSvc.DeregisterContainerInstance(&ecs.DeregisterContainerInstanceInput{
+    Cluster: aws.String(clusterName),
+    ContainerInstance: aws.String(ciArn),
+    Force: aws.Bool(tasksLeft),
+  })
+  if err != nil { return ci, fmt.Errorf("DrainAndTerminate: failed to deregister %s: %s", instance, err) }
+  ci = dResp.ContainerInstance
+
+  report(DrainProgress{Stage: TerminatingStage, Instance: ci})
+  _, err = TerminateInstance(ci.Ec2InstanceId, sess)
+  if err != nil { return ci, fmt.Errorf("DrainAndTerminate: deregistered %s but failed to terminate %s: %s", instance, *ci.Ec2InstanceId, err) }
+
+  // OnInstanceTerminated, with the rest of our timeout (but at least a few minutes, the instance is going anyway).
+  if remaining := time.Until(deadline); remaining < 5 * time.Minute { deadline = time.Now().Add(5 * time.Minute) }
+  ctx, cancel := context.WithDeadline(context.Background(), deadline)
+  defer cancel()
+  err = ec2.New(sess).WaitUntilInstanceTerminatedWithContext(ctx, &ec2.DescribeInstancesInput{
+    InstanceIds: []*string{ci.Ec2InstanceId},
+  })
+  if err != nil { return ci, fmt.Errorf("DrainAndTerminate: failed waiting for %s to terminate: %s", *ci.Ec2InstanceId, err) }
+
+  report(DrainProgress{Stage: TerminatedStage, Instance: ci})
+  return ci, err
+}
+
+// instance is a container instance arn or an EC2 instance id.
+func findContainerInstance(clusterName, instance string, sess *session.Session) (ci *ecs.ContainerInstance, err error) {
+  var ciMap ContainerInstanceMap
+  if strings.HasPrefix(instance, "i-") {
+    all, err := GetAllContainerInstanceDescriptions(clusterName, sess)
+    if err != nil { return ci, fmt.Errorf("DrainAndTerminate: failed to get container instances for %s: %s", clusterName, err) }
+    ciMap = all.GetEc2InstanceMap()
+  } else {
+    ciMap, err = GetContainerInstanceDescription(clusterName, instance, sess)
+    if err != nil { return ci, fmt.Errorf("DrainAndTerminate: failed to describe %s: %s", instance, err) }
+  }
+  c, ok := ciMap[instance]
+  if !ok || c.Instance == nil {
+    if ok && c.Failure != nil { return ci, fmt.Errorf("DrainAndTerminate: failed to describe %s: %s", instance, stringPString(c.Failure.Reason)) }
+    return ci, fmt.Errorf("DrainAndTerminate: no container instance %s on %s", instance, clusterName)
+  }
+  return c.Instance, err
+}
+
+func instanceTaskCount(ci *ecs.ContainerInstance) (n int64) {
+  if ci.RunningTasksCount != nil { n += *ci.RunningTasksCount }
+  if ci.PendingTasksCount != nil { n += *ci.PendingTasksCount }
+  return n
+}
+
+// Tasks that haven't actually stopped yet, whatever their desired status.
+// Service tasks are in a "service:name" group.
+func countInstanceTasks(ctMap ContainerTaskMap) (serviceTasks, otherTasks int) {
+  for _, ct := range ctMap {
+    if ct.Task == nil { continue }
+    if ct.Task.LastStatus != nil && *ct.Task.LastStatus == "STOPPED" { continue }
+    if ct.Task.Group != nil && strings.HasPrefix(*ct.Task.Group, "service:") {
+      serviceTasks++
+    } else {
+      otherTasks++
+    }
+  }
+  return serviceTasks, otherTasks
+}
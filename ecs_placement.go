@@ -0,0 +1,294 @@
+package awslib
+
+import(
+  "fmt"
+  "math/rand"
+  "sort"
+  "strings"
+  "time"
+  "github.com/aws/aws-sdk-go/aws/session"
+  "github.com/aws/aws-sdk-go/service/ec2"
+  "github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// Simulates task placement offline, to see what a change of placement strategy would do
+// before making it. Works on a snapshot of the cluster, which it updates as it places tasks.
+
+// What the simulator needs to know about a container instance.
+type PlacementInstance struct {
+  ContainerInstanceArn string
+  Ec2InstanceId string
+  Status string
+  AgentConnected bool
+  AgentVersion string
+  RegisteredAt time.Time
+  RunningTasksCount int64
+  RegisteredCpu int64
+  RegisteredMemory int64
+  RemainingCpu int64
+  RemainingMemory int64
+  UsedPorts map[string]bool
+  UsedUDPPorts map[string]bool
+  // ECS attributes (ecs.instance-type, ecs.availability-zone etc.) and custom ones.
+  Attributes map[string]string
+  // Task group (e.g. service:web) => number of tasks from it on the instance.
+  Groups map[string]int
+}
+
+// One copy of a task to place.
+type PlacementTask struct {
+  Requirements TaskRequirements
+  // e.g. service:web or family:web, distinctInstance and spread work within a group.
+  Group string
+}
+
+type PlacementAssignment struct {
+  Task int
+  // "" if the task couldn't be placed.
+  ContainerInstanceArn string
+  Reason string
+}
+
+type PlacementResult struct {
+  Assignments []PlacementAssignment
+  // The snapshot after placement.
+  Instances []*PlacementInstance
+  Placed int
+  Unplaced int
+}
+
+// Builds a snapshot from the cluster's instances, their EC2 instances and the tasks on them.
+// The EC2 instance fills in the instance type and availability zone if the attributes don't have them.
+func NewPlacementSnapshot(ciMap ContainerInstanceMap, ec2Map map[string]*ec2.Instance, ctMap ContainerTaskMap) (instances []*PlacementInstance) {
+  byArn := make(map[string]*PlacementInstance)
+  for _, ci := range ciMap {
+    if ci.Instance == nil { continue }
+    i := ci.Instance
+    pi := &PlacementInstance{
+      ContainerInstanceArn: stringPString(i.ContainerInstanceArn),
+      Ec2InstanceId: stringPString(i.Ec2InstanceId),
+      Status: stringPString(i.Status),
+      UsedPorts: make(map[string]bool),
+      UsedUDPPorts: make(map[string]bool),
+      Attributes: make(map[string]string),
+      Groups: make(map[string]int),
+    }
+    if i.AgentConnected != nil { pi.AgentConnected = *i.AgentConnected }
+    if i.VersionInfo != nil { pi.AgentVersion = stringPString(i.VersionInfo.AgentVersion) }
+    if i.RegisteredAt != nil { pi.RegisteredAt = *i.RegisteredAt }
+    if i.RunningTasksCount != nil { pi.RunningTasksCount = *i.RunningTasksCount }
+    registered := collectResources(i.RegisteredResources)
+    remaining := collectResources(i.RemainingResources)
+    pi.RegisteredCpu, _ = registered.Int64For(CPU)
+    pi.RegisteredMemory, _ = registered.Int64For(MEMORY)
+    pi.RemainingCpu, _ = remaining.Int64For(CPU)
+    pi.RemainingMemory, _ = remaining.Int64For(MEMORY)
+    if r, ok := remaining[PORTS]; ok {
+      for _, p := range r.StringSetValue { pi.UsedPorts[*p] = true }
+    }
+    if r, ok := remaining[PORTS_UDP]; ok {
+      for _, p := range r.StringSetValue { pi.UsedUDPPorts[*p] = true }
+    }
+    for _, a := range i.Attributes {
+      if a.Name != nil { pi.Attributes[*a.Name] = stringPString(a.Value) }
+    }
+    if ei, ok := ec2Map[pi.Ec2InstanceId]; ok {
+      if _, ok := pi.Attributes["ecs.instance-type"]; !ok && ei.InstanceType != nil {
+        pi.Attributes["ecs.instance-type"] = *ei.InstanceType
+      }
+      if _, ok := pi.Attributes["ecs.availability-zone"]; !ok && ei.Placement != nil && ei.Placement.AvailabilityZone != nil {
+        pi.Attributes["ecs.availability-zone"] = *ei.Placement.AvailabilityZone
+      }
+    }
+    instances = append(instances, pi)
+    byArn[pi.ContainerInstanceArn] = pi
+  }
+  sort.Slice(instances, func(i, j int) bool { return instances[i].ContainerInstanceArn < instances[j].ContainerInstanceArn })
+
+  for _, ct := range ctMap {
+    if ct.Task == nil || ct.Task.ContainerInstanceArn == nil || ct.Task.Group == nil { continue }
+    if ct.Task.LastStatus != nil && *ct.Task.LastStatus == "STOPPED" { continue }
+    if pi, ok := byArn[*ct.Task.ContainerInstanceArn]; ok { pi.Groups[*ct.Task.Group]++ }
+  }
+  return instances
+}
+
+// Snapshots the cluster for SimulatePlacement.
+func GetPlacementSnapshot(clusterName string, sess *session.Session) (instances []*PlacementInstance, err error) {
+  ciMap, ec2Map, err := GetContainerMaps(clusterName, sess)
+  if err != nil { return instances, err }
+  ctMap, err := GetAllTaskDescriptions(clusterName, sess)
+  if err != nil { return instances, fmt.Errorf("GetPlacementSnapshot: can't get tasks for %s: %s", clusterName, err) }
+  return NewPlacementSnapshot(ciMap, ec2Map, ctMap), err
+}
+
+// Places the tasks in order, as ECS would:
+// the instances with room that meet the constraints (distinctInstance, memberOf) are
+// narrowed down by each strategy in turn (binpack on cpu or memory, spread on instanceId/host
+// or an attribute, random), and the first of what's left gets the task.
+// rnd is used by the random strategy, nil for a fixed seed.
+// instances is updated with the placements.
+func SimulatePlacement(instances []*PlacementInstance, tasks []PlacementTask, strategies []*ecs.PlacementStrategy,
+  constraints []*ecs.PlacementConstraint, rnd *rand.Rand) (result PlacementResult, err error) {
+
+  if rnd == nil { rnd = rand.New(rand.NewSource(1)) }
+  for _, s := range strategies {
+    if err = checkPlacementStrategy(s); err != nil { return result, err }
+  }
+
+  queries := make(map[*ecs.PlacementConstraint]*ClusterQuery)
+  for _, c := range constraints {
+    switch stringPString(c.Type) {
+    case ecs.PlacementConstraintTypeDistinctInstance:
+    case ecs.PlacementConstraintTypeMemberOf:
+      queries[c], err = ParseClusterQuery(stringPString(c.Expression))
+      if err != nil { return result, fmt.Errorf("SimulatePlacement: bad memberOf: %s", err) }
+    default:
+      return result, fmt.Errorf("SimulatePlacement: unknown constraint %s", stringPString(c.Type))
+    }
+  }
+
+  result.Instances = instances
+  for ti, task := range tasks {
+    a := PlacementAssignment{Task: ti}
+    candidates, reason := placementCandidates(instances, task, constraints, queries)
+    for _, s := range strategies {
+      candidates = applyPlacementStrategy(s, candidates, task, instances, rnd)
+    }
+    if len(candidates) == 0 {
+      a.Reason = reason
+      result.Unplaced++
+    } else {
+      pi := candidates[0]
+      pi.place(task)
+      a.ContainerInstanceArn = pi.ContainerInstanceArn
+      result.Placed++
+    }
+    result.Assignments = append(result.Assignments, a)
+  }
+  return result, err
+}
+
+func checkPlacementStrategy(s *ecs.PlacementStrategy) (error) {
+  field := strings.ToLower(stringPString(s.Field))
+  switch stringPString(s.Type) {
+  case ecs.PlacementStrategyTypeBinpack:
+    if field != "cpu" && field != "memory" { return fmt.Errorf("SimulatePlacement: binpack on %s, expected cpu or memory", stringPString(s.Field)) }
+  case ecs.PlacementStrategyTypeSpread:
+    if field != "instanceid" && field != "host" && !strings.HasPrefix(field, "attribute:") {
+      return fmt.Errorf("SimulatePlacement: spread on %s, expected instanceId, host or attribute:name", stringPString(s.Field))
+    }
+  case ecs.PlacementStrategyTypeRandom:
+  default:
+    return fmt.Errorf("SimulatePlacement: unknown strategy %s", stringPString(s.Type))
+  }
+  return nil
+}
+
+// Returns the instances the task can go on, or why there are none.
+func placementCandidates(instances []*PlacementInstance, task PlacementTask, constraints []*ecs.PlacementConstraint,
+  queries map[*ecs.PlacementConstraint]*ClusterQuery) (candidates []*PlacementInstance, reason string) {
+
+  // Count what rules out each instance, to say why nothing was found.
+  ruledOut := make(map[string]int)
+  for _, pi := range instances {
+    why := pi.fits(task.Requirements)
+    for _, c := range constraints {
+      if why != "" { break }
+      switch stringPString(c.Type) {
+      case ecs.PlacementConstraintTypeDistinctInstance:
+        if task.Group != "" && pi.Groups[task.Group] > 0 { why = "distinctInstance" }
+      case ecs.PlacementConstraintTypeMemberOf:
+        if match, _ := queries[c].Match(pi); !match { why = "memberOf" }
+      }
+    }
+    if why != "" {
+      ruledOut[why]++
+      continue
+    }
+    candidates = append(candidates, pi)
+  }
+
+  if len(candidates) == 0 {
+    reasons := make([]string, 0, len(ruledOut))
+    for why, n := range ruledOut { reasons = append(reasons, fmt.Sprintf("%s on %d", why, n)) }
+    sort.Strings(reasons)
+    reason = "no instances"
+    if len(reasons) > 0 { reason = "ruled out by " + strings.Join(reasons, ", ") }
+  }
+  return candidates, reason
+}
+
+// Returns "" if the task fits, otherwise the resource that doesn't.
+func (pi *PlacementInstance) fits(r TaskRequirements) (string) {
+  switch {
+  case pi.Status != ContainerInstanceActive: return InstanceUnavailable
+  case r.Cpu > pi.RemainingCpu: return CPU
+  case r.Memory > pi.RemainingMemory: return MEMORY
+  }
+  for _, p := range r.Ports {
+    if pi.UsedPorts[p] { return PORTS }
+  }
+  for _, p := range r.UDPPorts {
+    if pi.UsedUDPPorts[p] { return PORTS_UDP }
+  }
+  return ""
+}
+
+func (pi *PlacementInstance) place(task PlacementTask) {
+  pi.RemainingCpu -= task.Requirements.Cpu
+  pi.RemainingMemory -= task.Requirements.Memory
+  for _, p := range task.Requirements.Ports { pi.UsedPorts[p] = true }
+  for _, p := range task.Requirements.UDPPorts { pi.UsedUDPPorts[p] = true }
+  if task.Group != "" { pi.Groups[task.Group]++ }
+  pi.RunningTasksCount++
+}
+
+// Narrows candidates to the ones the strategy likes best.
+func applyPlacementStrategy(s *ecs.PlacementStrategy, candidates []*PlacementInstance, task PlacementTask,
+  instances []*PlacementInstance, rnd *rand.Rand) ([]*PlacementInstance) {
+  if len(candidates) <= 1 { return candidates }
+
+  field := strings.ToLower(stringPString(s.Field))
+  switch stringPString(s.Type) {
+  case ecs.PlacementStrategyTypeRandom:
+    return []*PlacementInstance{candidates[rnd.Intn(len(candidates))]}
+
+  case ecs.PlacementStrategyTypeBinpack:
+    // Least of the resource left.
+    left := func(pi *PlacementInstance) (int64) {
+      if field == "cpu" { return pi.RemainingCpu }
+      return pi.RemainingMemory
+    }
+    return minCandidates(candidates, left)
+
+  case ecs.PlacementStrategyTypeSpread:
+    // Fewest of the group's tasks on instances with the same value of the field,
+    // counting every instance in the snapshot, not just the candidates.
+    value := func(pi *PlacementInstance) (string) {
+      if field == "instanceid" || field == "host" { return pi.ContainerInstanceArn }
+      return pi.Attributes[stringPString(s.Field)[len("attribute:"):]]
+    }
+    counts := make(map[string]int64)
+    for _, pi := range instances {
+      if task.Group != "" { counts[value(pi)] += int64(pi.Groups[task.Group]) }
+    }
+    return minCandidates(candidates, func(pi *PlacementInstance) (int64) { return counts[value(pi)] })
+  }
+  return candidates
+}
+
+func minCandidates(candidates []*PlacementInstance, score func(*PlacementInstance) (int64)) (best []*PlacementInstance) {
+  var min int64
+  for i, pi := range candidates {
+    s := score(pi)
+    switch {
+    case i == 0 || s < min:
+      min = s
+      best = []*PlacementInstance{pi}
+    case s == min:
+      best = append(best, pi)
+    }
+  }
+  return best
+}
@@ -2,7 +2,6 @@ package awslib
 
 import(
   "fmt"
-  // "time"
   "github.com/aws/aws-sdk-go/aws"
   "github.com/aws/aws-sdk-go/aws/session"
   "github.com/aws/aws-sdk-go/service/ecs"
@@ -26,19 +25,29 @@ func ListServices(clusterName string, sess *session.Session) (services []*string
   return services, err
 }
 
+// DescribeServices takes at most this many services at a time.
+const describeServicesMax = 10
+
 func DescribeServices(clusterName string, sess *session.Session) (services  []*ecs.Service, failures []*ecs.Failure, err error) {
 
   serviceArns, err := ListServices(clusterName, sess)
   if err != nil || len(serviceArns) == 0 { return services, failures, err }
 
   ecsSvc := ecs.New(sess)
-  params := &ecs.DescribeServicesInput {
-    Cluster: aws.String(clusterName),
-    Services: serviceArns,
+  for start := 0; start < len(serviceArns); start += describeServicesMax {
+    end := start + describeServicesMax
+    if end > len(serviceArns) { end = len(serviceArns) }
+    params := &ecs.DescribeServicesInput {
+      Cluster: aws.String(clusterName),
+      Services: serviceArns[start:end],
+    }
+    res, err := ecsSvc.DescribeServices(params)
+    if err != nil { return services, failures, err }
+    services = append(services, res.Services...)
+    failures = append(failures, res.Failures...)
   }
-  res, err := ecsSvc.DescribeServices(params)
 
-  return res.Services, res.Failures, err
+  return services, failures, err
 }
 
 func DescribeService(serviceName, clusterName string, 
@@ -70,37 +79,117 @@ func DescribeService(serviceName, clusterName string,
 }
 
 
-// Create a service without a LoadBlancer.
-func CreateService(serviceName, clusterName , taskDefinitionArn string, 
-  instanceCount int64, sess *session.Session) (s *ecs.Service, err error) {
+// ServiceSpec describes a service for CreateService and UpdateService.
+// Only Name, Cluster, TaskDefinition and DesiredCount are required,
+// zero values for everything else leave the ECS defaults in place.
+// Leave DesiredCount out of an update to keep the service's current count,
+// e.g. when autoscaling manages it.
+type ServiceSpec struct {
+  Name string                                         `json:"name" yaml:"name"`
+  Cluster string                                      `json:"cluster" yaml:"cluster"`
+  TaskDefinition string                               `json:"taskDefinition" yaml:"taskDefinition"`
+  DesiredCount *int64                                 `json:"desiredCount,omitempty" yaml:"desiredCount,omitempty"`
+  // IAM role that allows ECS to register tasks with the load balancers.
+  // Required when LoadBalancers is not empty, unless you use the service-linked role.
+  Role string                                         `json:"role,omitempty" yaml:"role,omitempty"`
+  LoadBalancers []ServiceLoadBalancer                 `json:"loadBalancers,omitempty" yaml:"loadBalancers,omitempty"`
+  Deployment *DeploymentSpec                          `json:"deployment,omitempty" yaml:"deployment,omitempty"`
+  PlacementConstraints []*ecs.PlacementConstraint     `json:"placementConstraints,omitempty" yaml:"placementConstraints,omitempty"`
+  PlacementStrategy []*ecs.PlacementStrategy          `json:"placementStrategy,omitempty" yaml:"placementStrategy,omitempty"`
+  // Only used by ECS when the service has LoadBalancers.
+  HealthCheckGracePeriodSeconds int64                 `json:"healthCheckGracePeriodSeconds,omitempty" yaml:"healthCheckGracePeriodSeconds,omitempty"`
+}
 
-  ecsSvc := ecs.New(sess)
+// Set either LoadBalancerName for a classic ELB or TargetGroupArn for an ALB.
+type ServiceLoadBalancer struct {
+  LoadBalancerName string   `json:"loadBalancerName,omitempty" yaml:"loadBalancerName,omitempty"`
+  TargetGroupArn string     `json:"targetGroupArn,omitempty" yaml:"targetGroupArn,omitempty"`
+  ContainerName string      `json:"containerName" yaml:"containerName"`
+  ContainerPort int64       `json:"containerPort" yaml:"containerPort"`
+}
+
+// Percentages of DesiredCount that must stay running (Min) and may be running (Max) during a deployment.
+type DeploymentSpec struct {
+  MinimumHealthyPercent int64  `json:"minimumHealthyPercent" yaml:"minimumHealthyPercent"`
+  MaximumPercent int64         `json:"maximumPercent" yaml:"maximumPercent"`
+}
+
+func (spec ServiceSpec) loadBalancers() (lbs []*ecs.LoadBalancer) {
+  for _, lb := range spec.LoadBalancers {
+    elb := &ecs.LoadBalancer{
+      ContainerName: aws.String(lb.ContainerName),
+      ContainerPort: aws.Int64(lb.ContainerPort),
+    }
+    if lb.LoadBalancerName != "" { elb.LoadBalancerName = aws.String(lb.LoadBalancerName) }
+    if lb.TargetGroupArn != "" { elb.TargetGroupArn = aws.String(lb.TargetGroupArn) }
+    lbs = append(lbs, elb)
+  }
+  return lbs
+}
+
+func (spec ServiceSpec) deploymentConfiguration() (dc *ecs.DeploymentConfiguration) {
+  if spec.Deployment != nil {
+    dc = &ecs.DeploymentConfiguration{
+      MinimumHealthyPercent: aws.Int64(spec.Deployment.MinimumHealthyPercent),
+      MaximumPercent: aws.Int64(spec.Deployment.MaximumPercent),
+    }
+  }
+  return dc
+}
+
+func (spec ServiceSpec) healthCheckGracePeriodSeconds() (*int64) {
+  if spec.HealthCheckGracePeriodSeconds <= 0 { return nil }
+  return aws.Int64(spec.HealthCheckGracePeriodSeconds)
+}
+
+func (spec ServiceSpec) CreateServiceInput() (*ecs.CreateServiceInput) {
   params := &ecs.CreateServiceInput {
-    ServiceName: aws.String(serviceName),
-    TaskDefinition: aws.String(taskDefinitionArn),
-    Cluster: aws.String(clusterName),
-    DesiredCount: aws.Int64(instanceCount),
+    ServiceName: aws.String(spec.Name),
+    TaskDefinition: aws.String(spec.TaskDefinition),
+    Cluster: aws.String(spec.Cluster),
+    DesiredCount: spec.DesiredCount,
+    LoadBalancers: spec.loadBalancers(),
+    DeploymentConfiguration: spec.deploymentConfiguration(),
+    PlacementConstraints: spec.PlacementConstraints,
+    PlacementStrategy: spec.PlacementStrategy,
+    HealthCheckGracePeriodSeconds: spec.healthCheckGracePeriodSeconds(),
+  }
+  if spec.Role != "" { params.Role = aws.String(spec.Role) }
+  return params
+}
+
+// Role can't be changed on an existing service, so it is not part of the update.
+// An empty TaskDefinition leaves the service's current task definition in place.
+func (spec ServiceSpec) UpdateServiceInput() (*ecs.UpdateServiceInput) {
+  params := &ecs.UpdateServiceInput{
+    Service: aws.String(spec.Name),
+    Cluster: aws.String(spec.Cluster),
+    DesiredCount: spec.DesiredCount,
+    LoadBalancers: spec.loadBalancers(),
+    DeploymentConfiguration: spec.deploymentConfiguration(),
+    PlacementConstraints: spec.PlacementConstraints,
+    PlacementStrategy: spec.PlacementStrategy,
+    HealthCheckGracePeriodSeconds: spec.healthCheckGracePeriodSeconds(),
   }
+  if spec.TaskDefinition != "" { params.TaskDefinition = aws.String(spec.TaskDefinition) }
+  return params
+}
+
+// Create a service, with optional LoadBalancers, Role, Deployment and Placement configuration.
+func CreateService(spec ServiceSpec, sess *session.Session) (s *ecs.Service, err error) {
 
-  res, err := ecsSvc.CreateService(params)
+  ecsSvc := ecs.New(sess)
+  res, err := ecsSvc.CreateService(spec.CreateServiceInput())
   if err == nil { s = res.Service }
 
   return s, err
 }
 
-// Update a service with taskDefinition and instanceCount.
-func UpdateService(serviceName, clusterName, taskDefinitionArn string, 
-  instanceCount int64, sess *session.Session) (s *ecs.Service, err error) {
+// Update a service with the taskDefinition, instanceCount and configuration in spec.
+func UpdateService(spec ServiceSpec, sess *session.Session) (s *ecs.Service, err error) {
 
   ecsSvc := ecs.New(sess)
-  params := &ecs.UpdateServiceInput{
-    Service: aws.String(serviceName),
-    TaskDefinition: aws.String(taskDefinitionArn),
-    Cluster: aws.String(clusterName),
-    DesiredCount: aws.Int64(instanceCount),
-  }
-
-  res, err := ecsSvc.UpdateService(params)
+  res, err := ecsSvc.UpdateService(spec.UpdateServiceInput())
   if err == nil { s = res.Service }
 
   return s, err
@@ -179,11 +268,9 @@ func UpdateServiceDesiredCount(serviceName, clusterName string,
 }
 
 
-// TODO: Delete will fail if the status of the service is Primary and the desired count is > 0. Determine
-// if we should note this and fail to delete, or update the service to 0 and then delete or what?
-
 // Delete a service.
 // Delete will fail if primary deployment is > 0.
+// Use DeleteServiceSafely to scale the service down and drain it first.
 func DeleteService(serviceName, clusterName string, sess *session.Session) (s *ecs.Service, err error) {
 
   ecsSvc := ecs.New(sess)
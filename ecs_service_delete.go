@@ -0,0 +1,149 @@
+package awslib
+
+import(
+  "context"
+  "fmt"
+  "time"
+  "github.com/aws/aws-sdk-go/aws"
+  "github.com/aws/aws-sdk-go/aws/request"
+  "github.com/aws/aws-sdk-go/aws/session"
+  "github.com/aws/aws-sdk-go/service/ecs"
+  "github.com/Sirupsen/logrus"
+)
+
+type DeleteServiceStage int
+const(
+  ScalingDownStage DeleteServiceStage = iota
+  DrainingStage
+  DeletingStage
+  WaitingInactiveStage
+  DeletedStage
+)
+
+func (s DeleteServiceStage) String() (string) {
+  switch s {
+  case ScalingDownStage: return "ScalingDown"
+  case DrainingStage: return "Draining"
+  case DeletingStage: return "Deleting"
+  case WaitingInactiveStage: return "WaitingInactive"
+  case DeletedStage: return "Deleted"
+  }
+  return "Unknown"
+}
+
+type DeleteServiceProgress struct {
+  Stage DeleteServiceStage
+  // The latest description we have of the service, may be nil.
+  Service *ecs.Service
+}
+
+func (p DeleteServiceProgress) String() (string) {
+  if p.Service == nil { return p.Stage.String() }
+  return fmt.Sprintf("%s: running %s, pending %s", p.Stage,
+    int64PString(p.Service.RunningCount), int64PString(p.Service.PendingCount))
+}
+
+const DeleteServicePollInterval = 5 * time.Second
+
+// Scales the service to 0, waits for its tasks to stop, deletes it and waits for it to go INACTIVE.
+// Progress is sent on progress (which may be nil) and the channel is closed when we're done.
+// Sends don't block, reports the caller isn't ready for are dropped, so give the channel a buffer.
+// Returns an error, without deleting the service, if we time out while draining or something
+// unexpected happens to the service along the way (e.g. someone scales it back up).
+func DeleteServiceSafely(serviceName, clusterName string, timeout time.Duration,
+  progress chan<- DeleteServiceProgress, sess *session.Session) (s *ecs.Service, err error) {
+
+  if progress != nil { defer close(progress) }
+  report := func(stage DeleteServiceStage, s *ecs.Service) {
+    log.Debug(logrus.Fields{"service": serviceName, "cluster": clusterName, "stage": stage.String()},
+      "DeleteServiceSafely: progress.")
+    if progress != nil {
+      select {
+      case progress <- DeleteServiceProgress{Stage: stage, Service: s}:
+      default:
+      }
+    }
+  }
+  deadline := time.Now().Add(timeout)
+
+  s, err = describeServiceForDelete(serviceName, clusterName, sess)
+  if err != nil { return s, err }
+  switch *s.Status {
+  case "INACTIVE":
+    return s, fmt.Errorf("DeleteServiceSafely: service %s is already INACTIVE.", serviceName)
+  case "DRAINING": // Already deleted, we just need to wait.
+  default:
+    if *s.DesiredCount > 0 {
+      report(ScalingDownStage, s)
+      s, err = UpdateServiceDesiredCount(serviceName, clusterName, 0, sess)
+      if err != nil { return s, fmt.Errorf("DeleteServiceSafely: failed to scale %s down: %s", serviceName, err) }
+    }
+
+    for !serviceDrained(s) {
+      report(DrainingStage, s)
+      if time.Now().After(deadline) {
+        return s, fmt.Errorf("DeleteServiceSafely: timed out draining %s, %d tasks still running. The service has not been deleted.",
+          serviceName, *s.RunningCount)
+      }
+      time.Sleep(DeleteServicePollInterval)
+      s, err = describeServiceForDelete(serviceName, clusterName, sess)
+      if err != nil { return s, err }
+      if *s.DesiredCount > 0 {
+        return s, fmt.Errorf("DeleteServiceSafely: %s was scaled back up to %d while draining, refusing to delete.",
+          serviceName, *s.DesiredCount)
+      }
+      if *s.Status != "ACTIVE" {
+        return s, fmt.Errorf("DeleteServiceSafely: %s went %s while draining, refusing to delete.", serviceName, *s.Status)
+      }
+    }
+
+    report(DeletingStage, s)
+    s, err = DeleteService(serviceName, clusterName, sess)
+    if err != nil { return s, fmt.Errorf("DeleteServiceSafely: failed to delete %s: %s", serviceName, err) }
+  }
+
+  // OnServiceInactive, with the rest of our timeout.
+  report(WaitingInactiveStage, s)
+  ctx, cancel := context.WithDeadline(context.Background(), deadline)
+  defer cancel()
+  ecsSvc := ecs.New(sess)
+  params := &ecs.DescribeServicesInput{
+    Services: []*string{aws.String(serviceName)},
+    Cluster: aws.String(clusterName),
+  }
+  // The waiter gives up after its own MaxAttempts, make that agree with the deadline.
+  err = ecsSvc.WaitUntilServicesInactiveWithContext(ctx, params,
+    request.WithWaiterDelay(request.ConstantWaiterDelay(DeleteServicePollInterval)),
+    request.WithWaiterMaxAttempts(waiterAttempts(time.Until(deadline), DeleteServicePollInterval)))
+  if err != nil {
+    return s, fmt.Errorf("DeleteServiceSafely: %s deleted but failed waiting for it to go INACTIVE: %s", serviceName, err)
+  }
+
+  report(DeletedStage, s)
+  return s, err
+}
+
+// Enough attempts, delay apart, to last out remaining, and at least one.
+func waiterAttempts(remaining, delay time.Duration) (int) {
+  n := int(remaining / delay) + 1
+  if n < 1 { n = 1 }
+  return n
+}
+
+func describeServiceForDelete(serviceName, clusterName string, sess *session.Session) (s *ecs.Service, err error) {
+  s, failures, err := DescribeService(serviceName, clusterName, sess)
+  if err != nil { return s, fmt.Errorf("DeleteServiceSafely: failed to describe %s: %s", serviceName, err) }
+  if len(failures) > 0 {
+    return s, fmt.Errorf("DeleteServiceSafely: refusing to delete %s, failures describing it: %#v.", serviceName, failures)
+  }
+  return s, err
+}
+
+// No tasks running or on their way in any of the deployments.
+func serviceDrained(s *ecs.Service) (bool) {
+  if *s.RunningCount > 0 || *s.PendingCount > 0 { return false }
+  for _, d := range s.Deployments {
+    if *d.RunningCount > 0 || *d.PendingCount > 0 { return false }
+  }
+  return true
+}
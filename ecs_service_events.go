@@ -0,0 +1,195 @@
+package awslib
+
+import(
+  "fmt"
+  "strings"
+  "sync"
+  "time"
+  "github.com/aws/aws-sdk-go/aws/session"
+  "github.com/aws/aws-sdk-go/service/ecs"
+  "github.com/Sirupsen/logrus"
+)
+
+// ECS keeps the last 100 events on a service and returns all of them
+// on every DescribeServices. The watcher remembers the last event it
+// has seen, and when it was, and only hands on the new ones.
+
+type ServiceEventKind int
+const(
+  OtherServiceEvent ServiceEventKind = iota
+  SteadyStateEvent
+  UnableToPlaceTaskEvent
+  RegisteredTargetsEvent
+  DeregisteredTargetsEvent
+)
+
+func (k ServiceEventKind) String() (string) {
+  switch k {
+  case SteadyStateEvent: return "SteadyState"
+  case UnableToPlaceTaskEvent: return "UnableToPlaceTask"
+  case RegisteredTargetsEvent: return "RegisteredTargets"
+  case DeregisteredTargetsEvent: return "DeregisteredTargets"
+  }
+  return "Other"
+}
+
+type ServiceEvent struct {
+  Kind ServiceEventKind
+  Event *ecs.ServiceEvent
+}
+
+// Classifies the message of a service event. These are matched on the
+// text ECS uses, e.g.:
+// "(service web) has reached a steady state."
+// "(service web) was unable to place a task because no container instance met all of its requirements. ..."
+// "(service web) registered 1 targets in (target-group arn:...)"
+// "(service web) deregistered 1 instances in (elb web-elb)"
+func ClassifyServiceEvent(message string) (ServiceEventKind) {
+  switch {
+  case strings.Contains(message, "has reached a steady state"):
+    return SteadyStateEvent
+  case strings.Contains(message, "was unable to place a task"):
+    return UnableToPlaceTaskEvent
+  // deregistered contains registered so it has to come first.
+  case strings.Contains(message, " deregistered "):
+    return DeregisteredTargetsEvent
+  case strings.Contains(message, " registered "):
+    return RegisteredTargetsEvent
+  }
+  return OtherServiceEvent
+}
+
+// ECS returns events newest first. This returns the events that are newer than
+// lastEventId, oldest first. If lastEventId has dropped out of events, those created
+// after lastEventAt are new. With neither (or a zero lastEventAt) all of them are new.
+func newServiceEvents(events []*ecs.ServiceEvent, lastEventId string, lastEventAt time.Time) (newEvents []ServiceEvent) {
+  newEvents = make([]ServiceEvent, 0)
+  found := false
+  for _, e := range events {
+    if e.Id != nil && *e.Id == lastEventId { found = true }
+  }
+  for i := len(events) - 1; i >= 0; i-- {
+    e := events[i]
+    if e.Id != nil && *e.Id == lastEventId {
+      newEvents = newEvents[:0]
+      continue
+    }
+    if !found && !lastEventAt.IsZero() && (e.CreatedAt == nil || !e.CreatedAt.After(lastEventAt)) { continue }
+    m := ""
+    if e.Message != nil { m = *e.Message }
+    newEvents = append(newEvents, ServiceEvent{Kind: ClassifyServiceEvent(m), Event: e})
+  }
+  return newEvents
+}
+
+const DefaultServiceEventInterval = 10 * time.Second
+
+type ServiceEventWatcher struct {
+  ServiceName string
+  ClusterName string
+  Interval time.Duration
+  // New events, oldest first. Closed when the watcher stops.
+  Events chan ServiceEvent
+  // Errors from polling. The watcher keeps going after an error.
+  Errors chan error
+  // Guards lastEventId and lastEventAt.
+  mu sync.Mutex
+  lastEventId string
+  lastEventAt time.Time
+  sess *session.Session
+  done chan struct{}
+  startOnce sync.Once
+  stopOnce sync.Once
+}
+
+// The watcher starts by skipping the events the service already has,
+// call SetLastEventId("") before Start() to get the history too.
+func NewServiceEventWatcher(serviceName, clusterName string, sess *session.Session) (w *ServiceEventWatcher, err error) {
+  w = &ServiceEventWatcher{
+    ServiceName: serviceName,
+    ClusterName: clusterName,
+    Interval: DefaultServiceEventInterval,
+    Events: make(chan ServiceEvent, 100),
+    Errors: make(chan error, 1),
+    sess: sess,
+    done: make(chan struct{}),
+  }
+  _, err = w.Poll()
+  return w, err
+}
+
+func (w *ServiceEventWatcher) LastEventId() (string) {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+  return w.lastEventId
+}
+
+// We don't know when id was, so if it has dropped out of the service's events
+// the next Poll returns all of them.
+func (w *ServiceEventWatcher) SetLastEventId(id string) {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+  w.lastEventId = id
+  w.lastEventAt = time.Time{}
+}
+
+// Returns the events since the last Poll, oldest first, and remembers the newest.
+func (w *ServiceEventWatcher) Poll() (events []ServiceEvent, err error) {
+  s, failures, err := DescribeService(w.ServiceName, w.ClusterName, w.sess)
+  if err != nil { return events, err }
+  if len(failures) > 0 {
+    return events, fmt.Errorf("Failed when obtaining service description for %s: %#v.", w.ServiceName, failures)
+  }
+
+  w.mu.Lock()
+  defer w.mu.Unlock()
+  events = newServiceEvents(s.Events, w.lastEventId, w.lastEventAt)
+  if len(events) > 0 {
+    last := events[len(events)-1].Event
+    w.lastEventId = stringPString(last.Id)
+    if last.CreatedAt != nil { w.lastEventAt = *last.CreatedAt }
+  }
+  return events, err
+}
+
+// Polls every Interval, sending new events on Events and errors on Errors until Stop().
+// Only the first call starts the watcher.
+func (w *ServiceEventWatcher) Start() {
+  w.startOnce.Do(func() { go w.watch() })
+}
+
+func (w *ServiceEventWatcher) watch() {
+  defer close(w.Events)
+  ticker := time.NewTicker(w.Interval)
+  defer ticker.Stop()
+  for {
+    select {
+    case <-w.done:
+      return
+    case <-ticker.C:
+    }
+
+    events, err := w.Poll()
+    if err != nil {
+      log.Debug(logrus.Fields{"service": w.ServiceName, "cluster": w.ClusterName, "error": err},
+        "ServiceEventWatcher: failed to poll service.")
+      select {
+      case w.Errors <- err:
+      default: // Drop it if no one is listening.
+      }
+      continue
+    }
+    for _, e := range events {
+      select {
+      case w.Events <- e:
+      case <-w.done:
+        return
+      }
+    }
+  }
+}
+
+// Safe to call more than once.
+func (w *ServiceEventWatcher) Stop() {
+  w.stopOnce.Do(func() { close(w.done) })
+}
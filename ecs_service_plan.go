@@ -0,0 +1,303 @@
+package awslib
+
+import(
+  "fmt"
+  "io"
+  "io/ioutil"
+  "sort"
+  "strings"
+  "time"
+  "github.com/aws/aws-sdk-go/aws"
+  "github.com/aws/aws-sdk-go/aws/session"
+  "github.com/aws/aws-sdk-go/service/ecs"
+  "github.com/Sirupsen/logrus"
+  "gopkg.in/yaml.v2"
+)
+
+// Services kept in files, e.g.:
+//
+// services:
+//   - name: web
+//     cluster: production
+//     taskDefinition: web        # family (latest revision) or family:revision
+//     desiredCount: 2            # leave out to keep the current count, e.g. under autoscaling
+//     images:
+//       web: 123456789012.dkr.ecr.us-east-1.amazonaws.com/web:1.2.0
+//     deployment:
+//       minimumHealthyPercent: 50
+//       maximumPercent: 200
+//
+// Plan compares these against what DescribeServices returns for a cluster,
+// and Apply makes the changes. Services that aren't in the file are left alone
+// unless you ask Plan to prune them.
+
+// A ServiceSpec with the images we want the service's containers running.
+// Images are keyed on container name. If they don't match the task definition
+// a new revision of it is registered with the images swapped in, so use
+// a family rather than family:revision for the TaskDefinition along with Images.
+type DesiredService struct {
+  ServiceSpec                 `yaml:",inline"`
+  Images map[string]string    `json:"images,omitempty" yaml:"images,omitempty"`
+}
+
+type ServiceSpecs []DesiredService
+
+type serviceSpecFile struct {
+  Services ServiceSpecs `yaml:"services"`
+}
+
+func LoadServiceSpecs(r io.Reader) (specs ServiceSpecs, err error) {
+  b, err := ioutil.ReadAll(r)
+  if err != nil { return specs, err }
+
+  var f serviceSpecFile
+  err = yaml.UnmarshalStrict(b, &f)
+  if err != nil { return specs, fmt.Errorf("LoadServiceSpecs: %s", err) }
+
+  seen := make(map[string]bool, len(f.Services))
+  for i, s := range f.Services {
+    if s.Name == "" { return specs, fmt.Errorf("LoadServiceSpecs: service %d has no name.", i+1) }
+    if s.TaskDefinition == "" { return specs, fmt.Errorf("LoadServiceSpecs: service %s has no taskDefinition.", s.Name) }
+    k := s.Cluster + "/" + s.Name
+    if seen[k] { return specs, fmt.Errorf("LoadServiceSpecs: service %s is defined more than once.", k) }
+    seen[k] = true
+  }
+  return f.Services, err
+}
+
+type ServiceActionType int
+const(
+  CreateServiceAction ServiceActionType = iota
+  UpdateServiceAction
+  DeleteServiceAction
+)
+
+func (t ServiceActionType) String() (string) {
+  switch t {
+  case CreateServiceAction: return "create"
+  case UpdateServiceAction: return "update"
+  case DeleteServiceAction: return "delete"
+  }
+  return "unknown"
+}
+
+type ServiceAction struct {
+  Type ServiceActionType
+  // The desired service. Empty on a delete.
+  Desired DesiredService
+  // The current service. Nil on a create.
+  Service *ecs.Service
+  // Human readable description of the differences, e.g. "desiredCount: 2 -> 3".
+  Changes []string
+}
+
+func (a ServiceAction) ServiceName() (string) {
+  if a.Service != nil { return *a.Service.ServiceName }
+  return a.Desired.Name
+}
+
+func (a ServiceAction) String() (string) {
+  s := fmt.Sprintf("%s %s", a.Type, a.ServiceName())
+  if len(a.Changes) > 0 {
+    s += ": " + strings.Join(a.Changes, ", ")
+  }
+  return s
+}
+
+type ServicePlan struct {
+  ClusterName string
+  Actions []ServiceAction
+}
+
+// How long Apply gives DeleteServiceSafely to drain each service it deletes.
+var ServicePlanDeleteTimeout = 10 * time.Minute
+
+// Compares the specs for clusterName (or with no cluster) against the services running
+// in the cluster. With prune, services in the cluster that are not in specs are deleted,
+// which needs at least one spec for the cluster so that the wrong file can't empty it.
+func (specs ServiceSpecs) Plan(clusterName string, prune bool, sess *session.Session) (plan ServicePlan, err error) {
+  plan.ClusterName = clusterName
+  if prune && len(specs.forCluster(clusterName)) == 0 {
+    return plan, fmt.Errorf("Plan: no services in the specs for %s, refusing to prune.", clusterName)
+  }
+  // DescribeServices batches its calls, clusters have more services than one call takes.
+  services, failures, err := DescribeServices(clusterName, sess)
+  if err != nil { return plan, err }
+  if len(failures) > 0 { return plan, fmt.Errorf("Failed when obtaining service descriptions: %#v.", failures) }
+
+  // We need the task definitions we're running, and the latest revision
+  // for families without one in the spec.
+  tdCache := make(map[string]*ecs.TaskDefinition)
+  getTD := func(tdArn string) (td *ecs.TaskDefinition, err error) {
+    if td, ok := tdCache[tdArn]; ok { return td, nil }
+    td, err = SharedTaskDefinitionCache.Get(tdArn, sess)
+    if err == nil { tdCache[tdArn] = td }
+    return td, err
+  }
+
+  desiredTDs := make(map[string]*ecs.TaskDefinition)
+  for _, d := range specs.forCluster(clusterName) {
+    td, err := getTD(d.TaskDefinition)
+    if err != nil { return plan, fmt.Errorf("Plan: can't get task definition %s for %s: %s", d.TaskDefinition, d.Name, err) }
+    desiredTDs[d.Name] = td
+  }
+
+  currentTDs := make(map[string]*ecs.TaskDefinition)
+  for _, s := range services {
+    if s.TaskDefinition == nil { continue }
+    td, err := getTD(*s.TaskDefinition)
+    if err != nil { return plan, fmt.Errorf("Plan: can't get task definition %s for %s: %s", *s.TaskDefinition, *s.ServiceName, err) }
+    currentTDs[*s.ServiceName] = td
+  }
+
+  plan.Actions = planServiceActions(specs, clusterName, prune, services, desiredTDs, currentTDs)
+  return plan, err
+}
+
+// The specs for clusterName, and those with no cluster.
+func (specs ServiceSpecs) forCluster(clusterName string) (forCluster ServiceSpecs) {
+  for _, d := range specs {
+    if d.Cluster == "" || d.Cluster == clusterName { forCluster = append(forCluster, d) }
+  }
+  return forCluster
+}
+
+// desiredTDs is keyed on desired service name, currentTDs on current service name.
+// Deletes are only planned with prune, and never when none of the specs are for the cluster.
+func planServiceActions(specs ServiceSpecs, clusterName string, prune bool, services []*ecs.Service,
+  desiredTDs, currentTDs map[string]*ecs.TaskDefinition) (actions []ServiceAction) {
+
+  current := make(map[string]*ecs.Service, len(services))
+  for _, s := range services {
+    // Deleted services hang around as INACTIVE, and DRAINING ones are on their way.
+    if s.Status != nil && *s.Status != "ACTIVE" { continue }
+    current[*s.ServiceName] = s
+  }
+
+  specs = specs.forCluster(clusterName)
+  wanted := make(map[string]bool, len(specs))
+  for _, d := range specs {
+    d.Cluster = clusterName
+    wanted[d.Name] = true
+
+    s, ok := current[d.Name]
+    if !ok {
+      a := ServiceAction{Type: CreateServiceAction, Desired: d}
+      a.Changes = imageChanges(d.Images, desiredTDs[d.Name])
+      actions = append(actions, a)
+      continue
+    }
+
+    changes := serviceChanges(d, s, desiredTDs[d.Name], currentTDs[d.Name])
+    if len(changes) > 0 {
+      actions = append(actions, ServiceAction{Type: UpdateServiceAction, Desired: d, Service: s, Changes: changes})
+    }
+  }
+
+  if !prune || len(specs) == 0 { return actions }
+  names := make([]string, 0)
+  for n, _ := range current {
+    if !wanted[n] { names = append(names, n) }
+  }
+  sort.Strings(names)
+  for _, n := range names {
+    actions = append(actions, ServiceAction{Type: DeleteServiceAction, Service: current[n]})
+  }
+
+  return actions
+}
+
+func serviceChanges(d DesiredService, s *ecs.Service, desiredTD, currentTD *ecs.TaskDefinition) (changes []string) {
+  if desiredTD != nil && s.TaskDefinition != nil && *desiredTD.TaskDefinitionArn != *s.TaskDefinition {
+    changes = append(changes, fmt.Sprintf("taskDefinition: %s -> %s",
+      ShortArnString(s.TaskDefinition), ShortArnString(desiredTD.TaskDefinitionArn)))
+  }
+
+  // Images are what we'll end up running, so compare against the current revision.
+  changes = append(changes, imageChanges(d.Images, currentTD)...)
+
+  // No desiredCount leaves the count to whatever else is managing it, autoscaling say.
+  if d.DesiredCount != nil && (s.DesiredCount == nil || *s.DesiredCount != *d.DesiredCount) {
+    changes = append(changes, fmt.Sprintf("desiredCount: %s -> %d", int64PString(s.DesiredCount), *d.DesiredCount))
+  }
+
+  if d.Deployment != nil {
+    dc := s.DeploymentConfiguration
+    if dc == nil { dc = &ecs.DeploymentConfiguration{} }
+    if dc.MinimumHealthyPercent == nil || *dc.MinimumHealthyPercent != d.Deployment.MinimumHealthyPercent ||
+      dc.MaximumPercent == nil || *dc.MaximumPercent != d.Deployment.MaximumPercent {
+      changes = append(changes, fmt.Sprintf("deployment: %s/%s -> %d/%d",
+        int64PString(dc.MinimumHealthyPercent), int64PString(dc.MaximumPercent),
+        d.Deployment.MinimumHealthyPercent, d.Deployment.MaximumPercent))
+    }
+  }
+  return changes
+}
+
+func imageChanges(images map[string]string, td *ecs.TaskDefinition) (changes []string) {
+  names := make([]string, 0, len(images))
+  for n, _ := range images { names = append(names, n) }
+  sort.Strings(names)
+  for _, n := range names {
+    current := "<none>"
+    if td != nil {
+      if cd, ok := GetContainerDefinition(n, td); ok && cd.Image != nil { current = *cd.Image }
+    }
+    if current != images[n] {
+      changes = append(changes, fmt.Sprintf("image %s: %s -> %s", n, current, images[n]))
+    }
+  }
+  return changes
+}
+
+func int64PString(i *int64) (string) {
+  if i == nil { return "--" }
+  return fmt.Sprintf("%d", *i)
+}
+
+// Executes the actions in the plan in order, stopping at the first error.
+// With dryRun nothing is changed and all the actions are returned as applied.
+func (plan ServicePlan) Apply(dryRun bool, sess *session.Session) (applied []ServiceAction, err error) {
+  for _, a := range plan.Actions {
+    f := logrus.Fields{"cluster": plan.ClusterName, "service": a.ServiceName(), "action": a.Type.String(), "dryRun": dryRun}
+    log.Debug(f, "Applying service action.")
+    if dryRun {
+      applied = append(applied, a)
+      continue
+    }
+
+    switch a.Type {
+    case CreateServiceAction, UpdateServiceAction:
+      spec := a.Desired.ServiceSpec
+      if len(a.Desired.Images) > 0 {
+        td, err := registerWithImages(a, sess)
+        if err != nil { return applied, fmt.Errorf("Apply: %s: %s", a.ServiceName(), err) }
+        spec.TaskDefinition = *td.TaskDefinitionArn
+      }
+      if a.Type == CreateServiceAction {
+        _, err = CreateService(spec, sess)
+      } else {
+        _, err = UpdateService(spec, sess)
+      }
+    case DeleteServiceAction:
+      _, err = DeleteServiceSafely(a.ServiceName(), plan.ClusterName, ServicePlanDeleteTimeout, nil, sess)
+    }
+    if err != nil { return applied, fmt.Errorf("Apply: failed to %s: %s", a, err) }
+    applied = append(applied, a)
+  }
+  return applied, err
+}
+
+// Registers a new revision of the task definition the action will run with the
+// desired images, unless the images are already there.
+func registerWithImages(a ServiceAction, sess *session.Session) (td *ecs.TaskDefinition, err error) {
+  td, err = GetTaskDefinition(a.Desired.TaskDefinition, sess)
+  if err != nil { return td, err }
+  if len(imageChanges(a.Desired.Images, td)) == 0 { return td, err }
+
+  tdi := TaskDefinitionToInput(td)
+  for _, cd := range tdi.ContainerDefinitions {
+    if image, ok := a.Desired.Images[*cd.Name]; ok { cd.Image = aws.String(image) }
+  }
+  return RegisterTaskDefinition(tdi, sess)
+}
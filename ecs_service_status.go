@@ -0,0 +1,149 @@
+package awslib
+
+import(
+  "fmt"
+  "sort"
+  "time"
+  "github.com/aws/aws-sdk-go/aws/session"
+  "github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// The health of a service, in order of increasing severity.
+type ServiceHealth int
+const(
+  InactiveService ServiceHealth = iota
+  HealthyService
+  DeployingService
+  DegradedService
+  StalledService
+)
+
+func (h ServiceHealth) String() (string) {
+  switch h {
+  case InactiveService: return "Inactive"
+  case HealthyService: return "Healthy"
+  case DeployingService: return "Deploying"
+  case DegradedService: return "Degraded"
+  case StalledService: return "Stalled"
+  }
+  return "Unknown"
+}
+
+// A deployment that hasn't finished in this long is Stalled.
+// A service short of tasks for this long after its last update is Degraded rather than Deploying.
+const ServiceStallTimeout = 10 * time.Minute
+
+// A summary of a service as returned by DescribeServices.
+type ServiceStatus struct {
+  Service *ecs.Service
+  Name string
+  Running int64
+  Pending int64
+  Desired int64
+  Deployments int
+  RollingOut bool
+  // Time since the most recent service event, 0 if there are none.
+  LastEventAge time.Duration
+  Health ServiceHealth
+  // Why the service got the Health it did.
+  Reason string
+}
+
+func NewServiceStatus(s *ecs.Service) (ServiceStatus) {
+  return newServiceStatusAt(s, time.Now())
+}
+
+func newServiceStatusAt(s *ecs.Service, now time.Time) (st ServiceStatus) {
+  st.Service = s
+  if s.ServiceName != nil { st.Name = *s.ServiceName }
+  if s.RunningCount != nil { st.Running = *s.RunningCount }
+  if s.PendingCount != nil { st.Pending = *s.PendingCount }
+  if s.DesiredCount != nil { st.Desired = *s.DesiredCount }
+  st.Deployments = len(s.Deployments)
+
+  var primary *ecs.Deployment
+  for _, d := range s.Deployments {
+    if d.Status != nil && *d.Status == "PRIMARY" { primary = d }
+    if d.RolloutState != nil && *d.RolloutState == "IN_PROGRESS" { st.RollingOut = true }
+  }
+  if st.Deployments > 1 { st.RollingOut = true }
+
+  // ECS returns events newest first.
+  var lastEvent *ecs.ServiceEvent
+  if len(s.Events) > 0 {
+    lastEvent = s.Events[0]
+    if lastEvent.CreatedAt != nil { st.LastEventAge = now.Sub(*lastEvent.CreatedAt) }
+  }
+
+  // How long the primary deployment has been trying to get where it's going.
+  var sinceUpdate time.Duration
+  if primary != nil && primary.UpdatedAt != nil { sinceUpdate = now.Sub(*primary.UpdatedAt) }
+
+  switch {
+  case s.Status != nil && *s.Status != "ACTIVE":
+    st.Health = InactiveService
+    st.Reason = fmt.Sprintf("status is %s", *s.Status)
+  case st.Running < st.Desired && lastEvent != nil && lastEvent.Message != nil &&
+    ClassifyServiceEvent(*lastEvent.Message) == UnableToPlaceTaskEvent:
+    st.Health = StalledService
+    st.Reason = "unable to place tasks"
+  case st.RollingOut && sinceUpdate > ServiceStallTimeout:
+    st.Health = StalledService
+    st.Reason = fmt.Sprintf("deployment has not finished in %s", ShortDurationString(sinceUpdate))
+  case st.RollingOut:
+    st.Health = DeployingService
+    st.Reason = fmt.Sprintf("%d deployments", st.Deployments)
+  // A recent update that is still short of tasks is a scale up, otherwise we've lost tasks.
+  case st.Running < st.Desired && primary != nil && primary.UpdatedAt != nil && sinceUpdate <= ServiceStallTimeout:
+    st.Health = DeployingService
+    st.Reason = fmt.Sprintf("scaling to %d", st.Desired)
+  case st.Running < st.Desired:
+    st.Health = DegradedService
+    st.Reason = fmt.Sprintf("%d of %d tasks running", st.Running, st.Desired)
+  default:
+    st.Health = HealthyService
+    st.Reason = fmt.Sprintf("%d of %d tasks running", st.Running, st.Desired)
+  }
+  return st
+}
+
+func (st ServiceStatus) LastEventAgeString() (string) {
+  if st.LastEventAge == 0 { return "--" }
+  return ShortDurationString(st.LastEventAge)
+}
+
+type ServiceStatuses []ServiceStatus
+
+// Returns the status of every service on the cluster, most severe first.
+func ServiceStatusForCluster(clusterName string, sess *session.Session) (statuses ServiceStatuses, err error) {
+  services, failures, err := DescribeServices(clusterName, sess)
+  if err != nil { return statuses, err }
+  if len(failures) > 0 { return statuses, fmt.Errorf("Failed when obtaining service descriptions: %#v.", failures) }
+
+  statuses = make(ServiceStatuses, 0, len(services))
+  for _, s := range services {
+    statuses = append(statuses, NewServiceStatus(s))
+  }
+  sort.Sort(BySeverity(statuses))
+  return statuses, err
+}
+
+// Sorting interface
+type serviceStatusSort struct {
+  ss ServiceStatuses
+  less func(iS, jS ServiceStatus) (bool)
+}
+func (s serviceStatusSort) Len() int { return len(s.ss) }
+func (s serviceStatusSort) Swap(i, j int) { s.ss[i], s.ss[j] = s.ss[j], s.ss[i] }
+func (s serviceStatusSort) Less(i, j int) bool { return s.less(s.ss[i], s.ss[j]) }
+
+// Most severe first, then by name.
+func BySeverity(ss ServiceStatuses) (serviceStatusSort) {
+  return serviceStatusSort{
+    ss: ss,
+    less: func(iS, jS ServiceStatus) (bool) {
+      if iS.Health != jS.Health { return iS.Health > jS.Health }
+      return iS.Name < jS.Name
+    },
+  }
+}
@@ -0,0 +1,361 @@
+package awslib
+
+import(
+  "sort"
+  "strings"
+  "testing"
+  "time"
+  "github.com/aws/aws-sdk-go/aws"
+  "github.com/aws/aws-sdk-go/service/applicationautoscaling"
+  "github.com/aws/aws-sdk-go/service/ecs"
+  "github.com/aws/aws-sdk-go/service/route53"
+  "github.com/stretchr/testify/assert"
+)
+
+func TestServiceSpecInputs(t *testing.T) {
+  spec := ServiceSpec{
+    Name: "web",
+    Cluster: "test-cluster",
+    TaskDefinition: "web:3",
+    DesiredCount: aws.Int64(2),
+    Role: "ecsServiceRole",
+    LoadBalancers: []ServiceLoadBalancer{
+      {TargetGroupArn: "arn:aws:elasticloadbalancing:us-east-1:123456789012:targetgroup/web/1", ContainerName: "web", ContainerPort: 80},
+    },
+    Deployment: &DeploymentSpec{MinimumHealthyPercent: 50, MaximumPercent: 200},
+    HealthCheckGracePeriodSeconds: 90,
+  }
+
+  ci := spec.CreateServiceInput()
+  assert.Equal(t, "web", *ci.ServiceName)
+  assert.Equal(t, "ecsServiceRole", *ci.Role)
+  if assert.Len(t, ci.LoadBalancers, 1) {
+    assert.Nil(t, ci.LoadBalancers[0].LoadBalancerName)
+    assert.Equal(t, int64(80), *ci.LoadBalancers[0].ContainerPort)
+  }
+  assert.Equal(t, int64(50), *ci.DeploymentConfiguration.MinimumHealthyPercent)
+  assert.Equal(t, int64(90), *ci.HealthCheckGracePeriodSeconds)
+
+  spec.TaskDefinition = ""
+  spec.Deployment = nil
+  spec.HealthCheckGracePeriodSeconds = 0
+  ui := spec.UpdateServiceInput()
+  assert.Nil(t, ui.TaskDefinition)
+  assert.Nil(t, ui.DeploymentConfiguration)
+  assert.Nil(t, ui.HealthCheckGracePeriodSeconds)
+  assert.Equal(t, int64(2), *ui.DesiredCount)
+
+  // Leaving the count out of an update keeps the service's, autoscaling's say.
+  spec.DesiredCount = nil
+  assert.Nil(t, spec.UpdateServiceInput().DesiredCount)
+}
+
+func TestClassifyServiceEvent(t *testing.T) {
+  tests := []struct{
+    message string
+    expected ServiceEventKind
+  }{
+    {"(service web) has reached a steady state.", SteadyStateEvent},
+    {"(service web) was unable to place a task because no container instance met all of its requirements.", UnableToPlaceTaskEvent},
+    {"(service web) registered 2 targets in (target-group arn:aws:elasticloadbalancing:us-east-1:1:targetgroup/web/1)", RegisteredTargetsEvent},
+    {"(service web) deregistered 1 instances in (elb web-elb)", DeregisteredTargetsEvent},
+    {"(service web) has started 1 tasks: (task 1234).", OtherServiceEvent},
+  }
+  for _, test := range tests {
+    assert.Equal(t, test.expected, ClassifyServiceEvent(test.message), test.message)
+  }
+}
+
+func TestNewServiceEvents(t *testing.T) {
+  // Newest first, as ECS returns them.
+  at := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+  events := []*ecs.ServiceEvent{
+    {Id: aws.String("3"), CreatedAt: aws.Time(at.Add(2 * time.Minute)), Message: aws.String("(service web) has reached a steady state.")},
+    {Id: aws.String("2"), CreatedAt: aws.Time(at.Add(time.Minute)), Message: aws.String("(service web) registered 1 targets in (target-group tg)")},
+    {Id: aws.String("1"), CreatedAt: aws.Time(at), Message: aws.String("(service web) has started 1 tasks: (task 1234).")},
+  }
+
+  all := newServiceEvents(events, "", time.Time{})
+  if assert.Len(t, all, 3) {
+    assert.Equal(t, "1", *all[0].Event.Id)
+    assert.Equal(t, "3", *all[2].Event.Id)
+  }
+
+  since := newServiceEvents(events, "1", at)
+  if assert.Len(t, since, 2) {
+    assert.Equal(t, RegisteredTargetsEvent, since[0].Kind)
+    assert.Equal(t, SteadyStateEvent, since[1].Kind)
+  }
+
+  assert.Len(t, newServiceEvents(events, "3", at.Add(2 * time.Minute)), 0)
+
+  // The last event we saw has dropped out of the window, only newer ones are new.
+  dropped := newServiceEvents(events, "0", at.Add(30 * time.Second))
+  if assert.Len(t, dropped, 2) {
+    assert.Equal(t, "2", *dropped[0].Event.Id)
+  }
+  assert.Len(t, newServiceEvents(events, "0", time.Time{}), 3)
+}
+
+func TestServiceEventWatcherStop(t *testing.T) {
+  w := &ServiceEventWatcher{done: make(chan struct{})}
+  w.SetLastEventId("1")
+  assert.Equal(t, "1", w.LastEventId())
+  w.Stop()
+  assert.NotPanics(t, w.Stop)
+
+  // A second Start doesn't start another watcher to close Events again.
+  w = &ServiceEventWatcher{Interval: time.Hour, Events: make(chan ServiceEvent), done: make(chan struct{})}
+  w.Start()
+  w.Start()
+  w.Stop()
+  for range w.Events {}
+}
+
+func TestLoadServiceSpecs(t *testing.T) {
+  y := `
+services:
+  - name: web
+    cluster: production
+    taskDefinition: web
+    desiredCount: 2
+    healthCheckGracePeriodSeconds: 30
+    images:
+      web: repo/web:1.2.0
+    deployment:
+      minimumHealthyPercent: 50
+      maximumPercent: 200
+`
+  specs, err := LoadServiceSpecs(strings.NewReader(y))
+  if assert.NoError(t, err) && assert.Len(t, specs, 1) {
+    s := specs[0]
+    assert.Equal(t, "web", s.Name)
+    assert.Equal(t, int64(2), *s.DesiredCount)
+    assert.Equal(t, int64(30), s.HealthCheckGracePeriodSeconds)
+    assert.Equal(t, "repo/web:1.2.0", s.Images["web"])
+    assert.Equal(t, int64(50), s.Deployment.MinimumHealthyPercent)
+  }
+
+  _, err = LoadServiceSpecs(strings.NewReader("services:\n  - name: web\n    desiredCount: 1\n"))
+  assert.Error(t, err, "Expected an error for a missing taskDefinition.")
+
+  _, err = LoadServiceSpecs(strings.NewReader("services:\n  - name: web\n    taskDefinition: web\n    desiredcount: 1\n"))
+  assert.Error(t, err, "Expected an error for an unknown field.")
+}
+
+func TestPlanServiceActions(t *testing.T) {
+  td := func(arn, image string) (*ecs.TaskDefinition) {
+    return &ecs.TaskDefinition{
+      TaskDefinitionArn: aws.String(arn),
+      ContainerDefinitions: []*ecs.ContainerDefinition{{Name: aws.String("web"), Image: aws.String(image)}},
+    }
+  }
+  service := func(name, tdArn string, count int64) (*ecs.Service) {
+    return &ecs.Service{
+      ServiceName: aws.String(name),
+      Status: aws.String("ACTIVE"),
+      TaskDefinition: aws.String(tdArn),
+      DesiredCount: aws.Int64(count),
+    }
+  }
+  web3 := "arn:aws:ecs:us-east-1:123456789012:task-definition/web:3"
+  web4 := "arn:aws:ecs:us-east-1:123456789012:task-definition/web:4"
+
+  specs := ServiceSpecs{
+    {ServiceSpec: ServiceSpec{Name: "web", TaskDefinition: "web", DesiredCount: aws.Int64(3)}},
+    {ServiceSpec: ServiceSpec{Name: "same", TaskDefinition: "web:3", DesiredCount: aws.Int64(1)}},
+    {ServiceSpec: ServiceSpec{Name: "new", TaskDefinition: "web:3", DesiredCount: aws.Int64(1)}},
+    {ServiceSpec: ServiceSpec{Name: "elsewhere", Cluster: "other", TaskDefinition: "web:3", DesiredCount: aws.Int64(1)}},
+  }
+  services := []*ecs.Service{
+    service("web", web3, 2),
+    service("same", web3, 1),
+    service("old", web3, 1),
+  }
+  desiredTDs := map[string]*ecs.TaskDefinition{"web": td(web4, "web:4"), "same": td(web3, "web:3"), "new": td(web3, "web:3")}
+  currentTDs := map[string]*ecs.TaskDefinition{"web": td(web3, "web:3"), "same": td(web3, "web:3"), "old": td(web3, "web:3")}
+
+  actions := planServiceActions(specs, "test-cluster", true, services, desiredTDs, currentTDs)
+  if assert.Len(t, actions, 3) {
+    assert.Equal(t, UpdateServiceAction, actions[0].Type)
+    assert.Equal(t, []string{"taskDefinition: web:3 -> web:4", "desiredCount: 2 -> 3"}, actions[0].Changes)
+    assert.Equal(t, "test-cluster", actions[0].Desired.Cluster)
+    assert.Equal(t, CreateServiceAction, actions[1].Type)
+    assert.Equal(t, "new", actions[1].ServiceName())
+    assert.Equal(t, DeleteServiceAction, actions[2].Type)
+    assert.Equal(t, "old", actions[2].ServiceName())
+  }
+
+  // No deletes unless asked, or when the specs are all for other clusters.
+  actions = planServiceActions(specs, "test-cluster", false, services, desiredTDs, currentTDs)
+  assert.Len(t, actions, 2)
+  actions = planServiceActions(specs[3:], "test-cluster", true, services, desiredTDs, currentTDs)
+  assert.Len(t, actions, 0)
+
+  specs[1].Images = map[string]string{"web": "web:5"}
+  actions = planServiceActions(specs[1:2], "test-cluster", false, services[1:2], desiredTDs, currentTDs)
+  if assert.Len(t, actions, 1) {
+    assert.Equal(t, []string{"image web: web:3 -> web:5"}, actions[0].Changes)
+  }
+
+  specs[0].DesiredCount = nil
+  actions = planServiceActions(specs[:1], "test-cluster", false, services[:1], desiredTDs, currentTDs)
+  if assert.Len(t, actions, 1) {
+    assert.Equal(t, []string{"taskDefinition: web:3 -> web:4"}, actions[0].Changes)
+    assert.Nil(t, actions[0].Desired.UpdateServiceInput().DesiredCount)
+  }
+}
+
+func TestServiceDrained(t *testing.T) {
+  s := &ecs.Service{
+    RunningCount: aws.Int64(0),
+    PendingCount: aws.Int64(0),
+    Deployments: []*ecs.Deployment{
+      {RunningCount: aws.Int64(0), PendingCount: aws.Int64(0)},
+      {RunningCount: aws.Int64(1), PendingCount: aws.Int64(0)},
+    },
+  }
+  assert.False(t, serviceDrained(s), "A deployment still has a running task.")
+  s.Deployments = s.Deployments[:1]
+  assert.True(t, serviceDrained(s))
+  s.PendingCount = aws.Int64(1)
+  assert.False(t, serviceDrained(s), "The service has a pending task.")
+}
+
+func TestWaiterAttempts(t *testing.T) {
+  assert.Equal(t, 121, waiterAttempts(10 * time.Minute, 5 * time.Second))
+  assert.Equal(t, 1, waiterAttempts(2 * time.Second, 5 * time.Second))
+  assert.Equal(t, 1, waiterAttempts(-time.Second, 5 * time.Second), "Past the deadline still checks once.")
+}
+
+func TestBlueGreenSides(t *testing.T) {
+  bg := &BlueGreen{
+    Blue: BlueGreenSide{ServiceName: "web-blue", Endpoint: "blue.elb.amazonaws.com"},
+    Green: BlueGreenSide{ServiceName: "web-green", Endpoint: "green.elb.amazonaws.com"},
+  }
+  record := func(id string, w int64) (*route53.ResourceRecordSet) {
+    return &route53.ResourceRecordSet{SetIdentifier: aws.String(id), Weight: aws.Int64(w)}
+  }
+
+  active, idle, err := bg.sidesFromRecords(nil)
+  if assert.NoError(t, err) {
+    assert.Equal(t, "web-blue", active.ServiceName)
+    assert.Equal(t, "web-green", idle.ServiceName)
+  }
+
+  active, idle, err = bg.sidesFromRecords([]*route53.ResourceRecordSet{record("web-blue", 0), record("web-green", 100)})
+  if assert.NoError(t, err) {
+    assert.Equal(t, "web-green", active.ServiceName)
+    assert.Equal(t, "web-blue", idle.ServiceName)
+  }
+
+  _, _, err = bg.sidesFromRecords([]*route53.ResourceRecordSet{record("web-blue", 50), record("web-green", 50)})
+  assert.Error(t, err)
+}
+
+func TestServiceStatusHealth(t *testing.T) {
+  now := time.Now()
+  ago := func(d time.Duration) (*time.Time) { t := now.Add(-d); return &t }
+  service := func(name string, running, desired int64, deployments ...*ecs.Deployment) (*ecs.Service) {
+    return &ecs.Service{
+      ServiceName: aws.String(name),
+      Status: aws.String("ACTIVE"),
+      RunningCount: aws.Int64(running),
+      PendingCount: aws.Int64(0),
+      DesiredCount: aws.Int64(desired),
+      Deployments: deployments,
+    }
+  }
+  primary := func(updated time.Duration) (*ecs.Deployment) {
+    return &ecs.Deployment{Status: aws.String("PRIMARY"), UpdatedAt: ago(updated)}
+  }
+  active := &ecs.Deployment{Status: aws.String("ACTIVE"), UpdatedAt: ago(time.Hour)}
+
+  inactive := service("inactive", 0, 0)
+  inactive.Status = aws.String("INACTIVE")
+  unplaceable := service("unplaceable", 0, 2, primary(time.Minute))
+  unplaceable.Events = []*ecs.ServiceEvent{
+    {CreatedAt: ago(time.Minute), Message: aws.String("(service unplaceable) was unable to place a task because no container instance met all of its requirements.")},
+  }
+
+  tests := []struct{
+    s *ecs.Service
+    expected ServiceHealth
+  }{
+    {inactive, InactiveService},
+    {service("healthy", 2, 2, primary(time.Hour)), HealthyService},
+    {service("deploying", 2, 2, primary(time.Minute), active), DeployingService},
+    {service("scaling", 1, 2, primary(time.Minute)), DeployingService},
+    {service("degraded", 1, 2, primary(time.Hour)), DegradedService},
+    {service("stalled", 2, 2, primary(time.Hour), active), StalledService},
+    {unplaceable, StalledService},
+  }
+  for _, test := range tests {
+    st := newServiceStatusAt(test.s, now)
+    assert.Equal(t, test.expected, st.Health, "%s: %s", st.Name, st.Reason)
+  }
+  assert.Equal(t, time.Minute, newServiceStatusAt(unplaceable, now).LastEventAge)
+
+  ss := ServiceStatuses{newServiceStatusAt(tests[1].s, now), newServiceStatusAt(tests[5].s, now), newServiceStatusAt(tests[4].s, now)}
+  sort.Sort(BySeverity(ss))
+  assert.Equal(t, "stalled", ss[0].Name)
+  assert.Equal(t, "degraded", ss[1].Name)
+  assert.Equal(t, "healthy", ss[2].Name)
+}
+
+func TestServiceScalingInputs(t *testing.T) {
+  assert.Equal(t, "service/test-cluster/web", serviceResourceId("web", "test-cluster"))
+  clusterArn := "arn:aws:ecs:us-east-1:123456789012:cluster/test-cluster"
+  assert.Equal(t, "service/test-cluster/web",
+    serviceResourceId("arn:aws:ecs:us-east-1:123456789012:service/web", clusterArn))
+  assert.Equal(t, "service/test-cluster/web",
+    serviceResourceId("arn:aws:ecs:us-east-1:123456789012:service/test-cluster/web", clusterArn))
+
+  tt := targetTrackingPolicyInput("web", "test-cluster", "cpu75", MemoryScalingMetric, 75, 0, 30 * time.Second)
+  assert.Equal(t, "TargetTrackingScaling", *tt.PolicyType)
+  assert.Equal(t, "service/test-cluster/web", *tt.ResourceId)
+  assert.Equal(t, "ecs:service:DesiredCount", *tt.ScalableDimension)
+  config := tt.TargetTrackingScalingPolicyConfiguration
+  assert.Equal(t, 75.0, *config.TargetValue)
+  assert.Equal(t, "ECSServiceAverageMemoryUtilization", *config.PredefinedMetricSpecification.PredefinedMetricType)
+  assert.Nil(t, config.ScaleInCooldown, "0 leaves the default.")
+  assert.Equal(t, int64(30), *config.ScaleOutCooldown)
+
+  p := StepScalingPolicy{
+    PolicyName: "cpu-high",
+    Metric: CPUScalingMetric,
+    Threshold: 80,
+    ScaleOut: true,
+    Steps: []*applicationautoscaling.StepAdjustment{{MetricIntervalLowerBound: aws.Float64(0), ScalingAdjustment: aws.Int64(2)}},
+    Cooldown: 2 * time.Minute,
+  }
+  pi := p.policyInput("web", "test-cluster")
+  assert.Equal(t, "StepScaling", *pi.PolicyType)
+  assert.Equal(t, "ChangeInCapacity", *pi.StepScalingPolicyConfiguration.AdjustmentType)
+  assert.Equal(t, int64(120), *pi.StepScalingPolicyConfiguration.Cooldown)
+  assert.Len(t, pi.StepScalingPolicyConfiguration.StepAdjustments, 1)
+
+  ai := p.alarmInput("web", "test-cluster", "arn:policy")
+  assert.Equal(t, "test-cluster-web-cpu-high", *ai.AlarmName)
+  assert.Equal(t, stepScalingAlarmName("web", "test-cluster", "cpu-high"), *ai.AlarmName)
+  assert.Equal(t, []*string{aws.String("arn:policy")}, ai.AlarmActions)
+
+  ai = p.alarmInput("arn:aws:ecs:us-east-1:123456789012:service/web", "arn:aws:ecs:us-east-1:123456789012:cluster/test-cluster", "arn:policy")
+  assert.Equal(t, "test-cluster-web-cpu-high", *ai.AlarmName)
+  assert.Equal(t, "test-cluster", *ai.Dimensions[0].Value)
+  assert.Equal(t, "web", *ai.Dimensions[1].Value)
+  assert.Equal(t, "CPUUtilization", *ai.MetricName)
+  assert.Equal(t, "GreaterThanOrEqualToThreshold", *ai.ComparisonOperator)
+  assert.Equal(t, int64(1), *ai.EvaluationPeriods)
+  assert.Equal(t, int64(60), *ai.Period)
+  assert.Len(t, ai.Dimensions, 2)
+
+  p.ScaleOut = false
+  p.AdjustmentType = "PercentChangeInCapacity"
+  p.EvaluationPeriods, p.Period = 3, 5 * time.Minute
+  assert.Equal(t, "PercentChangeInCapacity", *p.policyInput("web", "test-cluster").StepScalingPolicyConfiguration.AdjustmentType)
+  ai = p.alarmInput("web", "test-cluster", "arn:policy")
+  assert.Equal(t, "LessThanOrEqualToThreshold", *ai.ComparisonOperator)
+  assert.Equal(t, int64(3), *ai.EvaluationPeriods)
+  assert.Equal(t, int64(300), *ai.Period)
+}
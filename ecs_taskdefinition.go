@@ -2,37 +2,139 @@ package awslib
 
 import(
   "io"
+  "sort"
+  "strconv"
   "strings"
   "github.com/aws/aws-sdk-go/aws"
   "github.com/aws/aws-sdk-go/aws/session"
   "github.com/aws/aws-sdk-go/service/ecs"
-  "github.com/aws/aws-sdk-go/private/protocol/json/jsonutil"
-  // "github.com/Sirupsen/logrus"
+  "github.com/Sirupsen/logrus"
 )
 
+const(
+  TaskDefinitionActive = "ACTIVE"
+  TaskDefinitionInactive = "INACTIVE"
+)
+
+// Zero values list everything ACTIVE, oldest revisions first.
+type TaskDefinitionFilter struct {
+  FamilyPrefix string
+  Status string      // ACTIVE or INACTIVE, defaults to ACTIVE.
+  Descending bool    // Newest revisions first.
+}
+
 // Lists ACTIVE families of Task Definitions, returning a colelctio of td arns.
 func ListTaskDefinitionFamilies(sess *session.Session) ([]*string, error) {
+  return ListTaskDefinitionFamiliesWithFilter(TaskDefinitionFilter{}, sess)
+}
+
+// Family names matching the filter, sorted by name.
+func ListTaskDefinitionFamiliesWithFilter(f TaskDefinitionFilter, sess *session.Session) ([]*string, error) {
   ecsSvc := ecs.New(sess)
   params := &ecs.ListTaskDefinitionFamiliesInput{
-    Status: aws.String("ACTIVE"),
+    Status: aws.String(f.status()),
   }
+  if f.FamilyPrefix != "" { params.FamilyPrefix = aws.String(f.FamilyPrefix) }
   results := make([]*string,0)
   err := ecsSvc.ListTaskDefinitionFamiliesPages(params,
     func(p *ecs.ListTaskDefinitionFamiliesOutput, lastPage bool) (bool) {
       results = append(results, p.Families...)
-      return lastPage
+      return true
   })
+  sort.Slice(results, func(i, j int) bool { return *results[i] < *results[j] })
   return results, err
 }
 
 // returns a collection of all registred task definition arns.
 func ListTaskDefinitions(sess *session.Session) ([]*string, error) {
+  return ListTaskDefinitionsWithFilter(TaskDefinitionFilter{}, sess)
+}
+
+// ECS sorts by family and then revision.
+// The ECS familyPrefix on this call only matches whole family names, so with
+// a prefix we find the families first and list each of them.
+func ListTaskDefinitionsWithFilter(f TaskDefinitionFilter, sess *session.Session) ([]*string, error) {
+  results := make([]*string, 0)
+  if f.FamilyPrefix == "" { return results, listTaskDefinitions(f, "", &results, sess) }
+
+  // A family with an ACTIVE revision can still have INACTIVE ones.
+  ff := f
+  if f.status() == TaskDefinitionInactive { ff.Status = "ALL" }
+  families, err := ListTaskDefinitionFamiliesWithFilter(ff, sess)
+  if err != nil { return results, err }
+  if f.Descending {
+    for i, j := 0, len(families) - 1; i < j; i, j = i + 1, j - 1 { families[i], families[j] = families[j], families[i] }
+  }
+  for _, family := range families {
+    if err = listTaskDefinitions(f, *family, &results, sess); err != nil { return results, err }
+  }
+  return results, err
+}
+
+// Appends the arns in family (all of them for "") to results.
+func listTaskDefinitions(f TaskDefinitionFilter, family string, results *[]*string, sess *session.Session) (error) {
   ecsSvc := ecs.New(sess)
   params := &ecs.ListTaskDefinitionsInput{
-    MaxResults: aws.Int64(100),
+    Status: aws.String(f.status()),
+    Sort: aws.String("ASC"),
   }
-  resp, err := ecsSvc.ListTaskDefinitions(params)
-  return resp.TaskDefinitionArns, err
+  if f.Descending { params.Sort = aws.String("DESC") }
+  if family != "" { params.FamilyPrefix = aws.String(family) }
+  return ecsSvc.ListTaskDefinitionsPages(params,
+    func(p *ecs.ListTaskDefinitionsOutput, lastPage bool) (bool) {
+      *results = append(*results, p.TaskDefinitionArns...)
+      return true
+  })
+}
+
+func (f TaskDefinitionFilter) status() (string) {
+  if f.Status == "" { return TaskDefinitionActive }
+  return f.Status
+}
+
+type TaskDefinitionRevision struct {
+  Arn string
+  Revision int64
+  Latest bool
+}
+
+type TaskDefinitionFamilyRevisions struct {
+  Family string
+  Revisions []TaskDefinitionRevision
+}
+
+// Task definitions grouped by family, families in name order and revisions
+// in the order asked for by the filter. Latest marks the highest revision listed in each family.
+func GetTaskDefinitionGroups(f TaskDefinitionFilter, sess *session.Session) ([]TaskDefinitionFamilyRevisions, error) {
+  arns, err := ListTaskDefinitionsWithFilter(f, sess)
+  if err != nil { return nil, err }
+  return GroupTaskDefinitions(arns, f.Descending), err
+}
+
+func GroupTaskDefinitions(arns []*string, descending bool) (groups []TaskDefinitionFamilyRevisions) {
+  byFamily := make(map[string][]TaskDefinitionRevision)
+  for _, arn := range arns {
+    family := TaskDefinitionFamily(arn)
+    byFamily[family] = append(byFamily[family], TaskDefinitionRevision{Arn: *arn, Revision: TaskDefinitionRevisionNumber(arn)})
+  }
+
+  families := make([]string, 0, len(byFamily))
+  for family, _ := range byFamily { families = append(families, family) }
+  sort.Strings(families)
+
+  groups = make([]TaskDefinitionFamilyRevisions, 0, len(families))
+  for _, family := range families {
+    revs := byFamily[family]
+    sort.Slice(revs, func(i, j int) bool {
+      if descending { return revs[i].Revision > revs[j].Revision }
+      return revs[i].Revision < revs[j].Revision
+    })
+    latest := 0
+    if !descending { latest = len(revs) - 1 }
+    revs[latest].Latest = true
+    groups = append(groups, TaskDefinitionFamilyRevisions{Family: family, Revisions: revs})
+  }
+  return groups
 }
 
 // func GetTaskDefinition(taskDefinitionArn string, ecs_svc *ecs.ECS) (*ecs.TaskDefinition, error) {
@@ -57,33 +159,88 @@ func GetContainerDefinition(containerName string, td *ecs.TaskDefinition) (cd *e
   return cd, ok
 }
 
-// TODO: This relies on an unsupported JSON unmarshalling interface in the aws go-sdk.
-// This could stop working.
+// The JSON is in the same shape as the ECS console/CLI JSON, see DecodeTaskDefinitionInput.
 func RegisterTaskDefinitionWithJSON(json io.Reader, sess *session.Session) (*ecs.RegisterTaskDefinitionOutput, error) {
-  var tdi ecs.RegisterTaskDefinitionInput
-  err := jsonutil.UnmarshalJSON(&tdi, json)
+  tdi, err := DecodeTaskDefinitionInput(json)
   if err != nil { return nil, err}
   log.Debug(nil, "RegisterTaskDefinition: Decoded JSON stream.")
 
   ecsSvc := ecs.New(sess)
-  resp, err := ecsSvc.RegisterTaskDefinition(&tdi)
+  resp, err := ecsSvc.RegisterTaskDefinition(tdi)
   if err == nil {
     log.Debug(nil, "RegisterTaskDefinition: Registered Task.")
   }
   return resp, err
 }
 
+func RegisterTaskDefinition(tdi *ecs.RegisterTaskDefinitionInput, sess *session.Session) (*ecs.TaskDefinition, error) {
+  ecsSvc := ecs.New(sess)
+  resp, err := ecsSvc.RegisterTaskDefinition(tdi)
+  if err != nil { return nil, err }
+  log.Debug(logrus.Fields{"taskDefinition": *resp.TaskDefinition.TaskDefinitionArn}, "RegisterTaskDefinition: Registered Task.")
+  return resp.TaskDefinition, err
+}
+
+// Deregistered revisions go INACTIVE. Running tasks and services using them carry on,
+// but no new tasks or services can be started with them.
+func DeregisterTaskDefinition(taskDefinitionArn string, sess *session.Session) (*ecs.TaskDefinition, error) {
+  ecsSvc := ecs.New(sess)
+  params := &ecs.DeregisterTaskDefinitionInput{
+    TaskDefinition: aws.String(taskDefinitionArn),
+  }
+  resp, err := ecsSvc.DeregisterTaskDefinition(params)
+  if err != nil { return nil, err }
+  return resp.TaskDefinition, err
+}
+
+// Returns the input that would register td again, e.g. as the
+// starting point for a new revision. The ContainerDefinitions are
+// copies so they can be changed without changing td.
+func TaskDefinitionToInput(td *ecs.TaskDefinition) (*ecs.RegisterTaskDefinitionInput) {
+  cds := make([]*ecs.ContainerDefinition, len(td.ContainerDefinitions))
+  for i, cd := range td.ContainerDefinitions {
+    c := *cd
+    cds[i] = &c
+  }
+  return &ecs.RegisterTaskDefinitionInput{
+    ContainerDefinitions: cds,
+    Cpu: td.Cpu,
+    EphemeralStorage: td.EphemeralStorage,
+    ExecutionRoleArn: td.ExecutionRoleArn,
+    Family: td.Family,
+    InferenceAccelerators: td.InferenceAccelerators,
+    IpcMode: td.IpcMode,
+    Memory: td.Memory,
+    NetworkMode: td.NetworkMode,
+    PidMode: td.PidMode,
+    PlacementConstraints: td.PlacementConstraints,
+    ProxyConfiguration: td.ProxyConfiguration,
+    RequiresCompatibilities: td.RequiresCompatibilities,
+    RuntimePlatform: td.RuntimePlatform,
+    TaskRoleArn: td.TaskRoleArn,
+    Volumes: td.Volumes,
+  }
+}
+
 // This parses a TaskDefinitionArn and returns just the Family portion.
 func TaskDefinitionFamily(taskDefinitionArn *string) (f string) {
   f = strings.Split(ShortArnString(taskDefinitionArn), ":")[0]
   return f
 }
 
+// This parses a TaskDefinitionArn and returns just the revision, 0 if there isn't one.
+func TaskDefinitionRevisionNumber(taskDefinitionArn *string) (r int64) {
+  parts := strings.Split(ShortArnString(taskDefinitionArn), ":")
+  if len(parts) < 2 { return 0 }
+  r, _ = strconv.ParseInt(parts[len(parts)-1], 10, 64)
+  return r
+}
+
 
 func DefaultTaskDefinition() (ecs.RegisterTaskDefinitionInput) {
     var tdi = ecs.RegisterTaskDefinitionInput{
     Family: aws.String("Family"),
-    // TaskRoleArn: This appears not to be in the golang definition.
+    // For roles, network modes, secrets, health checks and Fargate see NewTaskDefinition.
     ContainerDefinitions: []*ecs.ContainerDefinition{
       &ecs.ContainerDefinition{
 
@@ -171,7 +328,7 @@ func DefaultTaskDefinition() (ecs.RegisterTaskDefinitionInput) {
 func CompleteEmptyTaskDefinition() (ecs.RegisterTaskDefinitionInput) {
   var tdi = ecs.RegisterTaskDefinitionInput{
     Family: aws.String(""),
-    // TaskRoleArn: This appears not to be in the golang definition.
+    // For roles, network modes, secrets, health checks and Fargate see NewTaskDefinition.
     ContainerDefinitions: []*ecs.ContainerDefinition{
       &ecs.ContainerDefinition{
 
@@ -0,0 +1,305 @@
+package awslib
+
+import(
+  "fmt"
+  "strings"
+  "time"
+  "github.com/aws/aws-sdk-go/aws"
+  "github.com/aws/aws-sdk-go/aws/awsutil"
+  "github.com/aws/aws-sdk-go/aws/session"
+  "github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// Builds task definitions, e.g.:
+//
+//   tdi, err := NewTaskDefinition().
+//     WithFamily("web").
+//     WithExecutionRole(execRoleArn).
+//     WithContainer("web", "repo/web:1.0").
+//       WithPort(8080, 0).
+//       WithEnv("LEVEL", "info").
+//       WithSecret("DB_PASSWORD", "arn:aws:ssm:us-east-1:123456789012:parameter/db-password").
+//       WithHealthCheck("curl -f http://localhost:8080/health || exit 1", 30 * time.Second, 5 * time.Second, 3).
+//     WithContainer("proxy", "repo/proxy:1.0").
+//       WithDependsOn("web", "HEALTHY").
+//     Build()
+//
+// The container settings (WithPort, WithEnv etc.) apply to the last container added.
+// Mistakes are collected and returned by Build, so the calls can be chained.
+//
+// Defaults:
+//   - bridge networking, or awsvpc with WithFargate.
+//   - containers are essential.
+//   - ports are tcp; under awsvpc the host port is the container port.
+//   - containers with no memory, memoryReservation or task memory get DefaultContainerMemoryReservation.
+type TaskDefinitionBuilder struct {
+  tdi *ecs.RegisterTaskDefinitionInput
+  container *ecs.ContainerDefinition
+  errs []string
+}
+
+// MB
+const DefaultContainerMemoryReservation = 256
+
+func NewTaskDefinition() (*TaskDefinitionBuilder) {
+  return &TaskDefinitionBuilder{
+    tdi: &ecs.RegisterTaskDefinitionInput{NetworkMode: aws.String(ecs.NetworkModeBridge)},
+  }
+}
+
+func (b *TaskDefinitionBuilder) errorf(f string, args ...interface{}) (*TaskDefinitionBuilder) {
+  b.errs = append(b.errs, fmt.Sprintf(f, args...))
+  return b
+}
+
+//
+// Task settings
+//
+
+func (b *TaskDefinitionBuilder) WithFamily(family string) (*TaskDefinitionBuilder) {
+  b.tdi.Family = aws.String(family)
+  return b
+}
+
+// The role the containers get to make AWS calls.
+func (b *TaskDefinitionBuilder) WithTaskRole(roleArn string) (*TaskDefinitionBuilder) {
+  b.tdi.TaskRoleArn = aws.String(roleArn)
+  return b
+}
+
+// The role ECS uses to pull images, write awslogs and read secrets.
+func (b *TaskDefinitionBuilder) WithExecutionRole(roleArn string) (*TaskDefinitionBuilder) {
+  b.tdi.ExecutionRoleArn = aws.String(roleArn)
+  return b
+}
+
+// bridge, host, awsvpc or none.
+func (b *TaskDefinitionBuilder) WithNetworkMode(mode string) (*TaskDefinitionBuilder) {
+  switch mode {
+  case ecs.NetworkModeBridge, ecs.NetworkModeHost, ecs.NetworkModeAwsvpc, ecs.NetworkModeNone:
+    b.tdi.NetworkMode = aws.String(mode)
+  default:
+    b.errorf("unknown network mode %s", mode)
+  }
+  return b
+}
+
+// Task level cpu units and memory (MB), e.g. ("512", "1024").
+func (b *TaskDefinitionBuilder) WithTaskSize(cpu, memory string) (*TaskDefinitionBuilder) {
+  b.tdi.Cpu = aws.String(cpu)
+  b.tdi.Memory = aws.String(memory)
+  return b
+}
+
+// Runs on Fargate, which needs awsvpc networking and one of the Fargate sizes, e.g. ("256", "512").
+func (b *TaskDefinitionBuilder) WithFargate(cpu, memory string) (*TaskDefinitionBuilder) {
+  b.tdi.RequiresCompatibilities = aws.StringSlice([]string{ecs.CompatibilityFargate})
+  b.tdi.NetworkMode = aws.String(ecs.NetworkModeAwsvpc)
+  if !fargateSize(cpu, memory) { b.errorf("%s cpu and %s memory is not a Fargate size", cpu, memory) }
+  return b.WithTaskSize(cpu, memory)
+}
+
+// A volume for the containers to mount, on the host at hostPath or docker managed if hostPath is "".
+func (b *TaskDefinitionBuilder) WithVolume(name, hostPath string) (*TaskDefinitionBuilder) {
+  v := &ecs.Volume{Name: aws.String(name)}
+  if hostPath != "" { v.Host = &ecs.HostVolumeProperties{SourcePath: aws.String(hostPath)} }
+  b.tdi.Volumes = append(b.tdi.Volumes, v)
+  return b
+}
+
+//
+// Container settings
+//
+
+// Adds a container, the container settings that follow apply to it.
+func (b *TaskDefinitionBuilder) WithContainer(name, image string) (*TaskDefinitionBuilder) {
+  b.container = &ecs.ContainerDefinition{
+    Name: aws.String(name),
+    Image: aws.String(image),
+    Essential: aws.Bool(true),
+  }
+  b.tdi.ContainerDefinitions = append(b.tdi.ContainerDefinitions, b.container)
+  return b
+}
+
+// Applies set to the current container, or records the mistake if there isn't one.
+func (b *TaskDefinitionBuilder) withCurrent(setting string, set func(cd *ecs.ContainerDefinition)) (*TaskDefinitionBuilder) {
+  if b.container == nil { return b.errorf("%s before WithContainer", setting) }
+  set(b.container)
+  return b
+}
+
+// Hard limit in MB, the container is killed if it goes over.
+func (b *TaskDefinitionBuilder) WithMemory(mb int64) (*TaskDefinitionBuilder) {
+  return b.withCurrent("WithMemory", func(cd *ecs.ContainerDefinition) { cd.Memory = aws.Int64(mb) })
+}
+
+// Soft limit in MB, what gets reserved on the instance.
+func (b *TaskDefinitionBuilder) WithMemoryReservation(mb int64) (*TaskDefinitionBuilder) {
+  return b.withCurrent("WithMemoryReservation", func(cd *ecs.ContainerDefinition) { cd.MemoryReservation = aws.Int64(mb) })
+}
+
+// 1024 units per core.
+func (b *TaskDefinitionBuilder) WithCpu(units int64) (*TaskDefinitionBuilder) {
+  return b.withCurrent("WithCpu", func(cd *ecs.ContainerDefinition) { cd.Cpu = aws.Int64(units) })
+}
+
+func (b *TaskDefinitionBuilder) WithEssential(essential bool) (*TaskDefinitionBuilder) {
+  return b.withCurrent("WithEssential", func(cd *ecs.ContainerDefinition) { cd.Essential = aws.Bool(essential) })
+}
+
+func (b *TaskDefinitionBuilder) WithCommand(command ...string) (*TaskDefinitionBuilder) {
+  return b.withCurrent("WithCommand", func(cd *ecs.ContainerDefinition) { cd.Command = aws.StringSlice(command) })
+}
+
+func (b *TaskDefinitionBuilder) WithEntryPoint(entryPoint ...string) (*TaskDefinitionBuilder) {
+  return b.withCurrent("WithEntryPoint", func(cd *ecs.ContainerDefinition) { cd.EntryPoint = aws.StringSlice(entryPoint) })
+}
+
+// A tcp port, hostPort 0 for a dynamic port under bridge networking.
+func (b *TaskDefinitionBuilder) WithPort(containerPort, hostPort int64) (*TaskDefinitionBuilder) {
+  return b.WithPortMapping(&ecs.PortMapping{ContainerPort: aws.Int64(containerPort), HostPort: aws.Int64(hostPort)})
+}
+
+// For udp and anything else WithPort doesn't do.
+func (b *TaskDefinitionBuilder) WithPortMapping(pm *ecs.PortMapping) (*TaskDefinitionBuilder) {
+  return b.withCurrent("WithPortMapping", func(cd *ecs.ContainerDefinition) {
+    if pm.Protocol == nil { pm.Protocol = aws.String(ecs.TransportProtocolTcp) }
+    cd.PortMappings = append(cd.PortMappings, pm)
+  })
+}
+
+func (b *TaskDefinitionBuilder) WithEnv(name, value string) (*TaskDefinitionBuilder) {
+  return b.withCurrent("WithEnv", func(cd *ecs.ContainerDefinition) {
+    cd.Environment = append(cd.Environment, &ecs.KeyValuePair{Name: aws.String(name), Value: aws.String(value)})
+  })
+}
+
+// An environment variable read from SSM Parameter Store or Secrets Manager (valueFrom is the arn)
+// when the task starts. Needs an execution role that can read it.
+func (b *TaskDefinitionBuilder) WithSecret(name, valueFrom string) (*TaskDefinitionBuilder) {
+  return b.withCurrent("WithSecret", func(cd *ecs.ContainerDefinition) {
+    cd.Secrets = append(cd.Secrets, &ecs.Secret{Name: aws.String(name), ValueFrom: aws.String(valueFrom)})
+  })
+}
+
+// command is run with the container's shell (CMD-SHELL).
+func (b *TaskDefinitionBuilder) WithHealthCheck(command string, interval, timeout time.Duration, retries int64) (*TaskDefinitionBuilder) {
+  return b.withCurrent("WithHealthCheck", func(cd *ecs.ContainerDefinition) {
+    cd.HealthCheck = &ecs.HealthCheck{
+      Command: aws.StringSlice([]string{"CMD-SHELL", command}),
+      Interval: aws.Int64(int64(interval / time.Second)),
+      Timeout: aws.Int64(int64(timeout / time.Second)),
+      Retries: aws.Int64(retries),
+    }
+  })
+}
+
+// condition is START, COMPLETE, SUCCESS or HEALTHY.
+// containerName can be added after, Build checks it's there.
+func (b *TaskDefinitionBuilder) WithDependsOn(containerName, condition string) (*TaskDefinitionBuilder) {
+  switch condition {
+  case ecs.ContainerConditionStart, ecs.ContainerConditionComplete, ecs.ContainerConditionSuccess, ecs.ContainerConditionHealthy:
+  default:
+    return b.errorf("unknown dependsOn condition %s", condition)
+  }
+  return b.withCurrent("WithDependsOn", func(cd *ecs.ContainerDefinition) {
+    cd.DependsOn = append(cd.DependsOn, &ecs.ContainerDependency{ContainerName: aws.String(containerName), Condition: aws.String(condition)})
+  })
+}
+
+func (b *TaskDefinitionBuilder) WithMountPoint(volume, containerPath string, readOnly bool) (*TaskDefinitionBuilder) {
+  return b.withCurrent("WithMountPoint", func(cd *ecs.ContainerDefinition) {
+    cd.MountPoints = append(cd.MountPoints, &ecs.MountPoint{
+      SourceVolume: aws.String(volume),
+      ContainerPath: aws.String(containerPath),
+      ReadOnly: aws.Bool(readOnly),
+    })
+  })
+}
+
+func (b *TaskDefinitionBuilder) WithLogging(driver string, options map[string]string) (*TaskDefinitionBuilder) {
+  return b.withCurrent("WithLogging", func(cd *ecs.ContainerDefinition) {
+    cd.LogConfiguration = &ecs.LogConfiguration{LogDriver: aws.String(driver), Options: aws.StringMap(options)}
+  })
+}
+
+// Logs to CloudWatch group in region, with streams named prefix/container/task-id.
+func (b *TaskDefinitionBuilder) WithAWSLogs(group, region, prefix string) (*TaskDefinitionBuilder) {
+  return b.WithLogging(ecs.LogDriverAwslogs, map[string]string{
+    "awslogs-group": group,
+    "awslogs-region": region,
+    "awslogs-stream-prefix": prefix,
+  })
+}
+
+//
+// Building
+//
+
+// Fills in the defaults and checks the result, returning every mistake found.
+// The result is a copy, the builder can carry on (or Build again) without changing it.
+func (b *TaskDefinitionBuilder) Build() (tdi *ecs.RegisterTaskDefinitionInput, err error) {
+  tdi = awsutil.CopyOf(b.tdi).(*ecs.RegisterTaskDefinitionInput)
+  errs := append([]string{}, b.errs...)
+  if tdi.Family == nil || *tdi.Family == "" { errs = append(errs, "no family") }
+
+  containers := make(map[string]bool)
+  for _, cd := range tdi.ContainerDefinitions { containers[*cd.Name] = true }
+
+  awsvpc := *tdi.NetworkMode == ecs.NetworkModeAwsvpc
+  needsExecutionRole := false
+  for _, cd := range tdi.ContainerDefinitions {
+    if cd.Memory == nil && cd.MemoryReservation == nil && tdi.Memory == nil {
+      cd.MemoryReservation = aws.Int64(DefaultContainerMemoryReservation)
+    }
+    for _, pm := range cd.PortMappings {
+      if !awsvpc { continue }
+      if pm.HostPort == nil || *pm.HostPort == 0 {
+        pm.HostPort = pm.ContainerPort
+      } else if *pm.HostPort != *pm.ContainerPort {
+        errs = append(errs, fmt.Sprintf("container %s: host port %d must be the container port under awsvpc", *cd.Name, *pm.HostPort))
+      }
+    }
+    for _, d := range cd.DependsOn {
+      if !containers[*d.ContainerName] || *d.ContainerName == *cd.Name {
+        errs = append(errs, fmt.Sprintf("container %s: depends on unknown container %s", *cd.Name, *d.ContainerName))
+      }
+    }
+    if len(cd.Secrets) > 0 { needsExecutionRole = true }
+    if cd.LogConfiguration != nil && *cd.LogConfiguration.LogDriver == ecs.LogDriverAwslogs && len(tdi.RequiresCompatibilities) > 0 {
+      needsExecutionRole = true
+    }
+  }
+  if needsExecutionRole && tdi.ExecutionRoleArn == nil {
+    errs = append(errs, "secrets and awslogs on Fargate need an execution role")
+  }
+
+  for _, p := range lintTaskDefinition(tdi, 0, nil) { errs = append(errs, p.String()) }
+  if verr := tdi.Validate(); verr != nil { errs = append(errs, verr.Error()) }
+
+  if len(errs) > 0 { return tdi, fmt.Errorf("TaskDefinitionBuilder: %s", strings.Join(errs, "; ")) }
+  return tdi, nil
+}
+
+// Builds and registers the task definition.
+func (b *TaskDefinitionBuilder) Register(sess *session.Session) (*ecs.TaskDefinition, error) {
+  tdi, err := b.Build()
+  if err != nil { return nil, err }
+  return RegisterTaskDefinition(tdi, sess)
+}
+
+// cpu => memory (MB) Fargate allows.
+func fargateSize(cpu, memory string) (bool) {
+  var c, m int64
+  if _, err := fmt.Sscanf(cpu, "%d", &c); err != nil { return false }
+  if _, err := fmt.Sscanf(memory, "%d", &m); err != nil { return false }
+  switch c {
+  case 256: return m == 512 || m == 1024 || m == 2048
+  case 512: return m >= 1024 && m <= 4096 && m % 1024 == 0
+  case 1024: return m >= 2048 && m <= 8192 && m % 1024 == 0
+  case 2048: return m >= 4096 && m <= 16384 && m % 1024 == 0
+  case 4096: return m >= 8192 && m <= 30720 && m % 1024 == 0
+  }
+  return false
+}
@@ -0,0 +1,133 @@
+package awslib
+
+import(
+  "fmt"
+  "sort"
+  "strings"
+  "github.com/aws/aws-sdk-go/aws"
+  "github.com/aws/aws-sdk-go/aws/session"
+  "github.com/aws/aws-sdk-go/service/ecr"
+  "github.com/aws/aws-sdk-go/service/ecs"
+  "github.com/Sirupsen/logrus"
+)
+
+// Same task definition, new image.
+
+type BumpImageResult struct {
+  Previous *ecs.TaskDefinition
+  // The new revision, or Previous if the container already had the image.
+  TaskDefinition *ecs.TaskDefinition
+  Registered bool
+  PreviousImage string
+  Image string
+  UpdatedServices []*ecs.Service
+}
+
+// Registers a new revision of family's latest revision with containerName's image swapped for image.
+// An empty image means the most recently pushed image in the ECR repository the container already uses.
+// With updateServices, every service on any cluster running a revision of family
+// is updated to the new revision.
+// If the container already has the image nothing is registered or updated.
+func BumpImage(family, containerName, image string, updateServices bool, sess *session.Session) (r BumpImageResult, err error) {
+  r.Previous, err = GetTaskDefinition(family, sess)
+  if err != nil { return r, fmt.Errorf("BumpImage: can't get task definition %s: %s", family, err) }
+  r.TaskDefinition = r.Previous
+
+  cd, ok := GetContainerDefinition(containerName, r.Previous)
+  if !ok { return r, fmt.Errorf("BumpImage: no container %s in %s", containerName, ShortArnString(r.Previous.TaskDefinitionArn)) }
+  r.PreviousImage = stringPString(cd.Image)
+
+  r.Image = image
+  if r.Image == "" {
+    r.Image, err = LatestPushedImage(r.PreviousImage, sess)
+    if err != nil { return r, err }
+  }
+  if r.Image == r.PreviousImage { return r, err }
+
+  tdi := swapImage(TaskDefinitionToInput(r.Previous), containerName, r.Image)
+  r.TaskDefinition, err = RegisterTaskDefinition(tdi, sess)
+  if err != nil { return r, fmt.Errorf("BumpImage: failed to register %s: %s", family, err) }
+  r.Registered = true
+  log.Debug(logrus.Fields{"taskDefinition": *r.TaskDefinition.TaskDefinitionArn, "container": containerName,
+    "image": r.Image, "previousImage": r.PreviousImage}, "BumpImage: registered.")
+
+  if !updateServices { return r, err }
+  r.UpdatedServices, err = updateFamilyServices(family, *r.TaskDefinition.TaskDefinitionArn, sess)
+  return r, err
+}
+
+func swapImage(tdi *ecs.RegisterTaskDefinitionInput, containerName, image string) (*ecs.RegisterTaskDefinitionInput) {
+  for _, cd := range tdi.ContainerDefinitions {
+    if cd.Name != nil && *cd.Name == containerName { cd.Image = aws.String(image) }
+  }
+  return tdi
+}
+
+// Returns the most recently pushed image in the ECR repository of image, e.g.
+// 123456789012.dkr.ecr.us-east-1.amazonaws.com/web:1.0 => 123456789012.dkr.ecr.us-east-1.amazonaws.com/web:1.1
+// The image is referred to by a tag that stays put (not latest), or by digest,
+// so the task definition is pinned to it.
+func LatestPushedImage(image string, sess *session.Session) (latest string, err error) {
+  repoUri, ok := ecrRepositoryUri(image)
+  if !ok { return latest, fmt.Errorf("LatestPushedImage: %s is not an ECR image", image) }
+  repoName := repoUri[strings.Index(repoUri, "/")+1:]
+
+  ids, err := GetImages(repoName, sess)
+  if err != nil { return latest, fmt.Errorf("LatestPushedImage: can't get images for %s: %s", repoName, err) }
+  id := latestImage(ids)
+  if id == nil { return latest, fmt.Errorf("LatestPushedImage: no images in %s", repoName) }
+  return imageReference(repoUri, id), err
+}
+
+func latestImage(ids ImageDetailList) (*ecr.ImageDetail) {
+  pushed := make(ImageDetailList, 0, len(ids))
+  for _, id := range ids {
+    if id.ImagePushedAt != nil { pushed = append(pushed, id) }
+  }
+  if len(pushed) == 0 { return nil }
+  sort.Sort(sort.Reverse(ByPushedAt(pushed)))
+  return pushed[0]
+}
+
+// Tags that get moved from image to image.
+var floatingImageTags = map[string]bool{"latest": true}
+
+func imageReference(repoUri string, id *ecr.ImageDetail) (string) {
+  for _, tag := range id.ImageTags {
+    if tag != nil && !floatingImageTags[*tag] { return repoUri + ":" + *tag }
+  }
+  return repoUri + "@" + stringPString(id.ImageDigest)
+}
+
+// Updates the services on every cluster that run a revision of family to taskDefinitionArn.
+// DesiredCount is left alone, autoscaling may have changed it since we looked.
+func updateFamilyServices(family, taskDefinitionArn string, sess *session.Session) (updated []*ecs.Service, err error) {
+  clusters, err := GetClusters(sess)
+  if err != nil { return updated, fmt.Errorf("BumpImage: can't get clusters: %s", err) }
+
+  for _, cArn := range clusters {
+    clusterName := ShortArnString(cArn)
+    services, failures, err := DescribeServices(clusterName, sess)
+    if err != nil { return updated, fmt.Errorf("BumpImage: can't describe services on %s: %s", clusterName, err) }
+    if len(failures) > 0 { return updated, fmt.Errorf("Failed when obtaining service descriptions: %#v.", failures) }
+
+    ecsSvc := ecs.New(sess)
+    for _, s := range servicesUsingFamily(services, family) {
+      resp, err := ecsSvc.UpdateService(&ecs.UpdateServiceInput{
+        Service: s.ServiceName,
+        Cluster: aws.String(clusterName),
+        TaskDefinition: aws.String(taskDefinitionArn),
+      })
+      if err != nil { return updated, fmt.Errorf("BumpImage: failed to update service %s on %s: %s", *s.ServiceName, clusterName, err) }
+      updated = append(updated, resp.Service)
+    }
+  }
+  return updated, err
+}
+
+func servicesUsingFamily(services []*ecs.Service, family string) (using []*ecs.Service) {
+  for _, s := range services {
+    if s.TaskDefinition != nil && TaskDefinitionFamily(s.TaskDefinition) == family { using = append(using, s) }
+  }
+  return using
+}
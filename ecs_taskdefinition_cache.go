@@ -0,0 +1,214 @@
+package awslib
+
+import(
+  "bytes"
+  "container/list"
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+  "sync"
+  "github.com/aws/aws-sdk-go/aws/awsutil"
+  "github.com/aws/aws-sdk-go/aws/session"
+  "github.com/aws/aws-sdk-go/service/ecs"
+  "github.com/Sirupsen/logrus"
+)
+
+// Task definition revisions never change once registered, so they can be cached for good.
+// Only revisions (family:revision or a full arn) are cached, a bare family
+// is the latest revision and always goes to ECS.
+// Entries are keyed on the full arn, so one cache serves any number of accounts and regions,
+// and family:revision is resolved against the session's account and region.
+// Callers get their own copy of the task definition, to change as they like.
+// Safe for concurrent use. Two callers missing on the same revision at the same
+// time will both fetch it.
+type TaskDefinitionCache struct {
+  mu sync.Mutex
+  capacity int
+  // Most recently used at the front.
+  order *list.List
+  entries map[string]*list.Element
+  // Where Save writes the cache, "" for none.
+  path string
+  hits int64
+  misses int64
+  // Account numbers, by session, for resolving family:revision.
+  accounts map[*session.Session]string
+}
+
+type taskDefinitionCacheEntry struct {
+  key string
+  td *ecs.TaskDefinition
+}
+
+type TaskDefinitionCacheStats struct {
+  Hits int64
+  Misses int64
+  Size int
+  Capacity int
+}
+
+func (s TaskDefinitionCacheStats) HitRate() (float64) {
+  if s.Hits + s.Misses == 0 { return 0 }
+  return float64(s.Hits) / float64(s.Hits + s.Misses)
+}
+
+const DefaultTaskDefinitionCacheSize = 256
+
+// Used by GetDeepTasks, GetDeepTask and the other task definition lookups in this package.
+var SharedTaskDefinitionCache = NewTaskDefinitionCache(DefaultTaskDefinitionCacheSize)
+
+// Holds at most capacity task definitions, dropping the least recently used.
+func NewTaskDefinitionCache(capacity int) (*TaskDefinitionCache) {
+  if capacity < 1 { capacity = 1 }
+  return &TaskDefinitionCache{
+    capacity: capacity,
+    order: list.New(),
+    entries: make(map[string]*list.Element),
+    accounts: make(map[*session.Session]string),
+  }
+}
+
+// A cache that starts with whatever was last saved at path (if anything) and saves there with Save.
+func NewPersistentTaskDefinitionCache(capacity int, path string) (c *TaskDefinitionCache, err error) {
+  c = NewTaskDefinitionCache(capacity)
+  c.path = path
+  b, err := ioutil.ReadFile(path)
+  if os.IsNotExist(err) { return c, nil }
+  if err != nil { return c, fmt.Errorf("NewPersistentTaskDefinitionCache: can't read %s: %s", path, err) }
+
+  var saved []taskDefinitionCacheFileEntry
+  err = json.Unmarshal(b, &saved)
+  if err != nil { return c, fmt.Errorf("NewPersistentTaskDefinitionCache: bad cache file %s: %s", path, err) }
+  for _, e := range saved {
+    td, err := DecodeTaskDefinition(bytes.NewReader(e.TaskDefinition))
+    if err != nil { return c, fmt.Errorf("NewPersistentTaskDefinitionCache: bad entry %s in %s: %s", e.Key, path, err) }
+    c.add(e.Key, td)
+  }
+  return c, nil
+}
+
+type taskDefinitionCacheFileEntry struct {
+  Key string                      `json:"key"`
+  TaskDefinition json.RawMessage  `json:"taskDefinition"`
+}
+
+// Returns the task definition from the cache, or from ECS (caching it) if it isn't there.
+func (c *TaskDefinitionCache) Get(taskDefinitionArn string, sess *session.Session) (td *ecs.TaskDefinition, err error) {
+  cacheable := TaskDefinitionRevisionNumber(&taskDefinitionArn) > 0
+  if cacheable {
+    // If we can't work out the arn we just go without the cache.
+    if key, kerr := c.key(taskDefinitionArn, sess); kerr == nil {
+      if td, ok := c.lookup(key); ok { return copyTaskDefinition(td), nil }
+    }
+  }
+
+  td, err = GetTaskDefinition(taskDefinitionArn, sess)
+  if err != nil || !cacheable || td.TaskDefinitionArn == nil { return td, err }
+  c.mu.Lock()
+  c.add(*td.TaskDefinitionArn, td)
+  c.mu.Unlock()
+  return copyTaskDefinition(td), err
+}
+
+func copyTaskDefinition(td *ecs.TaskDefinition) (*ecs.TaskDefinition) {
+  return awsutil.CopyOf(td).(*ecs.TaskDefinition)
+}
+
+// The full arn for family:revision in the session's account and region.
+func (c *TaskDefinitionCache) key(taskDefinitionArn string, sess *session.Session) (key string, err error) {
+  if strings.HasPrefix(taskDefinitionArn, "arn:") { return taskDefinitionArn, err }
+  if sess == nil || sess.Config.Region == nil || *sess.Config.Region == "" {
+    return key, fmt.Errorf("TaskDefinitionCache: no region to resolve %s", taskDefinitionArn)
+  }
+  c.mu.Lock()
+  an, ok := c.accounts[sess]
+  c.mu.Unlock()
+  if !ok {
+    an, err = GetCurrentAccountNumber(sess)
+    if err != nil { return key, err }
+    c.mu.Lock()
+    c.accounts[sess] = an
+    c.mu.Unlock()
+  }
+  av := arnResourceMap[TaskDefinitionType]
+  return makeLong(av.servicePrefix, *sess.Config.Region, an, av.typeString, taskDefinitionArn), err
+}
+
+// Counts a hit or a miss.
+func (c *TaskDefinitionCache) lookup(key string) (td *ecs.TaskDefinition, ok bool) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  e, ok := c.entries[key]
+  if !ok {
+    c.misses++
+    return nil, false
+  }
+  c.hits++
+  c.order.MoveToFront(e)
+  return e.Value.(*taskDefinitionCacheEntry).td, true
+}
+
+// Callers hold c.mu (or own c).
+func (c *TaskDefinitionCache) add(key string, td *ecs.TaskDefinition) {
+  if e, ok := c.entries[key]; ok {
+    e.Value.(*taskDefinitionCacheEntry).td = td
+    c.order.MoveToFront(e)
+    return
+  }
+  c.entries[key] = c.order.PushFront(&taskDefinitionCacheEntry{key: key, td: td})
+  for c.order.Len() > c.capacity {
+    oldest := c.order.Back()
+    c.order.Remove(oldest)
+    delete(c.entries, oldest.Value.(*taskDefinitionCacheEntry).key)
+  }
+}
+
+func (c *TaskDefinitionCache) Stats() (TaskDefinitionCacheStats) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  return TaskDefinitionCacheStats{Hits: c.hits, Misses: c.misses, Size: c.order.Len(), Capacity: c.capacity}
+}
+
+// Empties the cache and zeros the stats.
+func (c *TaskDefinitionCache) Clear() {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  c.order.Init()
+  c.entries = make(map[string]*list.Element)
+  c.hits, c.misses = 0, 0
+  c.accounts = make(map[*session.Session]string)
+}
+
+// Writes the cache to its file, if it has one. Entries are written least recently
+// used first so that loading them back keeps the order.
+func (c *TaskDefinitionCache) Save() (err error) {
+  if c.path == "" { return nil }
+  c.mu.Lock()
+  saved := make([]taskDefinitionCacheFileEntry, 0, c.order.Len())
+  for e := c.order.Back(); e != nil; e = e.Prev() {
+    ce := e.Value.(*taskDefinitionCacheEntry)
+    var buf bytes.Buffer
+    if err = EncodeTaskDefinition(&buf, ce.td); err != nil { break }
+    saved = append(saved, taskDefinitionCacheFileEntry{Key: ce.key, TaskDefinition: buf.Bytes()})
+  }
+  c.mu.Unlock()
+  if err != nil { return fmt.Errorf("TaskDefinitionCache.Save: %s", err) }
+
+  b, err := json.Marshal(saved)
+  if err != nil { return fmt.Errorf("TaskDefinitionCache.Save: %s", err) }
+  // Write and rename so a failed save doesn't leave a broken cache behind.
+  tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path) + ".tmp")
+  if err != nil { return fmt.Errorf("TaskDefinitionCache.Save: %s", err) }
+  _, err = tmp.Write(b)
+  if cerr := tmp.Close(); err == nil { err = cerr }
+  if err == nil { err = os.Rename(tmp.Name(), c.path) }
+  if err != nil {
+    os.Remove(tmp.Name())
+    return fmt.Errorf("TaskDefinitionCache.Save: can't write %s: %s", c.path, err)
+  }
+  log.Debug(logrus.Fields{"path": c.path, "entries": len(saved)}, "TaskDefinitionCache: saved.")
+  return nil
+}
@@ -0,0 +1,635 @@
+package awslib
+
+import(
+  "fmt"
+  "io"
+  "io/ioutil"
+  "reflect"
+  "regexp"
+  "sort"
+  "strconv"
+  "strings"
+  "github.com/aws/aws-sdk-go/aws"
+  "github.com/aws/aws-sdk-go/service/ecs"
+  "gopkg.in/yaml.v2"
+)
+
+// Converting between docker-compose files and task definitions.
+// Each compose service is a container in one task definition:
+//
+//   compose                          task definition
+//   image, command, entrypoint       image, command, entryPoint
+//   environment                      environment
+//   ports                            portMappings (a bare container port gets a dynamic host port)
+//   volumes                          mountPoints and volumes (host paths become host volumes)
+//   volumes_from, links, depends_on  volumesFrom, links, dependsOn
+//   logging                          logConfiguration
+//   mem_limit, mem_reservation       memory, memoryReservation (MiB)
+//   cpu_shares                       cpu
+//   network_mode                     networkMode (of the task, so all services must agree)
+//
+// as well as hostname, working_dir, user, privileged, read_only, dns, dns_search,
+// extra_hosts, labels and ulimits.
+// Anything else is reported as a TaskDefinitionProblem, with the service name as the Container,
+// rather than being silently dropped.
+
+// Reads a compose file into a task definition for family.
+func ComposeToTaskDefinition(compose io.Reader, family string) (tdi *ecs.RegisterTaskDefinitionInput, problems []TaskDefinitionProblem, err error) {
+  b, err := ioutil.ReadAll(compose)
+  if err != nil { return nil, nil, err }
+  var raw interface{}
+  err = yaml.Unmarshal(b, &raw)
+  if err != nil { return nil, nil, fmt.Errorf("ComposeToTaskDefinition: bad YAML: %s", err) }
+  top, ok := jsonValue(raw).(map[string]interface{})
+  if !ok { return nil, nil, fmt.Errorf("ComposeToTaskDefinition: expected a mapping at the top level") }
+
+  c := &composeImporter{
+    tdi: &ecs.RegisterTaskDefinitionInput{Family: aws.String(family)},
+    hostVolumes: make(map[string]string),
+    volumes: make(map[string]bool),
+  }
+  services, ok := top["services"].(map[string]interface{})
+  if !ok { return nil, nil, fmt.Errorf("ComposeToTaskDefinition: no services, only version 2 and later compose files are supported") }
+
+  for _, k := range sortedKeys(top) {
+    switch k {
+    case "version", "services":
+    case "volumes":
+      vs, _ := top[k].(map[string]interface{})
+      for _, name := range sortedKeys(vs) {
+        if opts, ok := vs[name].(map[string]interface{}); vs[name] != nil && !(ok && len(opts) == 0) {
+          c.problem("", "options for volume %s are not supported", name)
+        }
+        c.addVolume(name, true, nil)
+      }
+    default:
+      c.problem("", "%s is not supported", k)
+    }
+  }
+
+  for _, name := range sortedKeys(services) {
+    svc, ok := services[name].(map[string]interface{})
+    if !ok {
+      c.problem(name, "service is not a mapping")
+      continue
+    }
+    c.tdi.ContainerDefinitions = append(c.tdi.ContainerDefinitions, c.container(name, svc))
+  }
+  return c.tdi, c.problems, err
+}
+
+type composeImporter struct {
+  tdi *ecs.RegisterTaskDefinitionInput
+  problems []TaskDefinitionProblem
+  // host path => volume name
+  hostVolumes map[string]string
+  // true for the volumes compose named, false for the names we made up.
+  volumes map[string]bool
+}
+
+func (c *composeImporter) problem(service, f string, args ...interface{}) {
+  c.problems = append(c.problems, TaskDefinitionProblem{Container: service, Message: fmt.Sprintf(f, args...)})
+}
+
+func (c *composeImporter) addVolume(name string, named bool, host *ecs.HostVolumeProperties) {
+  if _, ok := c.volumes[name]; ok { return }
+  c.volumes[name] = named
+  c.tdi.Volumes = append(c.tdi.Volumes, &ecs.Volume{Name: aws.String(name), Host: host})
+}
+
+// Made up names can collide, /var/data and /var-data are both var-data, so later ones get a suffix.
+func (c *composeImporter) unusedVolumeName(name string) (string) {
+  unused := name
+  for i := 2; ; i++ {
+    if _, ok := c.volumes[unused]; !ok { return unused }
+    unused = fmt.Sprintf("%s-%d", name, i)
+  }
+}
+
+func (c *composeImporter) container(name string, svc map[string]interface{}) (cd *ecs.ContainerDefinition) {
+  cd = &ecs.ContainerDefinition{Name: aws.String(name)}
+  bad := func(k string) { c.problem(name, "can't read %s: %v", k, svc[k]) }
+
+  for _, k := range sortedKeys(svc) {
+    v := svc[k]
+    switch k {
+    case "image":
+      cd.Image = aws.String(fmt.Sprintf("%v", v))
+    case "command", "entrypoint":
+      ss, ok := composeCommand(v)
+      if !ok { bad(k); continue }
+      if k == "command" { cd.Command = aws.StringSlice(ss) } else { cd.EntryPoint = aws.StringSlice(ss) }
+    case "environment":
+      env, ok := composeStringMap(v)
+      if !ok { bad(k); continue }
+      for _, n := range sortedStringKeys(env) {
+        if env[n] == nil {
+          c.problem(name, "environment %s has no value, values from the shell are not supported", n)
+          continue
+        }
+        cd.Environment = append(cd.Environment, &ecs.KeyValuePair{Name: aws.String(n), Value: env[n]})
+      }
+    case "ports":
+      ps, ok := v.([]interface{})
+      if !ok { bad(k); continue }
+      for _, p := range ps {
+        pm, err := composePortMapping(p)
+        if err != nil {
+          c.problem(name, "port %v: %s", p, err)
+          continue
+        }
+        cd.PortMappings = append(cd.PortMappings, pm)
+      }
+    case "volumes":
+      vs, ok := v.([]interface{})
+      if !ok { bad(k); continue }
+      for _, vol := range vs { c.mountPoint(name, cd, vol) }
+    case "volumes_from":
+      vs, ok := composeStrings(v)
+      if !ok { bad(k); continue }
+      for _, s := range vs {
+        parts := strings.Split(s, ":")
+        vf := &ecs.VolumeFrom{SourceContainer: aws.String(parts[0])}
+        if len(parts) > 1 { vf.ReadOnly = aws.Bool(parts[1] == "ro") }
+        cd.VolumesFrom = append(cd.VolumesFrom, vf)
+      }
+    case "links":
+      ls, ok := composeStrings(v)
+      if !ok { bad(k); continue }
+      cd.Links = aws.StringSlice(ls)
+    case "depends_on":
+      // The long form's conditions don't line up with ECS's, so only the list form.
+      ds, ok := composeStrings(v)
+      if !ok { bad(k); continue }
+      for _, d := range ds {
+        cd.DependsOn = append(cd.DependsOn, &ecs.ContainerDependency{ContainerName: aws.String(d), Condition: aws.String("START")})
+      }
+    case "logging":
+      l, ok := v.(map[string]interface{})
+      if !ok { bad(k); continue }
+      lc := &ecs.LogConfiguration{}
+      if d, ok := l["driver"]; ok { lc.LogDriver = aws.String(fmt.Sprintf("%v", d)) }
+      if opts, ok := composeStringMap(l["options"]); ok && len(opts) > 0 { lc.Options = opts }
+      cd.LogConfiguration = lc
+    case "mem_limit", "mem_reservation":
+      mb, err := composeMemory(v)
+      if err != nil {
+        c.problem(name, "%s: %s", k, err)
+        continue
+      }
+      if k == "mem_limit" { cd.Memory = aws.Int64(mb) } else { cd.MemoryReservation = aws.Int64(mb) }
+    case "cpu_shares":
+      i, err := strconv.ParseInt(fmt.Sprintf("%v", v), 10, 64)
+      if err != nil { bad(k); continue }
+      cd.Cpu = aws.Int64(i)
+    case "network_mode":
+      mode := fmt.Sprintf("%v", v)
+      switch {
+      case mode != "bridge" && mode != "host" && mode != "none":
+        c.problem(name, "network_mode %s is not supported", mode)
+      case c.tdi.NetworkMode != nil && *c.tdi.NetworkMode != mode:
+        c.problem(name, "network_mode %s conflicts with %s, task definitions have one network mode", mode, *c.tdi.NetworkMode)
+      default:
+        c.tdi.NetworkMode = aws.String(mode)
+      }
+    case "hostname":
+      cd.Hostname = aws.String(fmt.Sprintf("%v", v))
+    case "working_dir":
+      cd.WorkingDirectory = aws.String(fmt.Sprintf("%v", v))
+    case "user":
+      cd.User = aws.String(fmt.Sprintf("%v", v))
+    case "privileged", "read_only":
+      b, ok := v.(bool)
+      if !ok { bad(k); continue }
+      if k == "privileged" { cd.Privileged = aws.Bool(b) } else { cd.ReadonlyRootFilesystem = aws.Bool(b) }
+    case "dns", "dns_search":
+      ss, ok := composeStrings(v)
+      if !ok { bad(k); continue }
+      if k == "dns" { cd.DnsServers = aws.StringSlice(ss) } else { cd.DnsSearchDomains = aws.StringSlice(ss) }
+    case "extra_hosts":
+      hosts, ok := composeHostMap(v)
+      if !ok { bad(k); continue }
+      for _, h := range sortedStringKeys(hosts) {
+        cd.ExtraHosts = append(cd.ExtraHosts, &ecs.HostEntry{Hostname: aws.String(h), IpAddress: hosts[h]})
+      }
+    case "labels":
+      labels, ok := composeStringMap(v)
+      if !ok { bad(k); continue }
+      cd.DockerLabels = labels
+    case "ulimits":
+      ul, ok := v.(map[string]interface{})
+      if !ok { bad(k); continue }
+      for _, n := range sortedKeys(ul) {
+        u, err := composeUlimit(n, ul[n])
+        if err != nil {
+          c.problem(name, "ulimit %s: %s", n, err)
+          continue
+        }
+        cd.Ulimits = append(cd.Ulimits, u)
+      }
+    default:
+      c.problem(name, "%s is not supported", k)
+    }
+  }
+
+  if cd.Memory == nil && cd.MemoryReservation == nil {
+    c.problem(name, "no mem_limit or mem_reservation, ECS needs one of them")
+  }
+  return cd
+}
+
+// Short form: [source:]target[:ro|rw], long form: {type, source, target, read_only}.
+// Host paths become host volumes, anything else is a named volume, and a bare
+// target gets a volume of its own.
+func (c *composeImporter) mountPoint(service string, cd *ecs.ContainerDefinition, v interface{}) {
+  var source, target string
+  readOnly := false
+  switch vt := v.(type) {
+  case string:
+    parts := strings.Split(vt, ":")
+    switch len(parts) {
+    case 1:
+      target = parts[0]
+    case 2, 3:
+      source, target = parts[0], parts[1]
+      if len(parts) == 3 {
+        switch parts[2] {
+        case "ro": readOnly = true
+        case "rw":
+        default: c.problem(service, "volume %s: mode %s is not supported", vt, parts[2])
+        }
+      }
+    default:
+      c.problem(service, "can't read volume %s", vt)
+      return
+    }
+  case map[string]interface{}:
+    if t, ok := vt["type"]; ok && t != "bind" && t != "volume" {
+      c.problem(service, "volume type %v is not supported", t)
+      return
+    }
+    source = fmt.Sprintf("%v", vt["source"])
+    if vt["source"] == nil { source = "" }
+    target = fmt.Sprintf("%v", vt["target"])
+    readOnly, _ = vt["read_only"].(bool)
+  default:
+    c.problem(service, "can't read volume %v", v)
+    return
+  }
+
+  var name string
+  switch {
+  case source == "":
+    name = c.unusedVolumeName(composeVolumeName(service + target))
+    c.addVolume(name, false, nil)
+  case strings.HasPrefix(source, "/") || strings.HasPrefix(source, ".") || strings.HasPrefix(source, "~"):
+    if !strings.HasPrefix(source, "/") { c.problem(service, "volume %s: host paths have to be absolute on container instances", source) }
+    name = c.hostVolumes[source]
+    if name == "" {
+      name = c.unusedVolumeName(composeVolumeName(source))
+      c.hostVolumes[source] = name
+    }
+    c.addVolume(name, false, &ecs.HostVolumeProperties{SourcePath: aws.String(source)})
+  default:
+    name = source
+    if named, ok := c.volumes[name]; ok && !named {
+      c.problem(service, "volume %s has the same name as a host path or anonymous volume, declare it under volumes", name)
+    }
+    c.addVolume(name, true, nil)
+  }
+
+  mp := &ecs.MountPoint{SourceVolume: aws.String(name), ContainerPath: aws.String(target)}
+  if readOnly { mp.ReadOnly = aws.Bool(true) }
+  cd.MountPoints = append(cd.MountPoints, mp)
+}
+
+var composeVolumeNameRE = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// Volume names are letters, numbers, hyphens and underscores, e.g. /var/data => var-data
+func composeVolumeName(path string) (string) {
+  return strings.Trim(composeVolumeNameRE.ReplaceAllString(path, "-"), "-")
+}
+
+// [[ip:]host:]container[/protocol] or {target, published, protocol}.
+func composePortMapping(p interface{}) (pm *ecs.PortMapping, err error) {
+  var host, container, proto string
+  switch pt := p.(type) {
+  case map[string]interface{}:
+    container = fmt.Sprintf("%v", pt["target"])
+    if pt["published"] != nil { host = fmt.Sprintf("%v", pt["published"]) }
+    if pt["protocol"] != nil { proto = fmt.Sprintf("%v", pt["protocol"]) }
+  default:
+    s := fmt.Sprintf("%v", pt)
+    if i := strings.Index(s, "/"); i >= 0 { s, proto = s[:i], s[i+1:] }
+    parts := strings.Split(s, ":")
+    switch len(parts) {
+    case 1: container = parts[0]
+    case 2: host, container = parts[0], parts[1]
+    default: return nil, fmt.Errorf("binding to an address is not supported")
+    }
+  }
+  if strings.Contains(host + container, "-") { return nil, fmt.Errorf("port ranges are not supported") }
+
+  pm = &ecs.PortMapping{}
+  cp, err := strconv.ParseInt(container, 10, 64)
+  if err != nil { return nil, fmt.Errorf("bad container port %s", container) }
+  pm.ContainerPort = aws.Int64(cp)
+  if host != "" {
+    hp, err := strconv.ParseInt(host, 10, 64)
+    if err != nil { return nil, fmt.Errorf("bad host port %s", host) }
+    pm.HostPort = aws.Int64(hp)
+  }
+  if proto != "" { pm.Protocol = aws.String(proto) }
+  return pm, nil
+}
+
+// Returns MiB from bytes or a size like 512m or 1g.
+func composeMemory(v interface{}) (mb int64, err error) {
+  s := strings.ToLower(strings.TrimSpace(fmt.Sprintf("%v", v)))
+  s = strings.TrimSuffix(s, "b")
+  unit := int64(1)
+  if len(s) > 0 {
+    switch s[len(s)-1] {
+    case 'k': unit = 1 << 10
+    case 'm': unit = 1 << 20
+    case 'g': unit = 1 << 30
+    }
+    if unit > 1 { s = s[:len(s)-1] }
+  }
+  n, err := strconv.ParseInt(s, 10, 64)
+  if err != nil { return 0, fmt.Errorf("bad size %v", v) }
+  return n * unit / (1 << 20), nil
+}
+
+// name: limit or name: {soft, hard}
+func composeUlimit(name string, v interface{}) (u *ecs.Ulimit, err error) {
+  u = &ecs.Ulimit{Name: aws.String(name)}
+  var soft, hard string
+  if m, ok := v.(map[string]interface{}); ok {
+    soft, hard = fmt.Sprintf("%v", m["soft"]), fmt.Sprintf("%v", m["hard"])
+  } else {
+    soft = fmt.Sprintf("%v", v)
+    hard = soft
+  }
+  s, err := strconv.ParseInt(soft, 10, 64)
+  if err != nil { return nil, fmt.Errorf("bad soft limit %s", soft) }
+  h, err := strconv.ParseInt(hard, 10, 64)
+  if err != nil { return nil, fmt.Errorf("bad hard limit %s", hard) }
+  u.SoftLimit, u.HardLimit = aws.Int64(s), aws.Int64(h)
+  return u, nil
+}
+
+// A string (split on spaces) or a list.
+func composeCommand(v interface{}) ([]string, bool) {
+  if s, ok := v.(string); ok { return strings.Fields(s), true }
+  return composeStrings(v)
+}
+
+// A string or a list of them.
+func composeStrings(v interface{}) (ss []string, ok bool) {
+  switch vt := v.(type) {
+  case string:
+    return []string{vt}, true
+  case []interface{}:
+    for _, e := range vt { ss = append(ss, fmt.Sprintf("%v", e)) }
+    return ss, true
+  }
+  return nil, false
+}
+
+// A list of NAME=value or a mapping. A nil value means none was given.
+func composeStringMap(v interface{}) (m map[string]*string, ok bool) {
+  m = make(map[string]*string)
+  switch vt := v.(type) {
+  case map[string]interface{}:
+    for k, e := range vt {
+      if e == nil {
+        m[k] = nil
+      } else {
+        m[k] = aws.String(fmt.Sprintf("%v", e))
+      }
+    }
+    return m, true
+  case []interface{}:
+    for _, e := range vt {
+      kv := strings.SplitN(fmt.Sprintf("%v", e), "=", 2)
+      if len(kv) == 2 {
+        m[kv[0]] = aws.String(kv[1])
+      } else {
+        m[kv[0]] = nil
+      }
+    }
+    return m, true
+  }
+  return nil, false
+}
+
+// A list of host:ip or a mapping.
+func composeHostMap(v interface{}) (m map[string]*string, ok bool) {
+  if l, ok := v.([]interface{}); ok {
+    m = make(map[string]*string)
+    for _, e := range l {
+      hi := strings.SplitN(fmt.Sprintf("%v", e), ":", 2)
+      if len(hi) != 2 { return nil, false }
+      m[hi[0]] = aws.String(hi[1])
+    }
+    return m, true
+  }
+  return composeStringMap(v)
+}
+
+func sortedKeys(m map[string]interface{}) (keys []string) {
+  for k, _ := range m { keys = append(keys, k) }
+  sort.Strings(keys)
+  return keys
+}
+
+func sortedStringKeys(m map[string]*string) (keys []string) {
+  for k, _ := range m { keys = append(keys, k) }
+  sort.Strings(keys)
+  return keys
+}
+
+//
+// Export
+//
+
+// mem_limit, cpu_shares and volumes_from are v2 only, docker-compose rejects them in a v3 file.
+const composeExportVersion = "2.4"
+
+type composeFile struct {
+  Version string                          `yaml:"version"`
+  Services map[string]composeService      `yaml:"services"`
+  Volumes map[string]struct{}             `yaml:"volumes,omitempty"`
+}
+
+type composeService struct {
+  Image string                            `yaml:"image,omitempty"`
+  Command []string                        `yaml:"command,omitempty"`
+  Entrypoint []string                     `yaml:"entrypoint,omitempty"`
+  Environment map[string]string           `yaml:"environment,omitempty"`
+  Ports []string                          `yaml:"ports,omitempty"`
+  Volumes []string                        `yaml:"volumes,omitempty"`
+  VolumesFrom []string                    `yaml:"volumes_from,omitempty"`
+  Links []string                          `yaml:"links,omitempty"`
+  DependsOn []string                      `yaml:"depends_on,omitempty"`
+  Logging *composeLogging                 `yaml:"logging,omitempty"`
+  MemLimit string                         `yaml:"mem_limit,omitempty"`
+  MemReservation string                   `yaml:"mem_reservation,omitempty"`
+  CpuShares int64                         `yaml:"cpu_shares,omitempty"`
+  NetworkMode string                      `yaml:"network_mode,omitempty"`
+  Hostname string                         `yaml:"hostname,omitempty"`
+  WorkingDir string                       `yaml:"working_dir,omitempty"`
+  User string                             `yaml:"user,omitempty"`
+  Privileged bool                         `yaml:"privileged,omitempty"`
+  ReadOnly bool                           `yaml:"read_only,omitempty"`
+  Dns []string                            `yaml:"dns,omitempty"`
+  DnsSearch []string                      `yaml:"dns_search,omitempty"`
+  ExtraHosts []string                     `yaml:"extra_hosts,omitempty"`
+  Labels map[string]string                `yaml:"labels,omitempty"`
+  Ulimits map[string]composeUlimitLimits  `yaml:"ulimits,omitempty"`
+}
+
+type composeLogging struct {
+  Driver string                 `yaml:"driver,omitempty"`
+  Options map[string]string     `yaml:"options,omitempty"`
+}
+
+type composeUlimitLimits struct {
+  Soft int64  `yaml:"soft"`
+  Hard int64  `yaml:"hard"`
+}
+
+// Task definition and container fields that make it into the compose file.
+var composeTaskFields = map[string]bool{"family": true, "containerDefinitions": true, "volumes": true, "networkMode": true}
+var composeContainerFields = map[string]bool{
+  "name": true, "image": true, "command": true, "entryPoint": true, "environment": true,
+  "portMappings": true, "mountPoints": true, "volumesFrom": true, "links": true, "dependsOn": true,
+  "logConfiguration": true, "memory": true, "memoryReservation": true, "cpu": true,
+  "hostname": true, "workingDirectory": true, "user": true, "privileged": true,
+  "readonlyRootFilesystem": true, "dnsServers": true, "dnsSearchDomains": true,
+  "extraHosts": true, "dockerLabels": true, "ulimits": true, "essential": true,
+}
+
+// Writes the task definition as a docker-compose file, one service per container.
+func TaskDefinitionToCompose(tdi *ecs.RegisterTaskDefinitionInput, w io.Writer) (problems []TaskDefinitionProblem, err error) {
+  problem := func(container, f string, args ...interface{}) {
+    problems = append(problems, TaskDefinitionProblem{Container: container, Message: fmt.Sprintf(f, args...)})
+  }
+  problems = append(problems, unsupportedFields("", reflect.ValueOf(tdi).Elem(), composeTaskFields)...)
+
+  networkMode := ""
+  if tdi.NetworkMode != nil {
+    switch *tdi.NetworkMode {
+    case "bridge", "host", "none": networkMode = *tdi.NetworkMode
+    default: problem("", "networkMode %s is not supported", *tdi.NetworkMode)
+    }
+  }
+
+  cf := composeFile{Version: composeExportVersion, Services: make(map[string]composeService)}
+  volumes := make(map[string]*ecs.Volume)
+  for _, v := range tdi.Volumes {
+    if v.Name == nil { continue }
+    volumes[*v.Name] = v
+    if v.DockerVolumeConfiguration != nil || v.EfsVolumeConfiguration != nil || v.FsxWindowsFileServerVolumeConfiguration != nil {
+      problem("", "volume %s: only host and docker managed volumes are supported", *v.Name)
+    }
+  }
+
+  for _, cd := range tdi.ContainerDefinitions {
+    name := stringPString(cd.Name)
+    problems = append(problems, unsupportedFields(name, reflect.ValueOf(cd).Elem(), composeContainerFields)...)
+    if cd.Essential != nil && !*cd.Essential { problem(name, "non essential containers are not supported") }
+
+    s := composeService{
+      Image: stringPString(cd.Image),
+      Command: aws.StringValueSlice(cd.Command),
+      Entrypoint: aws.StringValueSlice(cd.EntryPoint),
+      Links: aws.StringValueSlice(cd.Links),
+      NetworkMode: networkMode,
+      Hostname: stringPString(cd.Hostname),
+      WorkingDir: stringPString(cd.WorkingDirectory),
+      User: stringPString(cd.User),
+      Privileged: aws.BoolValue(cd.Privileged),
+      ReadOnly: aws.BoolValue(cd.ReadonlyRootFilesystem),
+      Dns: aws.StringValueSlice(cd.DnsServers),
+      DnsSearch: aws.StringValueSlice(cd.DnsSearchDomains),
+      CpuShares: aws.Int64Value(cd.Cpu),
+    }
+    if len(cd.Environment) > 0 { s.Environment = keyValuesToMap(cd.Environment) }
+    if len(cd.DockerLabels) > 0 { s.Labels = aws.StringValueMap(cd.DockerLabels) }
+    if cd.Memory != nil { s.MemLimit = fmt.Sprintf("%dm", *cd.Memory) }
+    if cd.MemoryReservation != nil { s.MemReservation = fmt.Sprintf("%dm", *cd.MemoryReservation) }
+
+    for _, pm := range cd.PortMappings {
+      p := int64PDiffString(pm.ContainerPort)
+      if pm.HostPort != nil && *pm.HostPort != 0 { p = fmt.Sprintf("%d:%s", *pm.HostPort, p) }
+      if pm.Protocol != nil && *pm.Protocol != "tcp" { p += "/" + *pm.Protocol }
+      s.Ports = append(s.Ports, p)
+    }
+
+    for _, mp := range cd.MountPoints {
+      vName := stringPString(mp.SourceVolume)
+      source := vName
+      if v, ok := volumes[vName]; ok && v.Host != nil && v.Host.SourcePath != nil {
+        source = *v.Host.SourcePath
+      } else {
+        if cf.Volumes == nil { cf.Volumes = make(map[string]struct{}) }
+        cf.Volumes[vName] = struct{}{}
+      }
+      vol := source + ":" + stringPString(mp.ContainerPath)
+      if aws.BoolValue(mp.ReadOnly) { vol += ":ro" }
+      s.Volumes = append(s.Volumes, vol)
+    }
+
+    for _, vf := range cd.VolumesFrom {
+      f := stringPString(vf.SourceContainer)
+      if aws.BoolValue(vf.ReadOnly) { f += ":ro" }
+      s.VolumesFrom = append(s.VolumesFrom, f)
+    }
+
+    for _, d := range cd.DependsOn {
+      if d.Condition != nil && *d.Condition != "START" {
+        problem(name, "dependsOn %s: condition %s is not supported", stringPString(d.ContainerName), *d.Condition)
+      }
+      s.DependsOn = append(s.DependsOn, stringPString(d.ContainerName))
+    }
+
+    if lc := cd.LogConfiguration; lc != nil {
+      s.Logging = &composeLogging{Driver: stringPString(lc.LogDriver)}
+      if len(lc.Options) > 0 { s.Logging.Options = aws.StringValueMap(lc.Options) }
+      if len(lc.SecretOptions) > 0 { problem(name, "logConfiguration secretOptions are not supported") }
+    }
+
+    for _, h := range cd.ExtraHosts {
+      s.ExtraHosts = append(s.ExtraHosts, stringPString(h.Hostname) + ":" + stringPString(h.IpAddress))
+    }
+
+    if len(cd.Ulimits) > 0 { s.Ulimits = make(map[string]composeUlimitLimits) }
+    for _, u := range cd.Ulimits {
+      s.Ulimits[stringPString(u.Name)] = composeUlimitLimits{Soft: aws.Int64Value(u.SoftLimit), Hard: aws.Int64Value(u.HardLimit)}
+    }
+
+    cf.Services[name] = s
+  }
+
+  b, err := yaml.Marshal(cf)
+  if err != nil { return problems, err }
+  _, err = w.Write(b)
+  return problems, err
+}
+
+// Reports every field of v that is set but not in supported.
+func unsupportedFields(container string, v reflect.Value, supported map[string]bool) (problems []TaskDefinitionProblem) {
+  fields := jsonFieldIndex(v.Type())
+  names := make([]string, 0, len(fields))
+  for n, _ := range fields { names = append(names, n) }
+  sort.Strings(names)
+  for _, n := range names {
+    f := v.Field(fields[n])
+    if supported[n] || f.IsZero() { continue }
+    if (f.Kind() == reflect.Slice || f.Kind() == reflect.Map) && f.Len() == 0 { continue }
+    problems = append(problems, TaskDefinitionProblem{Container: container, Message: fmt.Sprintf("%s is not supported", n)})
+  }
+  return problems
+}
@@ -0,0 +1,257 @@
+package awslib
+
+import(
+  "encoding/json"
+  "fmt"
+  "sort"
+  "strings"
+  "github.com/aws/aws-sdk-go/aws/session"
+  "github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// What changed between two task definitions, e.g. family:12 and family:13.
+// Values are rendered as strings, with "" for not set.
+type TaskDefinitionDiff struct {
+  From string                     `json:"from"`
+  To string                       `json:"to"`
+  // Task level changes: role, network mode, cpu, memory, volumes.
+  Changes []FieldChange           `json:"changes,omitempty"`
+  Containers []ContainerDiff      `json:"containers,omitempty"`
+}
+
+type FieldChange struct {
+  Field string  `json:"field"`
+  From string   `json:"from"`
+  To string     `json:"to"`
+}
+
+const(
+  DiffAdded = "added"
+  DiffRemoved = "removed"
+  DiffChanged = "changed"
+)
+
+type ContainerDiff struct {
+  Name string                   `json:"name"`
+  // DiffAdded, DiffRemoved or DiffChanged.
+  Change string                 `json:"change"`
+  Changes []FieldChange         `json:"changes,omitempty"`
+  Environment []EnvChange       `json:"environment,omitempty"`
+}
+
+type EnvChange struct {
+  Name string     `json:"name"`
+  Change string   `json:"change"`
+  From string     `json:"from,omitempty"`
+  To string       `json:"to,omitempty"`
+}
+
+func (d TaskDefinitionDiff) Empty() (bool) {
+  return len(d.Changes) == 0 && len(d.Containers) == 0
+}
+
+func DiffTaskDefinitions(a, b *ecs.TaskDefinition) (d TaskDefinitionDiff) {
+  d.From = ShortArnString(a.TaskDefinitionArn)
+  d.To = ShortArnString(b.TaskDefinitionArn)
+
+  d.Changes = diffFields(d.Changes, "taskRoleArn", stringPString(a.TaskRoleArn), stringPString(b.TaskRoleArn))
+  d.Changes = diffFields(d.Changes, "executionRoleArn", stringPString(a.ExecutionRoleArn), stringPString(b.ExecutionRoleArn))
+  d.Changes = diffFields(d.Changes, "networkMode", stringPString(a.NetworkMode), stringPString(b.NetworkMode))
+  d.Changes = diffFields(d.Changes, "cpu", stringPString(a.Cpu), stringPString(b.Cpu))
+  d.Changes = diffFields(d.Changes, "memory", stringPString(a.Memory), stringPString(b.Memory))
+  d.Changes = diffFields(d.Changes, "volumes", volumesString(a.Volumes), volumesString(b.Volumes))
+
+  aCDs := containerDefinitionMap(a.ContainerDefinitions)
+  bCDs := containerDefinitionMap(b.ContainerDefinitions)
+  for _, name := range containerNames(a.ContainerDefinitions, b.ContainerDefinitions) {
+    aCD, aOk := aCDs[name]
+    bCD, bOk := bCDs[name]
+    switch {
+    case !aOk:
+      d.Containers = append(d.Containers, ContainerDiff{Name: name, Change: DiffAdded})
+    case !bOk:
+      d.Containers = append(d.Containers, ContainerDiff{Name: name, Change: DiffRemoved})
+    default:
+      cd := diffContainerDefinitions(aCD, bCD)
+      if len(cd.Changes) > 0 || len(cd.Environment) > 0 {
+        d.Containers = append(d.Containers, cd)
+      }
+    }
+  }
+  return d
+}
+
+func diffContainerDefinitions(a, b *ecs.ContainerDefinition) (cd ContainerDiff) {
+  cd.Name = *a.Name
+  cd.Change = DiffChanged
+  cd.Changes = diffFields(cd.Changes, "image", stringPString(a.Image), stringPString(b.Image))
+  cd.Changes = diffFields(cd.Changes, "cpu", int64PDiffString(a.Cpu), int64PDiffString(b.Cpu))
+  cd.Changes = diffFields(cd.Changes, "memory", int64PDiffString(a.Memory), int64PDiffString(b.Memory))
+  cd.Changes = diffFields(cd.Changes, "memoryReservation", int64PDiffString(a.MemoryReservation), int64PDiffString(b.MemoryReservation))
+  cd.Changes = diffFields(cd.Changes, "portMappings", portMappingsString(a.PortMappings), portMappingsString(b.PortMappings))
+  cd.Changes = diffFields(cd.Changes, "mountPoints", mountPointsString(a.MountPoints), mountPointsString(b.MountPoints))
+  cd.Changes = diffFields(cd.Changes, "logConfiguration", logConfigurationString(a.LogConfiguration), logConfigurationString(b.LogConfiguration))
+
+  aEnv := keyValuesToMap(a.Environment)
+  bEnv := keyValuesToMap(b.Environment)
+  names := make([]string, 0, len(aEnv) + len(bEnv))
+  for n, _ := range aEnv { names = append(names, n) }
+  for n, _ := range bEnv {
+    if _, ok := aEnv[n]; !ok { names = append(names, n) }
+  }
+  sort.Strings(names)
+  for _, n := range names {
+    aV, aOk := aEnv[n]
+    bV, bOk := bEnv[n]
+    switch {
+    case !aOk:
+      cd.Environment = append(cd.Environment, EnvChange{Name: n, Change: DiffAdded, To: bV})
+    case !bOk:
+      cd.Environment = append(cd.Environment, EnvChange{Name: n, Change: DiffRemoved, From: aV})
+    case aV != bV:
+      cd.Environment = append(cd.Environment, EnvChange{Name: n, Change: DiffChanged, From: aV, To: bV})
+    }
+  }
+  return cd
+}
+
+func diffFields(changes []FieldChange, field, from, to string) ([]FieldChange) {
+  if from != to {
+    changes = append(changes, FieldChange{Field: field, From: from, To: to})
+  }
+  return changes
+}
+
+func containerDefinitionMap(cds []*ecs.ContainerDefinition) (map[string]*ecs.ContainerDefinition) {
+  m := make(map[string]*ecs.ContainerDefinition, len(cds))
+  for _, cd := range cds { m[*cd.Name] = cd }
+  return m
+}
+
+// Container names in a's order followed by any new ones in b.
+func containerNames(a, b []*ecs.ContainerDefinition) (names []string) {
+  seen := make(map[string]bool)
+  for _, cds := range [][]*ecs.ContainerDefinition{a, b} {
+    for _, cd := range cds {
+      if !seen[*cd.Name] {
+        seen[*cd.Name] = true
+        names = append(names, *cd.Name)
+      }
+    }
+  }
+  return names
+}
+
+func stringPString(s *string) (string) {
+  if s == nil { return "" }
+  return *s
+}
+
+// Unlike int64PString, not set is "" here, as the diff and compose output want.
+func int64PDiffString(i *int64) (string) {
+  if i == nil { return "" }
+  return fmt.Sprintf("%d", *i)
+}
+
+// e.g. "8080->80/tcp, 0->443/tcp"
+func portMappingsString(pms []*ecs.PortMapping) (string) {
+  ps := make([]string, 0, len(pms))
+  for _, pm := range pms {
+    proto := "tcp"
+    if pm.Protocol != nil { proto = *pm.Protocol }
+    ps = append(ps, fmt.Sprintf("%s->%s/%s", int64PDiffString(pm.HostPort), int64PDiffString(pm.ContainerPort), proto))
+  }
+  sort.Strings(ps)
+  return strings.Join(ps, ", ")
+}
+
+// e.g. "data:/var/data(ro)"
+func mountPointsString(mps []*ecs.MountPoint) (string) {
+  ms := make([]string, 0, len(mps))
+  for _, mp := range mps {
+    m := fmt.Sprintf("%s:%s", stringPString(mp.SourceVolume), stringPString(mp.ContainerPath))
+    if mp.ReadOnly != nil && *mp.ReadOnly { m += "(ro)" }
+    ms = append(ms, m)
+  }
+  sort.Strings(ms)
+  return strings.Join(ms, ", ")
+}
+
+// e.g. "awslogs awslogs-group=web awslogs-region=us-east-1"
+func logConfigurationString(lc *ecs.LogConfiguration) (string) {
+  if lc == nil { return "" }
+  opts := make([]string, 0, len(lc.Options))
+  for k, v := range lc.Options { opts = append(opts, k + "=" + stringPString(v)) }
+  sort.Strings(opts)
+  return strings.TrimSpace(stringPString(lc.LogDriver) + " " + strings.Join(opts, " "))
+}
+
+// e.g. "data=/opt/data, scratch"
+func volumesString(vs []*ecs.Volume) (string) {
+  ss := make([]string, 0, len(vs))
+  for _, v := range vs {
+    s := stringPString(v.Name)
+    if v.Host != nil && v.Host.SourcePath != nil { s += "=" + *v.Host.SourcePath }
+    ss = append(ss, s)
+  }
+  sort.Strings(ss)
+  return strings.Join(ss, ", ")
+}
+
+func (d TaskDefinitionDiff) JSON() ([]byte, error) {
+  return json.MarshalIndent(d, "", "  ")
+}
+
+// Renders the diff as text, e.g.:
+// web:12 -> web:13
+//   memory: 512 -> 1024
+//   container web changed:
+//     image: repo/web:1.0 -> repo/web:1.1
+//     env + NEW_FLAG=true
+func (d TaskDefinitionDiff) String() (string) {
+  s := fmt.Sprintf("%s -> %s\n", d.From, d.To)
+  if d.Empty() { return s + "  no changes\n" }
+  for _, c := range d.Changes {
+    s += fmt.Sprintf("  %s\n", fieldChangeString(c))
+  }
+  for _, cd := range d.Containers {
+    s += fmt.Sprintf("  container %s %s", cd.Name, cd.Change)
+    if cd.Change != DiffChanged {
+      s += "\n"
+      continue
+    }
+    s += ":\n"
+    for _, c := range cd.Changes {
+      s += fmt.Sprintf("    %s\n", fieldChangeString(c))
+    }
+    for _, e := range cd.Environment {
+      switch e.Change {
+      case DiffAdded: s += fmt.Sprintf("    env + %s=%s\n", e.Name, e.To)
+      case DiffRemoved: s += fmt.Sprintf("    env - %s=%s\n", e.Name, e.From)
+      case DiffChanged: s += fmt.Sprintf("    env ~ %s: %s -> %s\n", e.Name, e.From, e.To)
+      }
+    }
+  }
+  return s
+}
+
+func fieldChangeString(c FieldChange) (string) {
+  from, to := c.From, c.To
+  if from == "" { from = "--" }
+  if to == "" { to = "--" }
+  return fmt.Sprintf("%s: %s -> %s", c.Field, from, to)
+}
+
+// Diffs the task definition the service is running against candidateArn.
+func DiffServiceTaskDefinition(serviceName, clusterName, candidateArn string, sess *session.Session) (d TaskDefinitionDiff, err error) {
+  s, failures, err := DescribeService(serviceName, clusterName, sess)
+  if err != nil { return d, err }
+  if len(failures) > 0 { return d, fmt.Errorf("Failed when obtaining service description: %#v.", failures) }
+
+  running, err := SharedTaskDefinitionCache.Get(*s.TaskDefinition, sess)
+  if err != nil { return d, err }
+  candidate, err := SharedTaskDefinitionCache.Get(candidateArn, sess)
+  if err != nil { return d, err }
+
+  return DiffTaskDefinitions(running, candidate), err
+}
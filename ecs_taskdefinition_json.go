@@ -0,0 +1,360 @@
+package awslib
+
+import(
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "reflect"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+  "github.com/aws/aws-sdk-go/aws/session"
+  "github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// Task definition JSON in the same shape as the ECS console and CLI (camelCase keys).
+// Keys come from the locationName tags on the SDK structs, so new fields in the SDK
+// are picked up without changes here. Decoding is strict: unknown fields and values of
+// the wrong type are errors that report the line and column of the problem.
+// Timestamps are written as epoch seconds, and read as epoch seconds or RFC3339.
+
+type TaskDefinitionJSONError struct {
+  Line int
+  Column int
+  // Where in the document, e.g. containerDefinitions[0].portMappings[1].hostPort
+  Path string
+  Message string
+}
+
+func (e *TaskDefinitionJSONError) Error() (string) {
+  if e.Path == "" { return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Message) }
+  return fmt.Sprintf("line %d, column %d: %s: %s", e.Line, e.Column, e.Path, e.Message)
+}
+
+func DecodeTaskDefinitionInput(r io.Reader) (tdi *ecs.RegisterTaskDefinitionInput, err error) {
+  tdi = new(ecs.RegisterTaskDefinitionInput)
+  err = decodeAWSJSON(r, tdi)
+  if err != nil { return nil, err }
+  return tdi, err
+}
+
+func DecodeTaskDefinition(r io.Reader) (td *ecs.TaskDefinition, err error) {
+  td = new(ecs.TaskDefinition)
+  err = decodeAWSJSON(r, td)
+  if err != nil { return nil, err }
+  return td, err
+}
+
+// Writes indented JSON.
+func EncodeTaskDefinitionInput(w io.Writer, tdi *ecs.RegisterTaskDefinitionInput) (error) {
+  return encodeAWSJSON(w, tdi)
+}
+
+func EncodeTaskDefinition(w io.Writer, td *ecs.TaskDefinition) (error) {
+  return encodeAWSJSON(w, td)
+}
+
+// Writes the revision as input JSON that will register it again,
+// leaving out what ECS fills in (arn, revision, status etc.).
+func ExportTaskDefinition(taskDefinitionArn string, w io.Writer, sess *session.Session) (error) {
+  td, err := SharedTaskDefinitionCache.Get(taskDefinitionArn, sess)
+  if err != nil { return err }
+  return EncodeTaskDefinitionInput(w, TaskDefinitionToInput(td))
+}
+
+//
+// Decoding
+//
+
+type awsJSONDecoder struct {
+  data []byte
+  dec *json.Decoder
+}
+
+func decodeAWSJSON(r io.Reader, v interface{}) (err error) {
+  data, err := ioutil.ReadAll(r)
+  if err != nil { return err }
+  d := &awsJSONDecoder{data: data, dec: json.NewDecoder(bytes.NewReader(data))}
+  d.dec.UseNumber()
+
+  err = d.decodeValue(reflect.ValueOf(v).Elem(), "")
+  if err != nil { return err }
+  if _, err = d.dec.Token(); err != io.EOF {
+    return d.errorf("", "unexpected data after the task definition")
+  }
+  return nil
+}
+
+// Error at the decoder's current position.
+func (d *awsJSONDecoder) errorf(path, f string, args ...interface{}) (error) {
+  offset := int(d.dec.InputOffset())
+  if offset > len(d.data) { offset = len(d.data) }
+  line := 1 + bytes.Count(d.data[:offset], []byte("\n"))
+  col := offset - bytes.LastIndex(d.data[:offset], []byte("\n"))
+  return &TaskDefinitionJSONError{Line: line, Column: col, Path: path, Message: fmt.Sprintf(f, args...)}
+}
+
+func (d *awsJSONDecoder) token(path string) (json.Token, error) {
+  t, err := d.dec.Token()
+  if err == io.EOF { return nil, d.errorf(path, "unexpected end of input") }
+  if err != nil { return nil, d.errorf(path, "%s", err) }
+  return t, nil
+}
+
+func (d *awsJSONDecoder) expectDelim(path string, want json.Delim, what string) (error) {
+  t, err := d.token(path)
+  if err != nil { return err }
+  if delim, ok := t.(json.Delim); !ok || delim != want {
+    return d.errorf(path, "expected %s, got %s", what, tokenString(t))
+  }
+  return nil
+}
+
+func (d *awsJSONDecoder) decodeValue(v reflect.Value, path string) (error) {
+  // null leaves pointers, slices and maps nil.
+  if d.nextIsNull() {
+    _, err := d.token(path)
+    return err
+  }
+
+  switch v.Kind() {
+  case reflect.Ptr:
+    if v.Type() == reflect.TypeOf(&time.Time{}) { return d.decodeTime(v, path) }
+    n := reflect.New(v.Type().Elem())
+    if err := d.decodeValue(n.Elem(), path); err != nil { return err }
+    v.Set(n)
+    return nil
+  case reflect.Struct:
+    return d.decodeStruct(v, path)
+  case reflect.Slice:
+    return d.decodeSlice(v, path)
+  case reflect.Map:
+    return d.decodeMap(v, path)
+  }
+  return d.decodeScalar(v, path)
+}
+
+func (d *awsJSONDecoder) nextIsNull() (bool) {
+  rest := bytes.TrimLeft(d.data[d.dec.InputOffset():], " \t\r\n,:")
+  return bytes.HasPrefix(rest, []byte("null"))
+}
+
+func (d *awsJSONDecoder) decodeStruct(v reflect.Value, path string) (error) {
+  if err := d.expectDelim(path, '{', "an object"); err != nil { return err }
+  fields := jsonFieldIndex(v.Type())
+  for d.dec.More() {
+    t, err := d.token(path)
+    if err != nil { return err }
+    key := t.(string)
+    fieldPath := joinJSONPath(path, key)
+    i, ok := fields[key]
+    if !ok {
+      return d.errorf(fieldPath, "unknown field %q in %s", key, v.Type().Name())
+    }
+    if err := d.decodeValue(v.Field(i), fieldPath); err != nil { return err }
+  }
+  _, err := d.token(path)
+  return err
+}
+
+func (d *awsJSONDecoder) decodeSlice(v reflect.Value, path string) (error) {
+  if err := d.expectDelim(path, '[', "an array"); err != nil { return err }
+  s := reflect.MakeSlice(v.Type(), 0, 0)
+  for i := 0; d.dec.More(); i++ {
+    e := reflect.New(v.Type().Elem()).Elem()
+    if err := d.decodeValue(e, fmt.Sprintf("%s[%d]", path, i)); err != nil { return err }
+    s = reflect.Append(s, e)
+  }
+  v.Set(s)
+  _, err := d.token(path)
+  return err
+}
+
+func (d *awsJSONDecoder) decodeMap(v reflect.Value, path string) (error) {
+  if err := d.expectDelim(path, '{', "an object"); err != nil { return err }
+  m := reflect.MakeMap(v.Type())
+  for d.dec.More() {
+    t, err := d.token(path)
+    if err != nil { return err }
+    key := t.(string)
+    e := reflect.New(v.Type().Elem()).Elem()
+    if err := d.decodeValue(e, joinJSONPath(path, key)); err != nil { return err }
+    m.SetMapIndex(reflect.ValueOf(key), e)
+  }
+  v.Set(m)
+  _, err := d.token(path)
+  return err
+}
+
+func (d *awsJSONDecoder) decodeScalar(v reflect.Value, path string) (error) {
+  t, err := d.token(path)
+  if err != nil { return err }
+  switch v.Kind() {
+  case reflect.String:
+    if s, ok := t.(string); ok {
+      v.SetString(s)
+      return nil
+    }
+    return d.errorf(path, "expected a string, got %s", tokenString(t))
+  case reflect.Bool:
+    if b, ok := t.(bool); ok {
+      v.SetBool(b)
+      return nil
+    }
+    return d.errorf(path, "expected true or false, got %s", tokenString(t))
+  case reflect.Int64:
+    if n, ok := t.(json.Number); ok {
+      if i, err := n.Int64(); err == nil {
+        v.SetInt(i)
+        return nil
+      }
+    }
+    return d.errorf(path, "expected an integer, got %s", tokenString(t))
+  case reflect.Float64:
+    if n, ok := t.(json.Number); ok {
+      if f, err := n.Float64(); err == nil {
+        v.SetFloat(f)
+        return nil
+      }
+    }
+    return d.errorf(path, "expected a number, got %s", tokenString(t))
+  }
+  return d.errorf(path, "can't decode into %s", v.Type())
+}
+
+func (d *awsJSONDecoder) decodeTime(v reflect.Value, path string) (error) {
+  t, err := d.token(path)
+  if err != nil { return err }
+  switch tv := t.(type) {
+  case json.Number:
+    f, err := tv.Float64()
+    if err == nil {
+      tm := time.Unix(0, int64(f * float64(time.Second))).UTC()
+      v.Set(reflect.ValueOf(&tm))
+      return nil
+    }
+  case string:
+    tm, err := time.Parse(time.RFC3339, tv)
+    if err == nil {
+      v.Set(reflect.ValueOf(&tm))
+      return nil
+    }
+  }
+  return d.errorf(path, "expected a timestamp, got %s", tokenString(t))
+}
+
+func tokenString(t json.Token) (string) {
+  switch tv := t.(type) {
+  case json.Delim: return string(tv)
+  case string: return strconv.Quote(tv)
+  case nil: return "null"
+  }
+  return fmt.Sprintf("%v", t)
+}
+
+func joinJSONPath(path, key string) (string) {
+  if path == "" { return key }
+  return path + "." + key
+}
+
+// JSON key -> field index, from the locationName tags.
+func jsonFieldIndex(t reflect.Type) (map[string]int) {
+  fields := make(map[string]int, t.NumField())
+  for i := 0; i < t.NumField(); i++ {
+    if name := jsonFieldName(t.Field(i)); name != "" { fields[name] = i }
+  }
+  return fields
+}
+
+func jsonFieldName(f reflect.StructField) (string) {
+  if f.PkgPath != "" { return "" } // unexported, e.g. the SDK's _ struct{}
+  if name := f.Tag.Get("locationName"); name != "" { return name }
+  return strings.ToLower(f.Name[:1]) + f.Name[1:]
+}
+
+//
+// Encoding
+//
+
+func encodeAWSJSON(w io.Writer, v interface{}) (err error) {
+  var buf bytes.Buffer
+  err = encodeValue(&buf, reflect.ValueOf(v))
+  if err != nil { return err }
+  var out bytes.Buffer
+  err = json.Indent(&out, buf.Bytes(), "", "  ")
+  if err != nil { return err }
+  out.WriteString("\n")
+  _, err = out.WriteTo(w)
+  return err
+}
+
+func encodeValue(buf *bytes.Buffer, v reflect.Value) (error) {
+  switch v.Kind() {
+  case reflect.Ptr:
+    if v.IsNil() {
+      buf.WriteString("null")
+      return nil
+    }
+    if tm, ok := v.Interface().(*time.Time); ok {
+      buf.WriteString(strconv.FormatFloat(float64(tm.UnixNano()) / float64(time.Second), 'f', -1, 64))
+      return nil
+    }
+    return encodeValue(buf, v.Elem())
+  case reflect.Struct:
+    buf.WriteString("{")
+    first := true
+    for i := 0; i < v.NumField(); i++ {
+      name := jsonFieldName(v.Type().Field(i))
+      fv := v.Field(i)
+      if name == "" || isEmptyJSONValue(fv) { continue }
+      if !first { buf.WriteString(",") }
+      first = false
+      buf.WriteString(strconv.Quote(name) + ":")
+      if err := encodeValue(buf, fv); err != nil { return err }
+    }
+    buf.WriteString("}")
+  case reflect.Slice:
+    buf.WriteString("[")
+    for i := 0; i < v.Len(); i++ {
+      if i > 0 { buf.WriteString(",") }
+      if err := encodeValue(buf, v.Index(i)); err != nil { return err }
+    }
+    buf.WriteString("]")
+  case reflect.Map:
+    keys := make([]string, 0, v.Len())
+    for _, k := range v.MapKeys() { keys = append(keys, k.String()) }
+    sort.Strings(keys)
+    buf.WriteString("{")
+    for i, k := range keys {
+      if i > 0 { buf.WriteString(",") }
+      buf.WriteString(strconv.Quote(k) + ":")
+      if err := encodeValue(buf, v.MapIndex(reflect.ValueOf(k))); err != nil { return err }
+    }
+    buf.WriteString("}")
+  case reflect.String:
+    b, _ := json.Marshal(v.String())
+    buf.Write(b)
+  case reflect.Bool:
+    buf.WriteString(strconv.FormatBool(v.Bool()))
+  case reflect.Int64:
+    buf.WriteString(strconv.FormatInt(v.Int(), 10))
+  case reflect.Float64:
+    buf.WriteString(strconv.FormatFloat(v.Float(), 'f', -1, 64))
+  default:
+    return fmt.Errorf("EncodeTaskDefinition: can't encode %s", v.Type())
+  }
+  return nil
+}
+
+// Nil pointers, slices and maps are left out, but empty (non-nil) slices
+// and maps are kept as they mean something different to ECS in a few places.
+func isEmptyJSONValue(v reflect.Value) (bool) {
+  switch v.Kind() {
+  case reflect.Ptr, reflect.Slice, reflect.Map, reflect.Interface:
+    return v.IsNil()
+  }
+  return false
+}
@@ -0,0 +1,207 @@
+package awslib
+
+import(
+  "fmt"
+  "strconv"
+  "strings"
+  "github.com/aws/aws-sdk-go/aws/session"
+  "github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// Problems a task definition would run into that ECS won't tell us about at registration.
+
+type TaskDefinitionProblem struct {
+  // Empty for task level problems.
+  Container string
+  Message string
+}
+
+func (p TaskDefinitionProblem) String() (string) {
+  if p.Container == "" { return p.Message }
+  return fmt.Sprintf("container %s: %s", p.Container, p.Message)
+}
+
+// With a session this also checks memory against the largest container instance
+// in clusterName (if given) and that ECR images are in repositories that exist.
+// Without one (sess == nil) only the offline checks are made.
+// ECR images are only checked against registries we have repositories in, so
+// images from other accounts are not flagged.
+func ValidateTaskDefinition(tdi *ecs.RegisterTaskDefinitionInput, clusterName string,
+  sess *session.Session) (problems []TaskDefinitionProblem, err error) {
+
+  var maxMemory int64
+  var repos map[string]bool
+  if sess != nil {
+    if clusterName != "" {
+      ciMap, err := GetAllContainerInstanceDescriptions(clusterName, sess)
+      if err != nil { return problems, fmt.Errorf("ValidateTaskDefinition: can't get container instances for %s: %s", clusterName, err) }
+      maxMemory = largestRegisteredMemory(ciMap)
+    }
+    rl, err := GetRepositories(sess)
+    if err != nil { return problems, fmt.Errorf("ValidateTaskDefinition: can't get repositories: %s", err) }
+    repos = make(map[string]bool, len(rl))
+    for _, r := range rl {
+      if r.RepositoryUri != nil { repos[*r.RepositoryUri] = true }
+    }
+  }
+
+  return lintTaskDefinition(tdi, maxMemory, repos), err
+}
+
+// maxMemory of 0 and nil repos skip those checks.
+func lintTaskDefinition(tdi *ecs.RegisterTaskDefinitionInput, maxMemory int64, repos map[string]bool) (problems []TaskDefinitionProblem) {
+  add := func(container, f string, args ...interface{}) {
+    problems = append(problems, TaskDefinitionProblem{Container: container, Message: fmt.Sprintf(f, args...)})
+  }
+
+  if len(tdi.ContainerDefinitions) == 0 {
+    add("", "no container definitions")
+    return problems
+  }
+
+  names := make(map[string]int)
+  for _, cd := range tdi.ContainerDefinitions {
+    if cd.Name != nil { names[*cd.Name]++ }
+  }
+  reported := make(map[string]bool)
+  for _, cd := range tdi.ContainerDefinitions {
+    n := stringPString(cd.Name)
+    if names[n] > 1 && !reported[n] {
+      add(n, "name used by %d containers", names[n])
+      reported[n] = true
+    }
+  }
+
+  volumes := make(map[string]bool)
+  for _, v := range tdi.Volumes {
+    if v.Name != nil { volumes[*v.Name] = true }
+  }
+
+  // ECS defaults essential to true.
+  essential := false
+  hostPorts := make(map[string]string)
+  // The containers share the task's network: the host's, or the task's own ENI with awsvpc.
+  sharedNetwork := tdi.NetworkMode != nil &&
+    (*tdi.NetworkMode == ecs.NetworkModeHost || *tdi.NetworkMode == ecs.NetworkModeAwsvpc)
+  var memory int64
+  for _, cd := range tdi.ContainerDefinitions {
+    name := stringPString(cd.Name)
+    if cd.Essential == nil || *cd.Essential { essential = true }
+
+    for _, pm := range cd.PortMappings {
+      hostPort := pm.HostPort
+      // Where the container port is the host port.
+      if sharedNetwork && (hostPort == nil || *hostPort == 0) { hostPort = pm.ContainerPort }
+      if hostPort == nil || *hostPort == 0 { continue }
+      proto := "tcp"
+      if pm.Protocol != nil { proto = *pm.Protocol }
+      port := fmt.Sprintf("%d/%s", *hostPort, proto)
+      if other, ok := hostPorts[port]; ok {
+        add(name, "host port %s is also mapped by %s", port, other)
+      } else {
+        hostPorts[port] = name
+      }
+    }
+
+    for _, l := range cd.Links {
+      linked := strings.Split(*l, ":")[0]
+      if names[linked] == 0 { add(name, "link to unknown container %s", linked) }
+    }
+    for _, vf := range cd.VolumesFrom {
+      if vf.SourceContainer != nil && names[*vf.SourceContainer] == 0 {
+        add(name, "volumesFrom unknown container %s", *vf.SourceContainer)
+      }
+    }
+    for _, mp := range cd.MountPoints {
+      if mp.SourceVolume != nil && !volumes[*mp.SourceVolume] {
+        add(name, "mount point uses undefined volume %s", *mp.SourceVolume)
+      }
+    }
+
+    if cd.Memory != nil {
+      memory += *cd.Memory
+    } else if cd.MemoryReservation != nil {
+      memory += *cd.MemoryReservation
+    }
+
+    if repos != nil && cd.Image != nil {
+      if repo, ok := ecrRepositoryUri(*cd.Image); ok && !repos[repo] && knownRegistry(repo, repos) {
+        add(name, "ECR repository %s does not exist", repo)
+      }
+    }
+  }
+
+  if !essential { add("", "no essential containers") }
+
+  // Task level memory, if set, is what gets reserved.
+  if tdi.Memory != nil {
+    if m, err := parseTaskMemory(*tdi.Memory); err != nil {
+      add("", "%s", err)
+    } else {
+      memory = m
+    }
+  }
+  if maxMemory > 0 && memory > maxMemory {
+    add("", "needs %d MB of memory, the largest container instance has %d MB", memory, maxMemory)
+  }
+
+  return problems
+}
+
+// Task memory is MiB ("1024"), or GB with the unit ("1GB", "1 gb"), the way ECS reads it.
+func parseTaskMemory(memory string) (mb int64, err error) {
+  m := strings.ToUpper(strings.TrimSpace(memory))
+  gb := strings.HasSuffix(m, "GB")
+  if gb { m = strings.TrimSpace(strings.TrimSuffix(m, "GB")) }
+  if gb && strings.Contains(m, ".") {
+    f, ferr := strconv.ParseFloat(m, 64)
+    if ferr == nil && f > 0 { return int64(f * 1024), nil }
+  }
+  mb, err = strconv.ParseInt(m, 10, 64)
+  if err != nil || mb <= 0 { return 0, fmt.Errorf("task memory %q is not a number of MiB or GB", memory) }
+  if gb { mb *= 1024 }
+  return mb, nil
+}
+
+// Task cpu is units ("1024"), or vCPU with the unit ("1 vcpu", "0.5 vCPU"), 1024 units to the vCPU.
+func parseTaskCpu(cpu string) (units int64, err error) {
+  c := strings.ToUpper(strings.TrimSpace(cpu))
+  vcpu := strings.HasSuffix(c, "VCPU")
+  if vcpu { c = strings.TrimSpace(strings.TrimSuffix(c, "VCPU")) }
+  if vcpu && strings.Contains(c, ".") {
+    f, ferr := strconv.ParseFloat(c, 64)
+    if ferr == nil && f > 0 { return int64(f * 1024), nil }
+  }
+  units, err = strconv.ParseInt(c, 10, 64)
+  if err != nil || units <= 0 { return 0, fmt.Errorf("task cpu %q is not a number of cpu units or vCPU", cpu) }
+  if vcpu { units *= 1024 }
+  return units, nil
+}
+
+func largestRegisteredMemory(ciMap ContainerInstanceMap) (max int64) {
+  for _, ci := range ciMap {
+    if ci.Instance == nil { continue }
+    if r, ok := ci.RegisteredResources()[MEMORY]; ok && r.IntegerValue != nil && *r.IntegerValue > max {
+      max = *r.IntegerValue
+    }
+  }
+  return max
+}
+
+// Returns the repository uri (image without tag or digest) if image is in ECR.
+// e.g. 123456789012.dkr.ecr.us-east-1.amazonaws.com/web:1.0 => 123456789012.dkr.ecr.us-east-1.amazonaws.com/web
+func ecrRepositoryUri(image string) (uri string, ok bool) {
+  uri = strings.Split(image, "@")[0]
+  if i := strings.LastIndex(uri, ":"); i > strings.LastIndex(uri, "/") { uri = uri[:i] }
+  host := strings.Split(uri, "/")[0]
+  ok = strings.Contains(host, ".dkr.ecr.") && strings.HasSuffix(host, ".amazonaws.com")
+  return uri, ok
+}
+
+func knownRegistry(repoUri string, repos map[string]bool) (bool) {
+  host := strings.Split(repoUri, "/")[0] + "/"
+  for r, _ := range repos {
+    if strings.HasPrefix(r, host) { return true }
+  }
+  return false
+}
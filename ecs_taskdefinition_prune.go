@@ -0,0 +1,148 @@
+package awslib
+
+import(
+  "fmt"
+  "sort"
+  "github.com/aws/aws-sdk-go/aws/session"
+  "github.com/Sirupsen/logrus"
+)
+
+// Pruning deregisters old revisions of a family, keeping the newest Keep revisions
+// and anything a service deployment or a running task on any cluster still uses.
+
+type PruneRetained struct {
+  Arn string
+  // e.g. "latest 5", "service web on cluster prod", "task on cluster prod"
+  Reason string
+}
+
+type TaskDefinitionPrunePlan struct {
+  Family string
+  Keep int
+  // Newest first.
+  Retained []PruneRetained
+  Deregister []string
+}
+
+type TaskDefinitionPruneReport struct {
+  TaskDefinitionPrunePlan
+  DryRun bool
+  Deregistered []string
+  Failed map[string]error
+}
+
+// Works out what PruneTaskDefinitions would do without doing it.
+func PlanTaskDefinitionPrune(family string, keep int, sess *session.Session) (plan TaskDefinitionPrunePlan, err error) {
+  if keep < 0 { return plan, fmt.Errorf("PlanTaskDefinitionPrune: keep must be 0 or more, got %d", keep) }
+
+  arns, err := ListTaskDefinitionsWithFilter(TaskDefinitionFilter{FamilyPrefix: family, Status: TaskDefinitionActive}, sess)
+  if err != nil { return plan, fmt.Errorf("PlanTaskDefinitionPrune: can't list task definitions for %s: %s", family, err) }
+
+  inUse, err := taskDefinitionsInUse(sess)
+  if err != nil { return plan, err }
+
+  return planTaskDefinitionPrune(family, keep, arns, inUse), err
+}
+
+// Returns a reason for every task definition arn used by a service deployment or a task, on any cluster.
+func taskDefinitionsInUse(sess *session.Session) (inUse map[string]string, err error) {
+  inUse = make(map[string]string)
+  clusters, err := GetClusters(sess)
+  if err != nil { return inUse, fmt.Errorf("PlanTaskDefinitionPrune: can't get clusters: %s", err) }
+
+  for _, cArn := range clusters {
+    clusterName := ShortArnString(cArn)
+    services, failures, err := DescribeServices(clusterName, sess)
+    if err != nil { return inUse, fmt.Errorf("PlanTaskDefinitionPrune: can't describe services on %s: %s", clusterName, err) }
+    if len(failures) > 0 { return inUse, fmt.Errorf("Failed when obtaining service descriptions: %#v.", failures) }
+    for _, s := range services {
+      reason := fmt.Sprintf("service %s on cluster %s", stringPString(s.ServiceName), clusterName)
+      if s.TaskDefinition != nil { inUse[*s.TaskDefinition] = reason }
+      for _, d := range s.Deployments {
+        if d.TaskDefinition != nil { inUse[*d.TaskDefinition] = reason }
+      }
+    }
+
+    ctMap, err := GetAllTaskDescriptions(clusterName, sess)
+    if err != nil { return inUse, fmt.Errorf("PlanTaskDefinitionPrune: can't describe tasks on %s: %s", clusterName, err) }
+    for _, ct := range ctMap {
+      if ct.Task == nil || ct.Task.TaskDefinitionArn == nil { continue }
+      if _, ok := inUse[*ct.Task.TaskDefinitionArn]; !ok {
+        inUse[*ct.Task.TaskDefinitionArn] = fmt.Sprintf("task on cluster %s", clusterName)
+      }
+    }
+  }
+  return inUse, err
+}
+
+// arns may include other families (e.g. from a prefix listing), only family's are considered.
+func planTaskDefinitionPrune(family string, keep int, arns []*string, inUse map[string]string) (plan TaskDefinitionPrunePlan) {
+  plan.Family = family
+  plan.Keep = keep
+
+  revisions := make([]*string, 0, len(arns))
+  for _, arn := range arns {
+    if TaskDefinitionFamily(arn) == family { revisions = append(revisions, arn) }
+  }
+  sort.Slice(revisions, func(i, j int) bool {
+    return TaskDefinitionRevisionNumber(revisions[i]) > TaskDefinitionRevisionNumber(revisions[j])
+  })
+
+  for i, arn := range revisions {
+    switch reason, ok := inUse[*arn]; {
+    case i < keep:
+      plan.Retained = append(plan.Retained, PruneRetained{Arn: *arn, Reason: fmt.Sprintf("latest %d", keep)})
+    case ok:
+      plan.Retained = append(plan.Retained, PruneRetained{Arn: *arn, Reason: reason})
+    default:
+      plan.Deregister = append(plan.Deregister, *arn)
+    }
+  }
+  return plan
+}
+
+// Deregisters all but the newest keep revisions of family, leaving any still in use.
+// With dryRun nothing is deregistered and the report is just the plan.
+// A failure to deregister one revision doesn't stop the others, failures are in the report.
+func PruneTaskDefinitions(family string, keep int, dryRun bool, sess *session.Session) (report TaskDefinitionPruneReport, err error) {
+  report.DryRun = dryRun
+  report.TaskDefinitionPrunePlan, err = PlanTaskDefinitionPrune(family, keep, sess)
+  if err != nil || dryRun { return report, err }
+
+  report.Failed = make(map[string]error)
+  for _, arn := range report.Deregister {
+    _, err := DeregisterTaskDefinition(arn, sess)
+    if err != nil {
+      report.Failed[arn] = err
+      log.Debug(logrus.Fields{"taskDefinition": arn, "error": err}, "PruneTaskDefinitions: failed to deregister.")
+      continue
+    }
+    report.Deregistered = append(report.Deregistered, arn)
+  }
+  if len(report.Failed) > 0 {
+    err = fmt.Errorf("PruneTaskDefinitions: failed to deregister %d of %d revisions of %s", len(report.Failed), len(report.Deregister), family)
+  }
+  return report, err
+}
+
+// e.g.
+// web: keeping 3, deregistering 2
+//   keep web:14 (latest 2)
+//   keep web:9 (service web on cluster prod)
+//   deregister web:8
+func (r TaskDefinitionPruneReport) String() (string) {
+  verb := "deregistering"
+  if r.DryRun { verb = "would deregister" }
+  s := fmt.Sprintf("%s: keeping %d, %s %d\n", r.Family, len(r.Retained), verb, len(r.Deregister))
+  for _, k := range r.Retained {
+    s += fmt.Sprintf("  keep %s (%s)\n", ShortArnString(&k.Arn), k.Reason)
+  }
+  for _, arn := range r.Deregister {
+    if err, ok := r.Failed[arn]; ok {
+      s += fmt.Sprintf("  failed %s: %s\n", ShortArnString(&arn), err)
+    } else {
+      s += fmt.Sprintf("  deregister %s\n", ShortArnString(&arn))
+    }
+  }
+  return s
+}
@@ -0,0 +1,95 @@
+package awslib
+
+import(
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "text/template"
+  "github.com/aws/aws-sdk-go/aws/session"
+  "github.com/aws/aws-sdk-go/service/ecs"
+  "github.com/Sirupsen/logrus"
+  "gopkg.in/yaml.v2"
+)
+
+// Task definitions as Go text/templates, so one file can serve each environment, e.g.:
+//
+// family: web-{{.env}}
+// containerDefinitions:
+//   - name: web
+//     image: repo/web:{{.imageTag}}
+//     memory: {{.memory}}
+//     environment:
+//       - name: CLUSTER
+//         value: {{.clusterName}}
+//
+// The rendered template can be YAML or JSON (in the same shape as the console JSON).
+// In YAML, quote values that have to stay strings, e.g. environment values like "true".
+// A variable used in the template but missing from vars is an error.
+
+// Renders the template and decodes and validates the result.
+// Returns the rendered text as well, for review.
+func RenderTaskDefinitionTemplate(tmpl io.Reader, vars map[string]interface{}) (tdi *ecs.RegisterTaskDefinitionInput, rendered []byte, err error) {
+  text, err := ioutil.ReadAll(tmpl)
+  if err != nil { return nil, nil, err }
+
+  t, err := template.New("taskDefinition").Option("missingkey=error").Parse(string(text))
+  if err != nil { return nil, nil, fmt.Errorf("RenderTaskDefinitionTemplate: bad template: %s", err) }
+  var buf bytes.Buffer
+  err = t.Execute(&buf, vars)
+  if err != nil { return nil, nil, fmt.Errorf("RenderTaskDefinitionTemplate: failed to render: %s", err) }
+  rendered = buf.Bytes()
+
+  jsonBytes := rendered
+  if !looksLikeJSON(rendered) {
+    jsonBytes, err = yamlToJSON(rendered)
+    if err != nil { return nil, rendered, fmt.Errorf("RenderTaskDefinitionTemplate: rendered YAML is bad: %s", err) }
+  }
+
+  // Line and column in errors are in the JSON, which for YAML is not what was rendered.
+  tdi, err = DecodeTaskDefinitionInput(bytes.NewReader(jsonBytes))
+  if err != nil { return nil, rendered, fmt.Errorf("RenderTaskDefinitionTemplate: can't decode the task definition: %s", err) }
+
+  err = tdi.Validate()
+  if err != nil { return nil, rendered, fmt.Errorf("RenderTaskDefinitionTemplate: invalid task definition: %s", err) }
+  return tdi, rendered, err
+}
+
+// Renders the template with vars and registers the result as a new revision, returning its arn.
+func RegisterTaskDefinitionFromTemplate(tmpl io.Reader, vars map[string]interface{}, sess *session.Session) (arn string, err error) {
+  tdi, _, err := RenderTaskDefinitionTemplate(tmpl, vars)
+  if err != nil { return arn, err }
+
+  td, err := RegisterTaskDefinition(tdi, sess)
+  if err != nil { return arn, err }
+  arn = *td.TaskDefinitionArn
+  log.Debug(logrus.Fields{"taskDefinition": arn}, "RegisterTaskDefinitionFromTemplate: registered.")
+  return arn, err
+}
+
+func looksLikeJSON(b []byte) (bool) {
+  t := bytes.TrimSpace(b)
+  return len(t) > 0 && t[0] == '{'
+}
+
+func yamlToJSON(y []byte) ([]byte, error) {
+  var v interface{}
+  err := yaml.Unmarshal(y, &v)
+  if err != nil { return nil, err }
+  return json.Marshal(jsonValue(v))
+}
+
+// yaml.v2 decodes maps as map[interface{}]interface{}, which encoding/json won't take.
+func jsonValue(v interface{}) (interface{}) {
+  switch vt := v.(type) {
+  case map[interface{}]interface{}:
+    m := make(map[string]interface{}, len(vt))
+    for k, e := range vt { m[fmt.Sprintf("%v", k)] = jsonValue(e) }
+    return m
+  case []interface{}:
+    for i, e := range vt { vt[i] = jsonValue(e) }
+    return vt
+  }
+  return v
+}
@@ -0,0 +1,599 @@
+package awslib
+
+import(
+  "bytes"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+  "github.com/aws/aws-sdk-go/aws"
+  "github.com/aws/aws-sdk-go/aws/session"
+  "github.com/aws/aws-sdk-go/service/ecr"
+  "github.com/aws/aws-sdk-go/service/ecs"
+  "github.com/stretchr/testify/assert"
+)
+
+func TestTaskDefinitionRevisionNumber(t *testing.T) {
+  assert.Equal(t, int64(12), TaskDefinitionRevisionNumber(aws.String("arn:aws:ecs:us-east-1:123456789012:task-definition/web:12")))
+  assert.Equal(t, int64(3), TaskDefinitionRevisionNumber(aws.String("web:3")))
+  assert.Equal(t, int64(0), TaskDefinitionRevisionNumber(aws.String("web")))
+}
+
+func TestGroupTaskDefinitions(t *testing.T) {
+  arns := StringPSlice([]string{
+    "arn:aws:ecs:us-east-1:123456789012:task-definition/web:10",
+    "arn:aws:ecs:us-east-1:123456789012:task-definition/api:1",
+    "arn:aws:ecs:us-east-1:123456789012:task-definition/web:9",
+    "arn:aws:ecs:us-east-1:123456789012:task-definition/web:11",
+  })
+
+  groups := GroupTaskDefinitions(arns, false)
+  if assert.Len(t, groups, 2) {
+    assert.Equal(t, "api", groups[0].Family)
+    assert.True(t, groups[0].Revisions[0].Latest)
+    web := groups[1]
+    if assert.Len(t, web.Revisions, 3) {
+      assert.Equal(t, []int64{9, 10, 11}, []int64{web.Revisions[0].Revision, web.Revisions[1].Revision, web.Revisions[2].Revision})
+      assert.False(t, web.Revisions[0].Latest)
+      assert.True(t, web.Revisions[2].Latest)
+    }
+  }
+
+  groups = GroupTaskDefinitions(arns, true)
+  web := groups[1]
+  assert.Equal(t, int64(11), web.Revisions[0].Revision)
+  assert.True(t, web.Revisions[0].Latest)
+}
+
+func testTaskDefinition(arn string) (*ecs.TaskDefinition) {
+  return &ecs.TaskDefinition{
+    TaskDefinitionArn: aws.String(arn),
+    TaskRoleArn: aws.String("arn:aws:iam::123456789012:role/web"),
+    ContainerDefinitions: []*ecs.ContainerDefinition{
+      {
+        Name: aws.String("web"),
+        Image: aws.String("repo/web:1.0"),
+        Memory: aws.Int64(512),
+        Environment: []*ecs.KeyValuePair{
+          {Name: aws.String("LEVEL"), Value: aws.String("info")},
+          {Name: aws.String("OLD"), Value: aws.String("yes")},
+        },
+        PortMappings: []*ecs.PortMapping{{HostPort: aws.Int64(0), ContainerPort: aws.Int64(80), Protocol: aws.String("tcp")}},
+      },
+      {Name: aws.String("sidecar"), Image: aws.String("repo/sidecar:1")},
+    },
+  }
+}
+
+func TestDiffTaskDefinitions(t *testing.T) {
+  a := testTaskDefinition("arn:aws:ecs:us-east-1:123456789012:task-definition/web:12")
+  b := testTaskDefinition("arn:aws:ecs:us-east-1:123456789012:task-definition/web:13")
+  assert.True(t, DiffTaskDefinitions(a, b).Empty())
+
+  b.TaskRoleArn = nil
+  web := b.ContainerDefinitions[0]
+  web.Image = aws.String("repo/web:1.1")
+  web.Memory = aws.Int64(1024)
+  web.Environment = []*ecs.KeyValuePair{
+    {Name: aws.String("LEVEL"), Value: aws.String("debug")},
+    {Name: aws.String("NEW"), Value: aws.String("true")},
+  }
+  b.ContainerDefinitions[1] = &ecs.ContainerDefinition{Name: aws.String("logger"), Image: aws.String("repo/logger:1")}
+
+  d := DiffTaskDefinitions(a, b)
+  assert.Equal(t, "web:12", d.From)
+  assert.Equal(t, []FieldChange{{Field: "taskRoleArn", From: "arn:aws:iam::123456789012:role/web", To: ""}}, d.Changes)
+  if assert.Len(t, d.Containers, 3) {
+    cd := d.Containers[0]
+    assert.Equal(t, "web", cd.Name)
+    assert.Equal(t, []FieldChange{
+      {Field: "image", From: "repo/web:1.0", To: "repo/web:1.1"},
+      {Field: "memory", From: "512", To: "1024"},
+    }, cd.Changes)
+    assert.Equal(t, []EnvChange{
+      {Name: "LEVEL", Change: DiffChanged, From: "info", To: "debug"},
+      {Name: "NEW", Change: DiffAdded, To: "true"},
+      {Name: "OLD", Change: DiffRemoved, From: "yes"},
+    }, cd.Environment)
+    assert.Equal(t, ContainerDiff{Name: "sidecar", Change: DiffRemoved}, d.Containers[1])
+    assert.Equal(t, ContainerDiff{Name: "logger", Change: DiffAdded}, d.Containers[2])
+  }
+
+  s := d.String()
+  assert.Contains(t, s, "image: repo/web:1.0 -> repo/web:1.1")
+  assert.Contains(t, s, "env + NEW=true")
+  _, err := d.JSON()
+  assert.NoError(t, err)
+}
+
+const testTDTemplate = `
+family: web-{{.env}}
+containerDefinitions:
+  - name: web
+    image: repo/web:{{.imageTag}}
+    memory: {{.memory}}
+    environment:
+      - name: CLUSTER
+        value: "{{.clusterName}}"
+`
+
+func TestRenderTaskDefinitionTemplate(t *testing.T) {
+  vars := map[string]interface{}{"env": "staging", "imageTag": "1.2.0", "memory": 512, "clusterName": "staging-cluster"}
+  tdi, rendered, err := RenderTaskDefinitionTemplate(strings.NewReader(testTDTemplate), vars)
+  if assert.NoError(t, err) {
+    assert.Contains(t, string(rendered), "image: repo/web:1.2.0")
+    assert.Equal(t, "web-staging", *tdi.Family)
+    cd := tdi.ContainerDefinitions[0]
+    assert.Equal(t, "repo/web:1.2.0", *cd.Image)
+    assert.Equal(t, int64(512), *cd.Memory)
+    assert.Equal(t, "staging-cluster", *cd.Environment[0].Value)
+  }
+
+  delete(vars, "imageTag")
+  _, _, err = RenderTaskDefinitionTemplate(strings.NewReader(testTDTemplate), vars)
+  assert.Error(t, err, "Expected an error for a missing variable.")
+
+  _, _, err = RenderTaskDefinitionTemplate(strings.NewReader(`{"family": "{{.env}}"}`), map[string]interface{}{"env": "web"})
+  assert.Error(t, err, "Expected a validation error for missing containerDefinitions.")
+}
+
+func TestTaskDefinitionJSONRoundTrip(t *testing.T) {
+  tdi := DefaultTaskDefinition()
+  tdi.ContainerDefinitions[0].DockerLabels = map[string]*string{"team": aws.String("web")}
+
+  var buf bytes.Buffer
+  err := EncodeTaskDefinitionInput(&buf, &tdi)
+  if assert.NoError(t, err) {
+    s := buf.String()
+    assert.Contains(t, s, `"containerDefinitions"`)
+    assert.Contains(t, s, `"portMappings"`)
+    assert.NotContains(t, s, `"hostname"`, "nil fields should be left out.")
+
+    decoded, err := DecodeTaskDefinitionInput(&buf)
+    if assert.NoError(t, err) {
+      assert.Equal(t, tdi, *decoded)
+    }
+  }
+
+  td := testTaskDefinition("arn:aws:ecs:us-east-1:123456789012:task-definition/web:12")
+  registered := time.Unix(1500000000, 0).UTC()
+  td.RegisteredAt = &registered
+  buf.Reset()
+  if assert.NoError(t, EncodeTaskDefinition(&buf, td)) {
+    decoded, err := DecodeTaskDefinition(&buf)
+    if assert.NoError(t, err) {
+      assert.Equal(t, td, decoded)
+    }
+  }
+}
+
+func TestTaskDefinitionJSONStrict(t *testing.T) {
+  _, err := DecodeTaskDefinitionInput(strings.NewReader(`{
+  "family": "web",
+  "containerDefinitions": [
+    {"name": "web", "imag": "repo/web"}
+  ]
+}`))
+  if assert.Error(t, err) {
+    jerr, ok := err.(*TaskDefinitionJSONError)
+    if assert.True(t, ok, "Expected a TaskDefinitionJSONError, got: %s", err) {
+      assert.Equal(t, 4, jerr.Line)
+      assert.Equal(t, "containerDefinitions[0].imag", jerr.Path)
+      assert.Contains(t, jerr.Message, "unknown field")
+    }
+  }
+
+  _, err = DecodeTaskDefinitionInput(strings.NewReader(`{"family": "web", "containerDefinitions": [{"name": "web", "memory": "512"}]}`))
+  if assert.Error(t, err) {
+    assert.Contains(t, err.Error(), "containerDefinitions[0].memory: expected an integer")
+  }
+
+  tdi, err := DecodeTaskDefinitionInput(strings.NewReader(`{"family": "web", "taskRoleArn": null, "containerDefinitions": []}`))
+  if assert.NoError(t, err) {
+    assert.Nil(t, tdi.TaskRoleArn)
+    assert.Equal(t, "web", *tdi.Family)
+  }
+}
+
+func TestLintTaskDefinition(t *testing.T) {
+  repo := "123456789012.dkr.ecr.us-east-1.amazonaws.com/"
+  tdi := &ecs.RegisterTaskDefinitionInput{
+    Family: aws.String("web"),
+    Volumes: []*ecs.Volume{{Name: aws.String("data")}},
+    ContainerDefinitions: []*ecs.ContainerDefinition{
+      {
+        Name: aws.String("web"),
+        Image: aws.String(repo + "web:1.0"),
+        Memory: aws.Int64(512),
+        PortMappings: []*ecs.PortMapping{{HostPort: aws.Int64(80), ContainerPort: aws.Int64(80)}},
+        Links: []*string{aws.String("proxy:proxy")},
+        MountPoints: []*ecs.MountPoint{{SourceVolume: aws.String("data"), ContainerPath: aws.String("/data")}},
+      },
+      {
+        Name: aws.String("proxy"),
+        Image: aws.String("nginx:latest"),
+        Memory: aws.Int64(128),
+        PortMappings: []*ecs.PortMapping{{HostPort: aws.Int64(0), ContainerPort: aws.Int64(80)}},
+      },
+    },
+  }
+  repos := map[string]bool{repo + "web": true}
+  assert.Empty(t, lintTaskDefinition(tdi, 1024, repos))
+  assert.Len(t, lintTaskDefinition(tdi, 512, repos), 1, "Expected the memory check to fail.")
+
+  // Task memory with units, and memory that isn't a number.
+  tdi.Memory = aws.String("1 GB")
+  assert.Empty(t, lintTaskDefinition(tdi, 1024, repos))
+  assert.Len(t, lintTaskDefinition(tdi, 1023, repos), 1)
+  tdi.Memory = aws.String("lots")
+  assert.Equal(t, `task memory "lots" is not a number of MiB or GB`, lintTaskDefinition(tdi, 0, repos)[0].Message)
+  tdi.Memory = nil
+
+  // With host networking the proxy's dynamic port is the container port, which web has.
+  tdi.NetworkMode = aws.String(ecs.NetworkModeHost)
+  if problems := lintTaskDefinition(tdi, 0, repos); assert.Len(t, problems, 1) {
+    assert.Equal(t, "container proxy: host port 80/tcp is also mapped by web", problems[0].String())
+  }
+  tdi.NetworkMode = nil
+
+  proxy := tdi.ContainerDefinitions[1]
+  proxy.Name = aws.String("web")
+  proxy.Essential = aws.Bool(false)
+  proxy.PortMappings[0].HostPort = aws.Int64(80)
+  proxy.VolumesFrom = []*ecs.VolumeFrom{{SourceContainer: aws.String("cache")}}
+  proxy.MountPoints = []*ecs.MountPoint{{SourceVolume: aws.String("logs"), ContainerPath: aws.String("/logs")}}
+  proxy.Image = aws.String(repo + "proxy:1.0")
+  tdi.ContainerDefinitions[0].Essential = aws.Bool(false)
+
+  problems := lintTaskDefinition(tdi, 0, repos)
+  messages := make([]string, len(problems))
+  for i, p := range problems { messages[i] = p.String() }
+  assert.Equal(t, []string{
+    "container web: name used by 2 containers",
+    "container web: link to unknown container proxy",
+    "container web: host port 80/tcp is also mapped by web",
+    "container web: volumesFrom unknown container cache",
+    "container web: mount point uses undefined volume logs",
+    "container web: ECR repository " + repo + "proxy does not exist",
+    "no essential containers",
+  }, messages)
+}
+
+func TestParseTaskMemory(t *testing.T) {
+  for in, want := range map[string]int64{"512": 512, "1GB": 1024, "2 gb": 2048, "0.5GB": 512} {
+    mb, err := parseTaskMemory(in)
+    assert.NoError(t, err, in)
+    assert.Equal(t, want, mb, in)
+  }
+  for _, in := range []string{"", "1 MB", "1.5", "-1", "0"} {
+    _, err := parseTaskMemory(in)
+    assert.Error(t, err, in)
+  }
+}
+
+func TestParseTaskCpu(t *testing.T) {
+  for in, want := range map[string]int64{"256": 256, "1 vcpu": 1024, "2vCPU": 2048, "0.25 vCPU": 256} {
+    units, err := parseTaskCpu(in)
+    assert.NoError(t, err, in)
+    assert.Equal(t, want, units, in)
+  }
+  for _, in := range []string{"", "1 cpu", "0.5", "-1", "0"} {
+    _, err := parseTaskCpu(in)
+    assert.Error(t, err, in)
+  }
+}
+
+func TestECRRepositoryUri(t *testing.T) {
+  uri, ok := ecrRepositoryUri("123456789012.dkr.ecr.us-east-1.amazonaws.com/team/web:1.0")
+  assert.True(t, ok)
+  assert.Equal(t, "123456789012.dkr.ecr.us-east-1.amazonaws.com/team/web", uri)
+  uri, ok = ecrRepositoryUri("123456789012.dkr.ecr.us-east-1.amazonaws.com/web@sha256:abcd")
+  assert.True(t, ok)
+  assert.Equal(t, "123456789012.dkr.ecr.us-east-1.amazonaws.com/web", uri)
+  _, ok = ecrRepositoryUri("localhost:5000/web:1.0")
+  assert.False(t, ok)
+}
+
+func TestPlanTaskDefinitionPrune(t *testing.T) {
+  prefix := "arn:aws:ecs:us-east-1:123456789012:task-definition/"
+  arns := []*string{}
+  for _, r := range []string{"web:1", "web:2", "web:3", "web:4", "web:5", "web-worker:1"} {
+    arns = append(arns, aws.String(prefix + r))
+  }
+  inUse := map[string]string{
+    prefix + "web:2": "service web on cluster prod",
+    prefix + "web:5": "service web on cluster staging",
+    prefix + "web-worker:1": "task on cluster prod",
+  }
+
+  plan := planTaskDefinitionPrune("web", 2, arns, inUse)
+  assert.Equal(t, []PruneRetained{
+    {Arn: prefix + "web:5", Reason: "latest 2"},
+    {Arn: prefix + "web:4", Reason: "latest 2"},
+    {Arn: prefix + "web:2", Reason: "service web on cluster prod"},
+  }, plan.Retained)
+  assert.Equal(t, []string{prefix + "web:3", prefix + "web:1"}, plan.Deregister)
+
+  plan = planTaskDefinitionPrune("web", 0, arns, nil)
+  assert.Empty(t, plan.Retained)
+  assert.Len(t, plan.Deregister, 5)
+}
+
+func TestLatestImage(t *testing.T) {
+  now := time.Now()
+  ids := ImageDetailList{
+    {ImageTags: aws.StringSlice([]string{"1.0"}), ImagePushedAt: aws.Time(now.Add(-2 * time.Hour))},
+    {ImageDigest: aws.String("sha256:abcd"), ImagePushedAt: aws.Time(now)},
+    {ImageTags: aws.StringSlice([]string{"1.1", "latest"}), ImagePushedAt: aws.Time(now.Add(-time.Hour))},
+    {ImageTags: aws.StringSlice([]string{"unknown"})},
+  }
+  repo := "123456789012.dkr.ecr.us-east-1.amazonaws.com/web"
+  assert.Equal(t, repo + "@sha256:abcd", imageReference(repo, latestImage(ids)))
+  assert.Equal(t, repo + ":1.1", imageReference(repo, latestImage(ids[2:])))
+  // Floating tags don't pin anything.
+  latest := &ecr.ImageDetail{ImageTags: aws.StringSlice([]string{"latest", "2.0"}), ImageDigest: aws.String("sha256:ef01")}
+  assert.Equal(t, repo + ":2.0", imageReference(repo, latest))
+  latest.ImageTags = aws.StringSlice([]string{"latest"})
+  assert.Equal(t, repo + "@sha256:ef01", imageReference(repo, latest))
+  assert.Nil(t, latestImage(ids[3:]))
+  assert.Nil(t, latestImage([]*ecr.ImageDetail{}))
+}
+
+func TestSwapImage(t *testing.T) {
+  tdi := TaskDefinitionToInput(testTaskDefinition("arn:aws:ecs:us-east-1:123456789012:task-definition/web:1"))
+  before := make([]string, len(tdi.ContainerDefinitions))
+  for i, cd := range tdi.ContainerDefinitions { before[i] = *cd.Image }
+
+  swapImage(tdi, "web", "repo/web:2.0")
+  for i, cd := range tdi.ContainerDefinitions {
+    if *cd.Name == "web" {
+      assert.Equal(t, "repo/web:2.0", *cd.Image)
+    } else {
+      assert.Equal(t, before[i], *cd.Image)
+    }
+  }
+
+  services := []*ecs.Service{
+    {ServiceName: aws.String("web"), TaskDefinition: aws.String("arn:aws:ecs:us-east-1:123456789012:task-definition/web:1")},
+    {ServiceName: aws.String("worker"), TaskDefinition: aws.String("arn:aws:ecs:us-east-1:123456789012:task-definition/web-worker:1")},
+  }
+  using := servicesUsingFamily(services, "web")
+  assert.Len(t, using, 1)
+  assert.Equal(t, "web", *using[0].ServiceName)
+}
+
+const testCompose = `
+version: "3"
+services:
+  web:
+    image: repo/web:1.0
+    command: serve --port 80
+    environment:
+      LEVEL: info
+      DEBUG:
+    ports:
+      - "8080:80"
+      - 9000
+      - "5353:53/udp"
+      - "127.0.0.1:443:443"
+    volumes:
+      - /var/data:/data:ro
+      - cache:/cache
+      - /scratch
+    links:
+      - redis
+    depends_on:
+      - redis
+    logging:
+      driver: awslogs
+      options:
+        awslogs-group: web
+    mem_limit: 512m
+    build: .
+  redis:
+    image: redis
+    mem_reservation: 268435456
+    ulimits:
+      nofile:
+        soft: 1024
+        hard: 2048
+volumes:
+  cache:
+networks:
+  front:
+`
+
+func TestComposeToTaskDefinition(t *testing.T) {
+  tdi, problems, err := ComposeToTaskDefinition(strings.NewReader(testCompose), "web")
+  assert.NoError(t, err)
+  if assert.Len(t, tdi.ContainerDefinitions, 2) {
+    redis, web := tdi.ContainerDefinitions[0], tdi.ContainerDefinitions[1]
+    assert.Equal(t, int64(256), *redis.MemoryReservation)
+    assert.Equal(t, int64(2048), *redis.Ulimits[0].HardLimit)
+
+    assert.Equal(t, []string{"serve", "--port", "80"}, aws.StringValueSlice(web.Command))
+    assert.Equal(t, map[string]string{"LEVEL": "info"}, keyValuesToMap(web.Environment))
+    assert.Equal(t, "->9000/tcp, 5353->53/udp, 8080->80/tcp", portMappingsString(web.PortMappings))
+    assert.Equal(t, "cache:/cache, var-data:/data(ro), web-scratch:/scratch", mountPointsString(web.MountPoints))
+    assert.Equal(t, "awslogs awslogs-group=web", logConfigurationString(web.LogConfiguration))
+    assert.Equal(t, int64(512), *web.Memory)
+    assert.Equal(t, "redis", *web.DependsOn[0].ContainerName)
+  }
+  assert.Equal(t, "cache, var-data=/var/data, web-scratch", volumesString(tdi.Volumes))
+
+  messages := make([]string, len(problems))
+  for i, p := range problems { messages[i] = p.String() }
+  assert.Equal(t, []string{
+    "networks is not supported",
+    "container web: build is not supported",
+    "container web: environment DEBUG has no value, values from the shell are not supported",
+    "container web: port 127.0.0.1:443:443: binding to an address is not supported",
+  }, messages)
+}
+
+func TestComposeVolumeNameCollisions(t *testing.T) {
+  y := `
+services:
+  web:
+    image: web
+    mem_limit: 512m
+    volumes:
+      - /var/data:/data
+      - /var-data:/other
+      - /cache:/cache
+      - /var/data:/again
+volumes:
+  cache:
+`
+  tdi, problems, err := ComposeToTaskDefinition(strings.NewReader(y), "web")
+  assert.NoError(t, err)
+  assert.Empty(t, problems)
+  assert.Equal(t, "cache, cache-2=/cache, var-data-2=/var-data, var-data=/var/data", volumesString(tdi.Volumes))
+  assert.Equal(t, "cache-2:/cache, var-data-2:/other, var-data:/again, var-data:/data",
+    mountPointsString(tdi.ContainerDefinitions[0].MountPoints))
+}
+
+func TestTaskDefinitionToCompose(t *testing.T) {
+  tdi, _, err := ComposeToTaskDefinition(strings.NewReader(testCompose), "web")
+  assert.NoError(t, err)
+  tdi.ContainerDefinitions[0].Secrets = []*ecs.Secret{{Name: aws.String("PASSWORD"), ValueFrom: aws.String("arn")}}
+  tdi.ExecutionRoleArn = aws.String("arn:aws:iam::123456789012:role/exec")
+
+  var buf bytes.Buffer
+  problems, err := TaskDefinitionToCompose(tdi, &buf)
+  assert.NoError(t, err)
+  assert.Contains(t, buf.String(), "version: \"2.4\"\n")
+  assert.Equal(t, []TaskDefinitionProblem{
+    {Message: "executionRoleArn is not supported"},
+    {Container: "redis", Message: "secrets is not supported"},
+  }, problems)
+
+  again, problems, err := ComposeToTaskDefinition(&buf, "web")
+  assert.NoError(t, err)
+  assert.Empty(t, problems)
+  for i, cd := range again.ContainerDefinitions {
+    d := diffContainerDefinitions(tdi.ContainerDefinitions[i], cd)
+    assert.Empty(t, d.Changes, *cd.Name)
+    assert.Empty(t, d.Environment, *cd.Name)
+  }
+  assert.Equal(t, volumesString(tdi.Volumes), volumesString(again.Volumes))
+}
+
+func TestTaskDefinitionCache(t *testing.T) {
+  prefix := "arn:aws:ecs:us-east-1:123456789012:task-definition/"
+  c := NewTaskDefinitionCache(2)
+  for _, r := range []string{"web:1", "web:2"} { c.add(prefix + r, testTaskDefinition(prefix + r)) }
+
+  // Hits don't need a session.
+  td, err := c.Get(prefix + "web:1", nil)
+  assert.NoError(t, err)
+  assert.Equal(t, prefix + "web:1", *td.TaskDefinitionArn)
+  _, ok := c.lookup(prefix + "web:3")
+  assert.False(t, ok)
+
+  // web:2 is now the least recently used.
+  c.add(prefix + "web:3", testTaskDefinition(prefix + "web:3"))
+  _, ok = c.lookup(prefix + "web:2")
+  assert.False(t, ok)
+  assert.Equal(t, TaskDefinitionCacheStats{Hits: 1, Misses: 2, Size: 2, Capacity: 2}, c.Stats())
+  assert.InDelta(t, 1.0/3.0, c.Stats().HitRate(), 0.001)
+
+  // Callers get a copy.
+  td.ContainerDefinitions[0].Image = aws.String("changed")
+  td, _ = c.Get(prefix + "web:1", nil)
+  assert.Equal(t, "repo/web:1.0", *td.ContainerDefinitions[0].Image)
+
+  // family:revision is keyed on the full arn for the session's account and region.
+  sess := &session.Session{Config: &aws.Config{Region: aws.String("us-east-1")}}
+  c.accounts[sess] = "123456789012"
+  key, err := c.key("web:1", sess)
+  assert.NoError(t, err)
+  assert.Equal(t, prefix + "web:1", key)
+  td, err = c.Get("web:1", sess)
+  assert.NoError(t, err)
+  assert.Equal(t, prefix + "web:1", *td.TaskDefinitionArn)
+  other := &session.Session{Config: &aws.Config{Region: aws.String("eu-west-1")}}
+  c.accounts[other] = "123456789012"
+  key, _ = c.key("web:1", other)
+  assert.Equal(t, "arn:aws:ecs:eu-west-1:123456789012:task-definition/web:1", key)
+  _, err = c.key("web:1", nil)
+  assert.Error(t, err)
+
+  c.Clear()
+  assert.Equal(t, TaskDefinitionCacheStats{Capacity: 2}, c.Stats())
+}
+
+func TestPersistentTaskDefinitionCache(t *testing.T) {
+  prefix := "arn:aws:ecs:us-east-1:123456789012:task-definition/"
+  path := filepath.Join(t.TempDir(), "taskdefinitions.json")
+  c, err := NewPersistentTaskDefinitionCache(2, path)
+  assert.NoError(t, err)
+  for _, r := range []string{"web:1", "web:2", "web:1"} { c.add(prefix + r, testTaskDefinition(prefix + r)) }
+  assert.NoError(t, c.Save())
+
+  loaded, err := NewPersistentTaskDefinitionCache(2, path)
+  assert.NoError(t, err)
+  td, ok := loaded.lookup(prefix + "web:2")
+  if assert.True(t, ok) {
+    assert.Equal(t, testTaskDefinition(prefix + "web:2"), td)
+  }
+  // web:1 was the most recently used when saved, web:2 since loading, so web:1 goes.
+  loaded.add(prefix + "web:3", testTaskDefinition(prefix + "web:3"))
+  _, ok = loaded.lookup(prefix + "web:1")
+  assert.False(t, ok)
+}
+
+func TestTaskDefinitionBuilder(t *testing.T) {
+  tdi, err := NewTaskDefinition().
+    WithFamily("web").
+    WithExecutionRole("arn:aws:iam::123456789012:role/exec").
+    WithFargate("512", "1024").
+    WithContainer("web", "repo/web:1.0").
+      WithPort(8080, 0).
+      WithSecret("DB_PASSWORD", "arn:aws:ssm:us-east-1:123456789012:parameter/db").
+      WithHealthCheck("curl -f http://localhost:8080/ || exit 1", 30 * time.Second, 5 * time.Second, 3).
+      WithAWSLogs("web", "us-east-1", "web").
+    WithContainer("proxy", "repo/proxy:1.0").
+      WithMemory(128).
+      WithDependsOn("web", "HEALTHY").
+    Build()
+  assert.NoError(t, err)
+  assert.Equal(t, "awsvpc", *tdi.NetworkMode)
+  assert.Equal(t, []string{"FARGATE"}, aws.StringValueSlice(tdi.RequiresCompatibilities))
+  web := tdi.ContainerDefinitions[0]
+  assert.True(t, *web.Essential)
+  assert.Equal(t, int64(8080), *web.PortMappings[0].HostPort)
+  assert.Nil(t, web.MemoryReservation, "Task memory is set so no default.")
+  assert.Equal(t, []string{"CMD-SHELL", "curl -f http://localhost:8080/ || exit 1"}, aws.StringValueSlice(web.HealthCheck.Command))
+  assert.Equal(t, int64(30), *web.HealthCheck.Interval)
+
+  b := NewTaskDefinition().WithFamily("worker").WithContainer("worker", "repo/worker")
+  tdi, err = b.Build()
+  assert.NoError(t, err)
+  assert.Equal(t, "bridge", *tdi.NetworkMode)
+  assert.Equal(t, int64(DefaultContainerMemoryReservation), *tdi.ContainerDefinitions[0].MemoryReservation)
+
+  // Carrying on with the builder leaves what it built alone.
+  again, err := b.WithEnv("MODE", "batch").WithContainer("sidecar", "repo/sidecar").WithDependsOn("worker", "START").Build()
+  assert.NoError(t, err)
+  assert.Len(t, tdi.ContainerDefinitions, 1)
+  assert.Empty(t, tdi.ContainerDefinitions[0].Environment)
+  assert.Len(t, again.ContainerDefinitions, 2)
+  assert.Len(t, again.ContainerDefinitions[0].Environment, 1)
+
+  _, err = NewTaskDefinition().
+    WithPort(80, 80).
+    WithFargate("256", "4096").
+    WithContainer("web", "repo/web").
+      WithSecret("TOKEN", "arn").
+      WithDependsOn("db", "READY").
+      WithDependsOn("cache", "START").
+    Build()
+  if assert.Error(t, err) {
+    for _, want := range []string{"WithPortMapping before WithContainer", "not a Fargate size",
+      "unknown dependsOn condition READY", "no family", "need an execution role",
+      "container web: depends on unknown container cache"} {
+      assert.Contains(t, err.Error(), want)
+    }
+  }
+}
@@ -20,8 +20,12 @@ func ListTasks(clusterName string, sess *session.Session) ([]*string, error) {
     Cluster: aws.String(clusterName),
     MaxResults: aws.Int64(100),
   }
-  resp, err := ecsSvc.ListTasks(params)
-  return resp.TaskArns, err
+  arns := make([]*string, 0)
+  err := ecsSvc.ListTasksPages(params, func(page *ecs.ListTasksOutput, lastPage bool) (bool) {
+    arns = append(arns, page.TaskArns...)
+    return true
+  })
+  return arns, err
 }
 
 type ContainerTask struct {
@@ -59,19 +63,49 @@ func GetAllTaskDescriptions(clusterName string, sess *session.Session) (Containe
  taskArns, err := ListTasks(clusterName, sess)
  if err != nil { return make(ContainerTaskMap), err}
 
- // Describe task will fail with no arns.
- if len(taskArns) <= 0 {
-  return make(ContainerTaskMap), nil
- }
+ return DescribeTasks(clusterName, taskArns, sess)
+}
 
+// Describes the tasks, as many calls as it takes.
+func DescribeTasks(clusterName string, taskArns []*string, sess *session.Session) (ContainerTaskMap, error) {
+  // DescribeTasks takes at most 100 tasks at a time, and fails with none.
+  ecsSvc := ecs.New(sess)
+  dto := &ecs.DescribeTasksOutput{}
+  for start := 0; start < len(taskArns); start += 100 {
+    end := start + 100
+    if end > len(taskArns) { end = len(taskArns) }
+    params := &ecs.DescribeTasksInput {
+      Cluster: aws.String(clusterName),
+      Tasks: taskArns[start:end],
+    }
+    resp, err := ecsSvc.DescribeTasks(params)
+    if err != nil { return makeCTMapFromDescribeTasksOutput(dto), err }
+    dto.Tasks = append(dto.Tasks, resp.Tasks...)
+    dto.Failures = append(dto.Failures, resp.Failures...)
+  }
+  return makeCTMapFromDescribeTasksOutput(dto), nil
+}
 
- ecsSvc := ecs.New(sess)
-  params := &ecs.DescribeTasksInput {
-    Cluster: aws.String(clusterName),
-    Tasks: taskArns,
+// The tasks on a container instance, including those ECS is stopping (desired STOPPED), which may
+// well still be running. Check LastStatus, this will include tasks that stopped in the last hour or so.
+func GetContainerInstanceTaskDescriptions(clusterName, containerInstanceArn string, sess *session.Session) (ContainerTaskMap, error) {
+  ecsSvc := ecs.New(sess)
+  arns := make([]*string, 0)
+  // ListTasks only returns one desired status at a time, and defaults to RUNNING.
+  for _, desired := range []string{ecs.DesiredStatusRunning, ecs.DesiredStatusStopped} {
+    params := &ecs.ListTasksInput{
+      Cluster: aws.String(clusterName),
+      ContainerInstance: aws.String(containerInstanceArn),
+      DesiredStatus: aws.String(desired),
+      MaxResults: aws.Int64(100),
+    }
+    err := ecsSvc.ListTasksPages(params, func(page *ecs.ListTasksOutput, lastPage bool) (bool) {
+      arns = append(arns, page.TaskArns...)
+      return true
+    })
+    if err != nil { return make(ContainerTaskMap), err }
   }
-  resp, err := ecsSvc.DescribeTasks(params)
-  return makeCTMapFromDescribeTasksOutput(resp), err
+  return DescribeTasks(clusterName, arns, sess)
 }
 
 func GetTaskDescription(clusterName string, taskArn string, sess *session.Session) (*ecs.DescribeTasksOutput, error) {
@@ -1,8 +1,12 @@
 package awslib
 
 import(
+  "fmt"
   "strconv"
+  "strings"
   "testing"
+  "github.com/aws/aws-sdk-go/aws"
+  "github.com/aws/aws-sdk-go/service/ec2"
   "github.com/aws/aws-sdk-go/service/ecs"
   "github.com/stretchr/testify/assert"
 )
@@ -42,3 +46,361 @@ func TestRMAggregation(t *testing.T) {
   assert.Equal(t, strconv.FormatInt(INT128,10), rm.StringFor(CPU))
 }
 
+func TestCountInstanceTasks(t *testing.T) {
+  ctMap := ContainerTaskMap{
+    "a": {Task: &ecs.Task{Group: aws.String("service:web"), LastStatus: aws.String("RUNNING")}},
+    "b": {Task: &ecs.Task{Group: aws.String("service:web"), LastStatus: aws.String("STOPPED")}},
+    "c": {Task: &ecs.Task{Group: aws.String("family:migrate"), LastStatus: aws.String("PENDING")}},
+    "d": {Failure: &ecs.Failure{Reason: aws.String("MISSING")}},
+  }
+  serviceTasks, otherTasks := countInstanceTasks(ctMap)
+  assert.Equal(t, 1, serviceTasks)
+  assert.Equal(t, 1, otherTasks)
+
+  // Draining stops service tasks straight away, they're still there until they've actually stopped.
+  ctMap["e"] = &ContainerTask{Task: &ecs.Task{Group: aws.String("service:web"),
+    DesiredStatus: aws.String("STOPPED"), LastStatus: aws.String("RUNNING")}}
+  serviceTasks, _ = countInstanceTasks(ctMap)
+  assert.Equal(t, 2, serviceTasks)
+
+  ci := &ecs.ContainerInstance{RunningTasksCount: aws.Int64(2), PendingTasksCount: aws.Int64(1)}
+  assert.Equal(t, int64(3), instanceTaskCount(ci))
+  assert.Equal(t, int64(0), instanceTaskCount(&ecs.ContainerInstance{}))
+}
+
+func testContainerInstance(arn string, cpu, memory int64, ports ...string) (*ContainerInstance) {
+  return &ContainerInstance{Instance: &ecs.ContainerInstance{
+    ContainerInstanceArn: aws.String(arn),
+    Ec2InstanceId: aws.String("i-" + arn),
+    Status: aws.String("ACTIVE"),
+    AgentConnected: aws.Bool(true),
+    RemainingResources: []*ecs.Resource{
+      {Name: aws.String(CPU), Type: aws.String("INTEGER"), IntegerValue: aws.Int64(cpu)},
+      {Name: aws.String(MEMORY), Type: aws.String("INTEGER"), IntegerValue: aws.Int64(memory)},
+      {Name: aws.String(PORTS), Type: aws.String("STRINGSET"), StringSetValue: aws.StringSlice(append([]string{"22"}, ports...))},
+    },
+  }}
+}
+
+func TestCalculateCapacity(t *testing.T) {
+  td := &ecs.TaskDefinition{
+    ContainerDefinitions: []*ecs.ContainerDefinition{
+      {Name: aws.String("web"), Cpu: aws.Int64(256), Memory: aws.Int64(1024), MemoryReservation: aws.Int64(512),
+        PortMappings: []*ecs.PortMapping{{ContainerPort: aws.Int64(80), HostPort: aws.Int64(0)}}},
+      {Name: aws.String("statsd"), Memory: aws.Int64(128),
+        PortMappings: []*ecs.PortMapping{{ContainerPort: aws.Int64(8125), HostPort: aws.Int64(8125), Protocol: aws.String("udp")}}},
+    },
+  }
+  r, err := TaskDefinitionRequirements(td)
+  assert.NoError(t, err)
+  assert.Equal(t, TaskRequirements{Cpu: 256, Memory: 640, UDPPorts: []string{"8125"}}, r)
+
+  draining := testContainerInstance("d", 2048, 8192)
+  draining.Instance.Status = aws.String("DRAINING")
+  ciMap := ContainerInstanceMap{
+    "a": testContainerInstance("a", 1024, 1500),
+    "b": testContainerInstance("b", 512, 8192),
+    "c": testContainerInstance("c", 2048, 8192),
+    "d": draining,
+  }
+  cc := CalculateCapacity(r, ciMap)
+  assert.Equal(t, []InstanceCapacity{
+    {ContainerInstanceArn: "a", Ec2InstanceId: "i-a", Placements: 1, Binding: PORTS_UDP},
+    {ContainerInstanceArn: "b", Ec2InstanceId: "i-b", Placements: 1, Binding: PORTS_UDP},
+    {ContainerInstanceArn: "c", Ec2InstanceId: "i-c", Placements: 1, Binding: PORTS_UDP},
+    {ContainerInstanceArn: "d", Ec2InstanceId: "i-d", Binding: InstanceUnavailable},
+  }, cc.Instances)
+  assert.Equal(t, int64(3), cc.Total)
+  assert.Equal(t, PORTS_UDP, cc.Binding)
+
+  // Without the static port cpu and memory bind.
+  r.UDPPorts = nil
+  cc = CalculateCapacity(r, ciMap)
+  assert.Equal(t, int64(2 + 2 + 8), cc.Total)
+  assert.Equal(t, map[string]int{MEMORY: 1, CPU: 2, InstanceUnavailable: 1}, cc.BindingCounts)
+  assert.Equal(t, CPU, cc.Binding)
+
+  r.Ports = []string{"22"}
+  assert.Equal(t, int64(0), CalculateCapacity(r, ciMap).Total)
+
+  // Host networking binds the container port, awsvpc takes no host ports at all.
+  td.NetworkMode = aws.String(ecs.NetworkModeHost)
+  r, _ = TaskDefinitionRequirements(td)
+  assert.Equal(t, []string{"80"}, r.Ports)
+  td.NetworkMode = aws.String(ecs.NetworkModeAwsvpc)
+  r, _ = TaskDefinitionRequirements(td)
+  assert.Equal(t, TaskRequirements{Cpu: 256, Memory: 640}, r)
+  assert.Equal(t, int64(2 + 2 + 8), CalculateCapacity(r, ciMap).Total)
+
+  // Task level cpu and memory, in any of the forms ECS takes, replace the containers'.
+  td.Cpu, td.Memory = aws.String("0.5 vcpu"), aws.String("1 GB")
+  r, err = TaskDefinitionRequirements(td)
+  assert.NoError(t, err)
+  assert.Equal(t, TaskRequirements{Cpu: 512, Memory: 1024}, r)
+  td.Memory = aws.String("lots")
+  _, err = TaskDefinitionRequirements(td)
+  assert.Error(t, err)
+}
+
+func testPlacementInstance(arn, az string, cpu, memory int64) (*PlacementInstance) {
+  return &PlacementInstance{
+    ContainerInstanceArn: arn,
+    Status: "ACTIVE",
+    RegisteredCpu: cpu, RegisteredMemory: memory,
+    RemainingCpu: cpu, RemainingMemory: memory,
+    UsedPorts: map[string]bool{}, UsedUDPPorts: map[string]bool{},
+    Attributes: map[string]string{"ecs.availability-zone": az, "ecs.instance-type": "t2.medium"},
+    Groups: map[string]int{},
+  }
+}
+
+func placedOn(r PlacementResult) (arns []string) {
+  for _, a := range r.Assignments { arns = append(arns, a.ContainerInstanceArn) }
+  return arns
+}
+
+func TestSimulatePlacement(t *testing.T) {
+  snapshot := func() ([]*PlacementInstance) {
+    return []*PlacementInstance{
+      testPlacementInstance("a", "us-east-1a", 2048, 4096),
+      testPlacementInstance("b", "us-east-1a", 2048, 2048),
+      testPlacementInstance("c", "us-east-1b", 2048, 4096),
+    }
+  }
+  task := PlacementTask{Requirements: TaskRequirements{Cpu: 256, Memory: 1024}, Group: "service:web"}
+  tasks := []PlacementTask{task, task, task, task}
+
+  binpack := []*ecs.PlacementStrategy{{Type: aws.String("binpack"), Field: aws.String("memory")}}
+  r, err := SimulatePlacement(snapshot(), tasks, binpack, nil, nil)
+  assert.NoError(t, err)
+  assert.Equal(t, []string{"b", "b", "a", "a"}, placedOn(r))
+
+  spread := []*ecs.PlacementStrategy{
+    {Type: aws.String("spread"), Field: aws.String("attribute:ecs.availability-zone")},
+    {Type: aws.String("spread"), Field: aws.String("instanceId")},
+  }
+  r, err = SimulatePlacement(snapshot(), tasks, spread, nil, nil)
+  assert.NoError(t, err)
+  assert.Equal(t, []string{"a", "c", "b", "c"}, placedOn(r))
+
+  distinct := []*ecs.PlacementConstraint{{Type: aws.String("distinctInstance")}}
+  r, err = SimulatePlacement(snapshot(), tasks, binpack, distinct, nil)
+  assert.NoError(t, err)
+  assert.Equal(t, []string{"b", "a", "c", ""}, placedOn(r))
+  assert.Equal(t, 1, r.Unplaced)
+  assert.Equal(t, "ruled out by distinctInstance on 3", r.Assignments[3].Reason)
+
+  memberOf := []*ecs.PlacementConstraint{{Type: aws.String("memberOf"), Expression: aws.String("attribute:ecs.availability-zone == us-east-1b")}}
+  r, err = SimulatePlacement(snapshot(), tasks, nil, memberOf, nil)
+  assert.NoError(t, err)
+  assert.Equal(t, []string{"c", "c", "c", "c"}, placedOn(r))
+  r, err = SimulatePlacement(snapshot(), append(tasks, task), nil, memberOf, nil)
+  assert.Equal(t, "ruled out by MEMORY on 1, memberOf on 2", r.Assignments[4].Reason)
+
+  // Placed tasks count towards runningTasksCount.
+  busy := []*ecs.PlacementConstraint{{Type: aws.String("memberOf"), Expression: aws.String("runningTasksCount < 2")}}
+  r, err = SimulatePlacement(snapshot(), append(tasks, task, task, task), binpack, busy, nil)
+  assert.NoError(t, err)
+  assert.Equal(t, []string{"b", "b", "a", "a", "c", "c", ""}, placedOn(r))
+
+  _, err = SimulatePlacement(snapshot(), tasks, []*ecs.PlacementStrategy{{Type: aws.String("binpack"), Field: aws.String("disk")}}, nil, nil)
+  assert.Error(t, err)
+}
+
+func TestClusterQuery(t *testing.T) {
+  a := testPlacementInstance("a", "us-east-1a", 2048, 4096)
+  a.AgentConnected = true
+  a.AgentVersion = "1.14.2"
+  a.RunningTasksCount = 3
+  a.Groups["service:web"] = 2
+  b := testPlacementInstance("b", "us-east-1c", 2048, 4096)
+  b.Attributes["ecs.instance-type"] = "m4.large"
+  b.AgentVersion = "1.20.0"
+  b.Attributes["stack"] = "prod"
+
+  for _, c := range []struct{ expr string; a, b bool }{
+    {"attribute:ecs.instance-type =~ t2.*", true, false},
+    {"attribute:ecs.instance-type matches 't2.*'", true, false},
+    {"attribute:ecs.instance-type !~ t2.*", false, true},
+    {"attribute:ecs.availability-zone in [us-east-1a, us-east-1b]", true, false},
+    {"attribute:ecs.availability-zone not_in (us-east-1a, us-east-1b)", false, true},
+    {"attribute:stack exists", false, true},
+    {"attribute:stack !exists", true, false},
+    {"attribute:stack != prod", true, false},
+    {"task:group == service:web", true, false},
+    {"not(task:group == service:web) || runningTasksCount > 2", true, true},
+    {"agentConnected == true and agentVersion < 1.15", true, false},
+    {"agentVersion >= 1.14.2 && !(attribute:stack equals prod)", true, false},
+    {"registeredAt < 2018-01-01", false, false},
+    {"attribute:stack in []", false, false},
+    {"attribute:stack !in ()", true, true},
+  } {
+    q, err := ParseClusterQuery(c.expr)
+    if !assert.NoError(t, err, c.expr) { continue }
+    results := q.Explain([]*PlacementInstance{a, b})
+    assert.Equal(t, c.a, results[0].Match, c.expr + ": " + results[0].Reason)
+    assert.Equal(t, c.b, results[1].Match, c.expr + ": " + results[1].Reason)
+  }
+
+  q, _ := ParseClusterQuery("attribute:ecs.instance-type =~ t2.* and attribute:ecs.availability-zone == us-east-1a")
+  _, reason := q.Match(b)
+  assert.Equal(t, "attribute:ecs.instance-type is m4.large", reason)
+  _, reason = q.Match(a)
+  assert.Equal(t, "attribute:ecs.instance-type is t2.medium and attribute:ecs.availability-zone is us-east-1a", reason)
+  q, _ = ParseClusterQuery("attribute:stack == prod or attribute:color == blue")
+  _, reason = q.Match(a)
+  assert.Equal(t, "attribute:stack is not set; attribute:color is not set", reason)
+
+  for _, bad := range []string{
+    "", "instance-type == t2.micro", "attribute:x", "attribute:x = y", "attribute:x in a, b",
+    "(attribute:x exists", "attribute:x =~ [", "attribute:x == y z", "attribute:x == 'y",
+    "attribute:x in [a,]", "attribute:x in [,]",
+  } {
+    _, err := ParseClusterQuery(bad)
+    assert.Error(t, err, bad)
+  }
+  _, err := ParseClusterQuery("attribute:x in [a,]")
+  assert.Contains(t, err.Error(), "expected a value in list, got ]")
+}
+
+func TestResourceMapLongAndSubtract(t *testing.T) {
+  rm := make(ResourceMap)
+  rm.Add(&ecs.Resource{Name: aws.String("DISK"), Type: aws.String("LONG"), LongValue: aws.Int64(5000000000)})
+  assert.Equal(t, "5000000000", rm.StringFor("DISK"))
+
+  rm.Add(MEMR)
+  rm.Add(&ecs.Resource{Name: aws.String(PORTS), Type: aws.String("STRINGSET"), StringSetValue: aws.StringSlice([]string{"22", "80", "8080"})})
+  rm.Add(&ecs.Resource{Name: aws.String(PORTS), Type: aws.String("STRINGSET"), StringSetValue: aws.StringSlice([]string{"22", "80"})})
+  assert.Equal(t, "22:2, 80:2, 8080:1", rm.GatheredStringFor(PORTS))
+
+  used := rm.Copy()
+  used.Subtract(&ecs.Resource{Name: aws.String(MEMORY), Type: aws.String("INTEGER"), IntegerValue: aws.Int64(24)})
+  used.Subtract(&ecs.Resource{Name: aws.String(PORTS), Type: aws.String("STRINGSET"), StringSetValue: aws.StringSlice([]string{"80", "443"})})
+  assert.Equal(t, "1000", used.StringFor(MEMORY))
+  assert.Equal(t, "22:2, 80:1, 8080:1", used.GatheredStringFor(PORTS))
+  assert.False(t, used.StringSetContains(PORTS, "443"))
+  assert.Equal(t, strconv.FormatInt(INT1024, 10), rm.StringFor(MEMORY), "Copy should leave the original alone.")
+  assert.Equal(t, "22:2, 80:2, 8080:1", rm.GatheredStringFor(PORTS))
+
+  used.SubtractAll(rm)
+  assert.Equal(t, "-24", used.StringFor(MEMORY))
+}
+
+func TestUtilisationReport(t *testing.T) {
+  ciMap := ContainerInstanceMap{
+    "a": testContainerInstance("a", 1024, 1024, "80"),
+    "b": testContainerInstance("b", 2048, 3072),
+  }
+  for _, ci := range ciMap {
+    ci.Instance.RegisteredResources = []*ecs.Resource{
+      {Name: aws.String(CPU), Type: aws.String("INTEGER"), IntegerValue: aws.Int64(2048)},
+      {Name: aws.String(MEMORY), Type: aws.String("INTEGER"), IntegerValue: aws.Int64(4096)},
+    }
+    ci.Instance.RunningTasksCount = aws.Int64(2)
+    ci.Instance.PendingTasksCount = aws.Int64(0)
+  }
+  r := ciMap.UtilisationReport()
+  if assert.Len(t, r.Instances, 2) {
+    assert.Equal(t, "a", r.Instances[0].ContainerInstanceArn)
+    assert.Equal(t, "50%", r.Instances[0].CpuString())
+    assert.Equal(t, "75%", r.Instances[0].MemoryString())
+    assert.Equal(t, 2, r.Instances[0].PortsInUse)
+    assert.Equal(t, "0%", r.Instances[1].CpuString())
+  }
+  assert.Equal(t, "25%", r.Cluster.CpuString())
+  assert.Equal(t, "50%", r.Cluster.MemoryString())
+  assert.Equal(t, 3, r.Cluster.PortsInUse)
+  assert.Equal(t, int64(4), r.Cluster.Resources.RunningTasks)
+  assert.Contains(t, r.String(), "cluster")
+}
+
+func TestAgentReport(t *testing.T) {
+  version := func(ci *ContainerInstance, agent string) (*ContainerInstance) {
+    ci.Instance.VersionInfo = &ecs.VersionInfo{AgentVersion: aws.String(agent), DockerVersion: aws.String("17.03.2-ce")}
+    return ci
+  }
+  ciMap := ContainerInstanceMap{
+    "a": version(testContainerInstance("a", 0, 0), "1.20.0"),
+    "b": version(testContainerInstance("b", 0, 0), "1.14.2"),
+    "c": version(testContainerInstance("c", 0, 0), "1.20.0"),
+    "d": testContainerInstance("d", 0, 0),
+  }
+  ciMap["c"].Instance.AgentConnected = aws.Bool(false)
+  ciMap["c"].Instance.AgentUpdateStatus = aws.String(ecs.AgentUpdateStatusFailed)
+
+  r := ciMap.AgentReport("")
+  assert.Equal(t, "1.20.0", r.Version)
+  if assert.Len(t, r.Instances, 4) {
+    assert.True(t, r.Instances[0].Healthy())
+    assert.True(t, r.Instances[1].Outdated)
+    assert.Equal(t, []string{"agent 1.14.2 is older than 1.20.0"}, r.Instances[1].Problems)
+    assert.Equal(t, []string{"agent disconnected", "last agent update failed"}, r.Instances[2].Problems)
+    assert.Equal(t, []string{"agent version unknown"}, r.Instances[3].Problems)
+  }
+  assert.Len(t, r.Flagged(), 3)
+  assert.Equal(t, []string{"b"}, r.Updatable())
+
+  r = ciMap.AgentReport("1.21.0")
+  assert.Equal(t, []string{"a", "b"}, r.Updatable(), "c is disconnected, d has no version.")
+}
+
+func TestAgentUpdateState(t *testing.T) {
+  i := &ecs.ContainerInstance{AgentConnected: aws.Bool(false), AgentUpdateStatus: aws.String(ecs.AgentUpdateStatusUpdated)}
+  _, done, _ := agentUpdateState(i)
+  assert.False(t, done, "Not done until the agent reconnects.")
+  i.AgentConnected = aws.Bool(true)
+  _, done, err := agentUpdateState(i)
+  assert.True(t, done)
+  assert.NoError(t, err)
+  i.AgentUpdateStatus = aws.String(ecs.AgentUpdateStatusStaging)
+  status, done, _ := agentUpdateState(i)
+  assert.Equal(t, "STAGING", status)
+  assert.False(t, done)
+  i.AgentUpdateStatus = aws.String(ecs.AgentUpdateStatusFailed)
+  _, done, err = agentUpdateState(i)
+  assert.True(t, done)
+  assert.Error(t, err)
+}
+
+func TestPlanEC2AttributeSync(t *testing.T) {
+  attribute := func(name, value string) (*ecs.Attribute) { return &ecs.Attribute{Name: aws.String(name), Value: aws.String(value)} }
+  a, b, c := testContainerInstance("a", 0, 0), testContainerInstance("b", 0, 0), testContainerInstance("c", 0, 0)
+  a.Instance.Attributes = []*ecs.Attribute{attribute("ecs.instance-type", "m4.large"), attribute("ec2.instance-type", "m4.large")}
+  b.Instance.Attributes = []*ecs.Attribute{attribute("ec2.instance-type", "t2.small"), attribute("ec2.tag.role", "web"), attribute("team", "ops"),
+    attribute("ec2.tag.owner", "bob")}
+  ciMap := ContainerInstanceMap{"a": a, "b": b, "c": c}
+  ec2Map := map[string]*ec2.Instance{
+    "i-a": {InstanceType: aws.String("m4.large"), Placement: &ec2.Placement{AvailabilityZone: aws.String("us-east-1a")},
+      Tags: []*ec2.Tag{{Key: aws.String("role"), Value: aws.String("worker")}, {Key: aws.String("Name"), Value: aws.String("a")}}},
+    "i-b": {InstanceType: aws.String("m4.xlarge"), Placement: &ec2.Placement{AvailabilityZone: aws.String("us-east-1b")},
+      Tags: []*ec2.Tag{{Key: aws.String("owner"), Value: aws.String("bob, alice")}}},
+  }
+  m := EC2AttributeMapping{InstanceType: true, AvailabilityZone: true, Tags: []string{"role", "owner"}}
+
+  s := planEC2AttributeSync(m, ciMap, ec2Map)
+  assert.Equal(t, InstanceAttributes{
+    "a": {"ec2.availability-zone": "us-east-1a", "ec2.tag.role": "worker"},
+    "b": {"ec2.availability-zone": "us-east-1b", "ec2.instance-type": "m4.xlarge"},
+  }, s.Put)
+  // Only our own attributes go, and ones we can't update aren't left with the old value.
+  assert.Equal(t, map[string][]string{"b": {"ec2.tag.owner", "ec2.tag.role"}}, s.Delete)
+  if assert.Len(t, s.Problems, 2) {
+    assert.Contains(t, s.Problems[0], "invalid value \"bob, alice\"")
+    assert.Equal(t, "c: no EC2 instance i-c", s.Problems[1])
+  }
+  assert.Contains(t, s.String(), "put a: ec2.tag.role=worker\n")
+  assert.Contains(t, s.String(), "delete b: ec2.tag.role\n")
+
+  s.Failed["c"] = fmt.Errorf("throttled")
+  s.Failed["a"] = fmt.Errorf("throttled")
+  assert.True(t, strings.HasSuffix(s.String(), "failed a: throttled\nfailed c: throttled\n"))
+}
+
+func TestValidAttribute(t *testing.T) {
+  assert.NoError(t, validAttribute("ec2.tag.role", "web server"))
+  assert.NoError(t, validAttribute("team/owner", "ops@example.com"))
+  assert.Error(t, validAttribute("role!", "web"))
+  assert.Error(t, validAttribute("role", " web"))
+  assert.Error(t, validAttribute("role", ""))
+  assert.NoError(t, validAttribute(`domain\role`, `CORP\ops`))
+}
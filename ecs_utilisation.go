@@ -0,0 +1,79 @@
+package awslib
+
+import(
+  "fmt"
+  "sort"
+  "github.com/aws/aws-sdk-go/aws/session"
+)
+
+// How much of each instance, and of the cluster as a whole, is in use.
+
+type InstanceUtilisation struct {
+  // Empty for the cluster.
+  ContainerInstanceArn string
+  Ec2InstanceId string
+  Resources InstanceResource
+  // Percentages of registered, -1 if unknown.
+  Cpu float64
+  Memory float64
+  // Reserved tcp ports, for the cluster the sum over the instances.
+  PortsInUse int
+}
+
+type UtilisationReport struct {
+  // Busiest (by memory) first.
+  Instances []InstanceUtilisation
+  Cluster InstanceUtilisation
+}
+
+func newInstanceUtilisation(ir InstanceResource) (iu InstanceUtilisation) {
+  iu.Resources = ir
+  iu.Cpu, iu.Memory = -1, -1
+  if pct, ok := ir.Utilisation(CPU); ok { iu.Cpu = pct }
+  if pct, ok := ir.Utilisation(MEMORY); ok { iu.Memory = pct }
+  for _, n := range ir.Remaining.StringSetCounts(PORTS) { iu.PortsInUse += n }
+  return iu
+}
+
+func (ciMap ContainerInstanceMap) UtilisationReport() (r UtilisationReport) {
+  for _, ci := range ciMap {
+    if ci.Instance == nil { continue }
+    iu := newInstanceUtilisation(ci.Resources())
+    iu.ContainerInstanceArn = stringPString(ci.Instance.ContainerInstanceArn)
+    iu.Ec2InstanceId = stringPString(ci.Instance.Ec2InstanceId)
+    r.Instances = append(r.Instances, iu)
+  }
+  sort.Slice(r.Instances, func(i, j int) bool {
+    if r.Instances[i].Memory != r.Instances[j].Memory { return r.Instances[i].Memory > r.Instances[j].Memory }
+    return r.Instances[i].ContainerInstanceArn < r.Instances[j].ContainerInstanceArn
+  })
+  r.Cluster = newInstanceUtilisation(ciMap.Totals())
+  return r
+}
+
+func GetClusterUtilisation(clusterName string, sess *session.Session) (r UtilisationReport, err error) {
+  ciMap, err := GetAllContainerInstanceDescriptions(clusterName, sess)
+  if err != nil { return r, fmt.Errorf("GetClusterUtilisation: can't get container instances for %s: %s", clusterName, err) }
+  return ciMap.UtilisationReport(), err
+}
+
+func (iu InstanceUtilisation) CpuString() (string) { return percentString(iu.Cpu) }
+func (iu InstanceUtilisation) MemoryString() (string) { return percentString(iu.Memory) }
+
+func percentString(pct float64) (string) {
+  if pct < 0 { return "--" }
+  return fmt.Sprintf("%.0f%%", pct)
+}
+
+// e.g.
+// instance               cpu  memory  ports  tasks
+// i-0a1b2c3d4e5f60718    50%     75%      3      4
+// cluster                25%     40%      5      6
+func (r UtilisationReport) String() (string) {
+  line := func(name string, iu InstanceUtilisation) (string) {
+    return fmt.Sprintf("%-20s %5s %7s %6d %6d\n", name, iu.CpuString(), iu.MemoryString(), iu.PortsInUse, iu.Resources.RunningTasks)
+  }
+  s := fmt.Sprintf("%-20s %5s %7s %6s %6s\n", "instance", "cpu", "memory", "ports", "tasks")
+  for _, iu := range r.Instances { s += line(iu.Ec2InstanceId, iu) }
+  return s + line("cluster", r.Cluster)
+}
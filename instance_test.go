@@ -1,6 +1,8 @@
 package awslib
 
 import(
+  "fmt"
+  "math/rand"
   "testing"
   "github.com/stretchr/testify/assert"
 )
@@ -11,4 +13,24 @@ func TestECSConfiguration(t *testing.T) {
   if assert.NoError(t, err){
     assert.Contains(t, configString, "ECS_CLUSTER=")
   }
-}
\ No newline at end of file
+}
+
+func TestContainerInstanceFilters(t *testing.T) {
+  skipOnShort(t)
+  cn := fmt.Sprintf("UNIT-TEST-CLUSTER-%d", rand.Intn(1000))
+  sess := testSession(t)
+  _, err := CreateCluster(cn, sess)
+  if !assert.NoError(t, err, "Error creating cluster \"%s\"", cn) { return }
+  defer DeleteCluster(cn, sess)
+
+  for _, status := range []string{ContainerInstanceActive, ContainerInstanceDraining, ContainerInstanceInactive} {
+    ciMap, err := GetContainerInstanceDescriptionsWithFilter(cn, ContainerInstanceFilter{Status: status}, sess)
+    if assert.NoError(t, err, "Error listing %s instances.", status) {
+      assert.Empty(t, ciMap)
+    }
+  }
+  _, err = GetContainerInstancesWithFilter(cn, ContainerInstanceFilter{Filter: "attribute:ecs.instance-type =~ t2.*"}, sess)
+  assert.NoError(t, err)
+  _, err = GetContainerInstancesWithFilter(cn, ContainerInstanceFilter{Filter: "not a query"}, sess)
+  assert.Error(t, err, "Expected a bad filter to be rejected.")
+}
@@ -78,6 +78,68 @@ func DetachFromDNS(ip, fqdn, comment string, ttl int64, sess *session.Session) (
   return resp.ChangeInfo, err
 }
 
+// One of a set of weighted records sharing a name, SetIdentifier tells them apart.
+type WeightedRecord struct {
+  SetIdentifier string
+  Value string
+  Weight int64
+}
+
+// UPSERTs the weighted records for fqdn in a single change so the weights move together.
+func SetWeightedRecords(fqdn, recordType string, ttl int64, records []WeightedRecord,
+  comment string, sess *session.Session) (*route53.ChangeInfo, error) {
+
+  zone, err := GetHostedZone(fqdn, sess)
+  if err != nil { return nil, err }
+
+  newaddr := strings.ToLower(strings.TrimSuffix(fqdn, ".")) + "."
+  changes := make([]*route53.Change, 0, len(records))
+  for _, r := range records {
+    changes = append(changes, &route53.Change{
+      Action: aws.String("UPSERT"),
+      ResourceRecordSet: &route53.ResourceRecordSet{
+        Name: aws.String(newaddr),
+        Type: aws.String(recordType),
+        SetIdentifier: aws.String(r.SetIdentifier),
+        Weight: aws.Int64(r.Weight),
+        ResourceRecords: []*route53.ResourceRecord{
+          { Value: aws.String(r.Value) },
+        },
+        TTL: aws.Int64(ttl),
+      },
+    })
+  }
+
+  r53Svc := route53.New(sess)
+  params := &route53.ChangeResourceRecordSetsInput{
+    HostedZoneId: zone.Id,
+    ChangeBatch: &route53.ChangeBatch{
+      Comment: aws.String(comment),
+      Changes: changes,
+    },
+  }
+  resp, err := r53Svc.ChangeResourceRecordSets(params)
+  log.Debug(logrus.Fields{"fqdn": newaddr, "type": recordType, "records": records, "zone": *zone.Name,},
+    "SetWeightedRecords: updating weighted records.")
+  if err != nil { return nil, err }
+  return resp.ChangeInfo, err
+}
+
+// Returns the weighted records with exactly the name fqdn.
+func GetWeightedRecords(fqdn string, sess *session.Session) ([]*route53.ResourceRecordSet, error) {
+  records, err := ListDNSRecords(fqdn, sess)
+  if err != nil { return nil, err }
+
+  name := strings.ToLower(strings.TrimSuffix(fqdn, ".")) + "."
+  weighted := make([]*route53.ResourceRecordSet, 0)
+  for _, r := range records {
+    if *r.Name == name && r.SetIdentifier != nil && r.Weight != nil {
+      weighted = append(weighted, r)
+    }
+  }
+  return weighted, err
+}
+
 // Get the hosted zone for the fqdn
 func GetHostedZone(fqdn string, sess *session.Session) (*route53.HostedZone, error) {
 